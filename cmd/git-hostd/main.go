@@ -4,11 +4,18 @@
 package main
 
 import (
+	"context"
 	"flag"
 	"io/ioutil"
+	"net"
 	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
 
 	"github.com/jtolds/gitserve/repo"
+	gs_ssh "github.com/jtolds/gitserve/ssh"
 	"github.com/spacemonkeygo/flagfile"
 	"github.com/spacemonkeygo/spacelog"
 	"github.com/spacemonkeygo/spacelog/setup"
@@ -19,9 +26,16 @@ import (
 )
 
 var (
-	addr       = flag.String("addr", ":7022", "address to listen on for ssh")
+	addr = flag.String("addr", ":7022",
+		"comma-separated addresses to listen on for ssh. unix:<path> is a "+
+			"Unix socket. ignored if systemd passes in sockets")
 	privateKey = flag.String("private_key", "",
-		"path to server private key. If not provided, one will be generated")
+		"path to server private key. If neither this or --host_key_dir are "+
+			"provided, one will be generated")
+	hostKeyDir = flag.String("host_key_dir", "",
+		"If set, a directory of host keys to use, generated on first run. "+
+			"ssh_host_*_key.next keys are announced to clients ahead of a "+
+			"rotation. See the README")
 	shellError = flag.String("shell_error",
 		"Sorry, no interactive shell available.",
 		"the message to display to interactive users")
@@ -35,9 +49,79 @@ var (
 		"If set, the repo to serve. Overrides --repo_base. If neither "+
 			"--repo_base or --repo are set, the current directory is used")
 	authorizedKeys = flag.String("authorized_keys", "",
-		"the authorized key file")
+		"the authorized key file. reloaded on SIGHUP or when it changes")
+	trustedUserCAKeys = flag.String("trusted_user_ca_keys", "",
+		"If set, user certificates signed by the CA keys in this file are "+
+			"accepted. Reloaded on SIGHUP or when it changes.")
+	revokedKeys = flag.String("revoked_keys", "",
+		"If set, a file of keys and certificates to refuse, along with "+
+			"certificates they signed. Requires --trusted_user_ca_keys. "+
+			"Reloaded on SIGHUP or when it changes.")
+	aclFile = flag.String("acl", "",
+		"If set, a file of per-repo permissions and ref protections. See the "+
+			"README. Otherwise anyone who can connect may read and write every "+
+			"repo. reloaded on SIGHUP or when it changes")
+	reloadInterval = flag.Duration("reload_interval", 10*time.Second,
+		"how often to check --authorized_keys, --acl, --webhooks and the "+
+			"certificate files for changes. 0 means only reload on SIGHUP")
+	maxConns = flag.Int("max_conns", 0,
+		"if set, the most concurrent connections to allow")
+	maxConnsPerIP = flag.Int("max_conns_per_ip", 0,
+		"if set, the most concurrent connections to allow from one IP")
+	maxConnsPerUser = flag.Int("max_conns_per_user", 0,
+		"if set, the most concurrent connections to allow from one user")
+	connRate = flag.Float64("conn_rate", 0,
+		"if set, how many new connections per second to allow from one IP")
+	connBurst = flag.Int("conn_burst", 10,
+		"how many new connections one IP may make at once, with --conn_rate")
+	pushRate = flag.Float64("push_rate", 0,
+		"if set, how many pushes per second to allow from one user")
+	pushBurst = flag.Int("push_burst", 5,
+		"how many pushes one user may make at once, with --push_rate")
+	maxAuthFailures = flag.Int("max_auth_failures", 0,
+		"if set, ban IPs with this many failed logins within "+
+			"--auth_failure_window")
+	authFailureWindow = flag.Duration("auth_failure_window", 10*time.Minute,
+		"see --max_auth_failures")
+	banDuration = flag.Duration("ban_duration", 10*time.Minute,
+		"how long IPs are banned for, with --max_auth_failures")
+	handshakeTimeout = flag.Duration("handshake_timeout", 2*time.Minute,
+		"how long clients have to log in. 0 means no limit")
+	idleTimeout = flag.Duration("idle_timeout", 0,
+		"if set, close connections that send nothing for this long")
+	maxSessionDuration = flag.Duration("max_session_duration", 0,
+		"if set, close connections after this long")
+	keepaliveInterval = flag.Duration("keepalive_interval", 0,
+		"if set, how often to check that clients are still there")
+	keepaliveCountMax = flag.Int("keepalive_count_max", 3,
+		"how many keepalives in a row may go unanswered before the "+
+			"connection is closed")
+	proxyProtocolFrom = flag.String("proxy_protocol_from", "",
+		"comma-separated CIDR ranges of proxies that send PROXY protocol "+
+			"headers, e.g. an HAProxy with send-proxy. connections from them "+
+			"must have one")
+	auditLog = flag.String("audit_log", "",
+		"if set, a file to write a JSON record of every login attempt and "+
+			"command to")
+	auditLogMaxSize = flag.Int64("audit_log_max_size", 100*1024*1024,
+		"how big --audit_log may get in bytes before it's rotated. 0 means "+
+			"no limit")
+	auditLogMaxFiles = flag.Int("audit_log_max_files", 10,
+		"how many rotated --audit_log files to keep")
+	webhooks = flag.String("webhooks", "",
+		"if set, a file of HTTP endpoints to notify about pushes. See the "+
+			"README. Reloaded on SIGHUP or when it changes")
+	webhookLog = flag.String("webhook_log", "",
+		"if set, a file to write a JSON record of every webhook delivery "+
+			"attempt to. rotated like --audit_log")
+	webhookAttempts = flag.Int("webhook_attempts", 5,
+		"how many times to try delivering each webhook")
+	webhookRetryDelay = flag.Duration("webhook_retry_delay", 5*time.Second,
+		"how long to wait before retrying a webhook. doubles every retry")
 	debugAddr = flag.String("debug_addr", "127.0.0.1:0",
 		"address to listen on for debug http endpoints")
+	shutdownTimeout = flag.Duration("shutdown_timeout", time.Minute,
+		"how long to let in-flight requests finish after SIGTERM")
 
 	logger = spacelog.GetLogger()
 	mon    = monkit.Package()
@@ -48,12 +132,17 @@ func main() {
 	setup.MustSetup("git-hostd")
 	environment.Register(monkit.Default)
 	go http.ListenAndServe(*debugAddr, present.HTTP(monkit.Default))
+	listeners := listen()
 
 	rh := &repo.RepoHosting{
-		ShellError: *shellError + "\r\n",
-		MOTD:       *motd + "\r\n",
-		RepoBase:   *repoBase,
-		Repo:       *repoPath}
+		ShellError:    *shellError + "\r\n",
+		MOTD:          *motd + "\r\n",
+		RepoBase:      *repoBase,
+		Repo:          *repoPath,
+		Limits:        connLimits(),
+		Timeouts:      connTimeouts(),
+		ProxyProtocol: proxyProtocol(),
+		Audit:         audit()}
 
 	if *privateKey != "" {
 		logger.Noticef("Using %#v as server's private key", *privateKey)
@@ -67,16 +156,181 @@ func main() {
 		}
 	}
 
+	if *hostKeyDir != "" {
+		var err error
+		rh.HostKeys, err = repo.LoadHostKeys(*hostKeyDir)
+		if err != nil {
+			panic(err)
+		}
+	}
+
+	var reloaders []reloader
 	if *authorizedKeys != "" {
-		authorized_bytes, err := ioutil.ReadFile(*authorizedKeys)
+		keys, err := repo.LoadAuthorizedKeysFile(*authorizedKeys)
 		if err != nil {
 			panic(err)
 		}
-		rh.AuthorizedKeys, err = repo.LoadAuthorizedKeys(authorized_bytes)
+		rh.KeySource = keys
+		reloaders = append(reloaders, keys)
+	}
+
+	if *trustedUserCAKeys != "" {
+		cas, err := repo.LoadAuthorizedKeysFile(*trustedUserCAKeys)
 		if err != nil {
 			panic(err)
 		}
+		rh.CertAuthority = &repo.CertAuthority{CAs: cas}
+		reloaders = append(reloaders, cas)
+		if *revokedKeys != "" {
+			revoked, err := repo.LoadAuthorizedKeysFile(*revokedKeys)
+			if err != nil {
+				panic(err)
+			}
+			rh.CertAuthority.Revoked = revoked
+			reloaders = append(reloaders, revoked)
+		}
+	} else if *revokedKeys != "" {
+		panic("--revoked_keys requires --trusted_user_ca_keys")
+	}
+
+	if *aclFile != "" {
+		acl, err := repo.LoadACLFile(*aclFile)
+		if err != nil {
+			panic(err)
+		}
+		rh.ACL = acl
+		rh.Protection = acl
+		reloaders = append(reloaders, acl)
+	}
+
+	if *webhooks != "" {
+		hooks, err := repo.LoadWebhooksFile(*webhooks)
+		if err != nil {
+			panic(err)
+		}
+		rh.Webhooks = &repo.WebhookSender{
+			Targets:     hooks,
+			MaxAttempts: *webhookAttempts,
+			RetryDelay:  *webhookRetryDelay}
+		if *webhookLog != "" {
+			log, err := repo.OpenAuditLog(*webhookLog, *auditLogMaxSize,
+				*auditLogMaxFiles)
+			if err != nil {
+				panic(err)
+			}
+			rh.Webhooks.DeliveryLog = log.LogDelivery
+		}
+		reloaders = append(reloaders, hooks)
+	} else if *webhookLog != "" {
+		panic("--webhook_log requires --webhooks")
+	}
+	go reloadOnHangup(reloaders)
+	if *reloadInterval > 0 {
+		for _, r := range reloaders {
+			go r.Watch(context.Background(), *reloadInterval)
+		}
+	}
+
+	shutdown_done := make(chan struct{})
+	go func() {
+		defer close(shutdown_done)
+		sigs := make(chan os.Signal, 1)
+		signal.Notify(sigs, syscall.SIGTERM, os.Interrupt)
+		sig := <-sigs
+		logger.Noticef("got %v, shutting down", sig)
+		ctx, cancel := context.WithTimeout(context.Background(), *shutdownTimeout)
+		defer cancel()
+		logger.Errore(rh.Shutdown(ctx))
+	}()
+
+	err := rh.Serve(listeners...)
+	if err != gs_ssh.ErrServerClosed {
+		panic(err)
+	}
+	<-shutdown_done
+}
+
+// listen returns the sockets systemd passed in, if any, or listens on
+// --addr.
+func listen() []net.Listener {
+	listeners, err := gs_ssh.InheritedListeners()
+	if err != nil {
+		panic(err)
+	}
+	if len(listeners) > 0 {
+		logger.Noticef("using %d sockets from systemd, ignoring --addr",
+			len(listeners))
+		return listeners
+	}
+	listeners, err = gs_ssh.ListenAll(*addr)
+	if err != nil {
+		panic(err)
 	}
+	return listeners
+}
+
+func audit() repo.AuditSink {
+	if *auditLog == "" {
+		return nil
+	}
+	log, err := repo.OpenAuditLog(*auditLog, *auditLogMaxSize,
+		*auditLogMaxFiles)
+	if err != nil {
+		panic(err)
+	}
+	return log
+}
 
-	panic(rh.ListenAndServe("tcp", *addr))
+func proxyProtocol() *gs_ssh.ProxyProtocol {
+	if *proxyProtocolFrom == "" {
+		return nil
+	}
+	proxies, err := gs_ssh.ParseTrustedProxies(*proxyProtocolFrom)
+	if err != nil {
+		panic(err)
+	}
+	return &gs_ssh.ProxyProtocol{TrustedProxies: proxies}
+}
+
+func connTimeouts() gs_ssh.Timeouts {
+	return gs_ssh.Timeouts{
+		HandshakeTimeout:   *handshakeTimeout,
+		IdleTimeout:        *idleTimeout,
+		MaxSessionDuration: *maxSessionDuration,
+		KeepaliveInterval:  *keepaliveInterval,
+		KeepaliveCountMax:  *keepaliveCountMax}
+}
+
+func connLimits() *gs_ssh.Limits {
+	return &gs_ssh.Limits{
+		MaxConns:          *maxConns,
+		MaxConnsPerIP:     *maxConnsPerIP,
+		MaxConnsPerUser:   *maxConnsPerUser,
+		ConnRate:          *connRate,
+		ConnBurst:         *connBurst,
+		PushRate:          *pushRate,
+		PushBurst:         *pushBurst,
+		MaxAuthFailures:   *maxAuthFailures,
+		AuthFailureWindow: *authFailureWindow,
+		BanDuration:       *banDuration}
+}
+
+type reloader interface {
+	Reload() error
+	Watch(ctx context.Context, interval time.Duration)
+}
+
+// reloadOnHangup reloads everything in reloaders on every SIGHUP.
+func reloadOnHangup(reloaders []reloader) {
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGHUP)
+	for range sigs {
+		logger.Noticef("got SIGHUP, reloading")
+		for _, r := range reloaders {
+			err := r.Reload()
+			if err != nil {
+				logger.Errorf("reload failed, keeping previous version: %v", err)
+			}
+		}
+	}
 }
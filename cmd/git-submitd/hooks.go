@@ -0,0 +1,158 @@
+// Copyright (C) 2014 JT Olds
+// See LICENSE for copying information
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"strings"
+
+	"github.com/jtolds/gitserve/repo"
+	"golang.org/x/crypto/ssh"
+)
+
+// hookProtocolVersion is bumped whenever hookRequest or hookResult change
+// incompatibly.
+const hookProtocolVersion = 1
+
+// maxHookResultSize bounds how much a hook may write to its result file.
+const maxHookResultSize = 1024 * 1024
+
+// hookRequest is the JSON document json-protocol hooks receive on stdin.
+type hookRequest struct {
+	Version        int       `json:"version"`
+	Hook           string    `json:"hook"`
+	Repo           string    `json:"repo,omitempty"`
+	User           string    `json:"user"`
+	UserId         string    `json:"user_id,omitempty"`
+	DisplayName    string    `json:"display_name,omitempty"`
+	Groups         []string  `json:"groups,omitempty"`
+	Remote         string    `json:"remote"`
+	Key            string    `json:"key"`
+	KeyFingerprint string    `json:"key_fingerprint"`
+	Worktree       string    `json:"worktree,omitempty"`
+	Name           string    `json:"name,omitempty"`
+	SubmissionId   string    `json:"submission_id,omitempty"`
+	Refs           []hookRef `json:"refs,omitempty"`
+}
+
+type hookRef struct {
+	Ref string `json:"ref"`
+	Old string `json:"old,omitempty"`
+	New string `json:"new"`
+	Tag string `json:"tag,omitempty"`
+}
+
+// hookResult is the optional JSON document json-protocol hooks may write to
+// file descriptor 3.
+type hookResult struct {
+	// if set, overrides the hook's exit status
+	ExitStatus *uint32 `json:"exit_status,omitempty"`
+	// if set, shown to the user
+	Message string `json:"message,omitempty"`
+
+	// only used by the auth hook. if user_id is unset, the user is identified
+	// by their key.
+	UserId      string   `json:"user_id,omitempty"`
+	DisplayName string   `json:"display_name,omitempty"`
+	Groups      []string `json:"groups,omitempty"`
+}
+
+// newHookRequest fills in the fields common to every hook. ctx is used to
+// find the authenticated user, if there is one yet.
+func newHookRequest(ctx context.Context, hook string, meta ssh.ConnMetadata,
+	key ssh.PublicKey) *hookRequest {
+	req := &hookRequest{
+		Version:        hookProtocolVersion,
+		Hook:           hook,
+		User:           meta.User(),
+		Remote:         meta.RemoteAddr().String(),
+		Key:            strings.TrimSpace(string(ssh.MarshalAuthorizedKey(key))),
+		KeyFingerprint: ssh.FingerprintSHA256(key)}
+	if user := repo.UserFromContext(ctx); user != nil {
+		req.UserId = user.Id
+		req.DisplayName = user.DisplayName
+		req.Groups = user.Groups
+	}
+	return req
+}
+
+// addUpdates fills in the submission id and ref list from the push.
+func (req *hookRequest) addUpdates(submission_id string,
+	updates []repo.RefUpdate) {
+	req.SubmissionId = submission_id
+	for _, update := range updates {
+		req.Refs = append(req.Refs, hookRef{
+			Ref: string(update.Ref),
+			Old: update.Old,
+			New: update.New,
+			Tag: string(update.Tag)})
+	}
+}
+
+// runHook runs a json-protocol hook command, writing req to its stdin and
+// reading an optional hookResult from file descriptor 3. Any result message
+// is written to output.
+func runHook(ctx context.Context, cmd *exec.Cmd, req *hookRequest,
+	output io.Writer) (exit_status uint32, result *hookResult, err error) {
+	defer mon.Task()(&ctx)(&err)
+	req_bytes, err := json.Marshal(req)
+	if err != nil {
+		return 1, nil, err
+	}
+
+	result_file, err := ioutil.TempFile("", "gitserve-hook-")
+	if err != nil {
+		return 1, nil, err
+	}
+	defer result_file.Close()
+	os.Remove(result_file.Name())
+
+	cmd.Stdin = bytes.NewReader(req_bytes)
+	cmd.Stdout = output
+	cmd.Stderr = output
+	cmd.ExtraFiles = []*os.File{result_file}
+	exit_status, err = repo.RunLimited(ctx, hookLimits(), cmd, output)
+	if err != nil {
+		return exit_status, nil, err
+	}
+
+	_, err = result_file.Seek(0, 0)
+	if err != nil {
+		return 1, nil, err
+	}
+	result_bytes, err := ioutil.ReadAll(
+		io.LimitReader(result_file, maxHookResultSize+1))
+	if err != nil {
+		return 1, nil, err
+	}
+	if len(result_bytes) > maxHookResultSize {
+		return 1, nil, fmt.Errorf("%s: result exceeded %d bytes", req.Hook,
+			maxHookResultSize)
+	}
+	if len(bytes.TrimSpace(result_bytes)) == 0 {
+		return exit_status, nil, nil
+	}
+	result = &hookResult{}
+	err = json.Unmarshal(result_bytes, result)
+	if err != nil {
+		return 1, nil, fmt.Errorf("%s: invalid result: %v", req.Hook, err)
+	}
+	if result.ExitStatus != nil {
+		exit_status = *result.ExitStatus
+	}
+	if result.Message != "" && output != nil {
+		_, err = fmt.Fprintln(output, result.Message)
+		if err != nil {
+			return 1, nil, err
+		}
+	}
+	return exit_status, result, nil
+}
@@ -0,0 +1,92 @@
+// Copyright (C) 2014 JT Olds
+// See LICENSE for copying information
+
+//go:build unix
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestRunHook(t *testing.T) {
+	for _, test := range []struct {
+		name   string
+		script string
+		status uint32
+		output string
+		result bool
+		err    bool
+	}{
+		{name: "exit status", script: "cat > /dev/null; exit 4", status: 4},
+		{name: "request", script: "cat",
+			output: `"hook":"presubmit","repo":"proj"`},
+		{name: "result",
+			script: `cat > /dev/null; ` +
+				`echo '{"exit_status": 0, "message": "hi"}' >&3; exit 1`,
+			output: "hi\n", result: true},
+		{name: "bad result", script: "cat > /dev/null; echo '{' >&3",
+			status: 1, err: true},
+	} {
+		var output bytes.Buffer
+		status, result, err := runHook(context.Background(),
+			exec.Command("sh", "-c", test.script),
+			&hookRequest{Hook: "presubmit", Repo: "proj"}, &output)
+		if status != test.status || (result != nil) != test.result ||
+			(err != nil) != test.err {
+			t.Errorf("%s: got %d, %+v, %v", test.name, status, result, err)
+		}
+		if !strings.Contains(output.String(), test.output) {
+			t.Errorf("%s: got output %#v, expected %#v", test.name,
+				output.String(), test.output)
+		}
+	}
+}
+
+func TestRunHookTimeout(t *testing.T) {
+	pid_file := filepath.Join(t.TempDir(), "pid")
+	ctx, cancel := context.WithTimeout(context.Background(),
+		100*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	_, _, err := runHook(ctx, exec.Command("sh", "-c",
+		"sleep 30 & echo $! > "+pid_file+"; sleep 30"),
+		&hookRequest{Hook: "presubmit"}, ioutil.Discard)
+	if err != context.DeadlineExceeded {
+		t.Fatalf("got %v, expected the deadline to pass", err)
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("took %s to give up", elapsed)
+	}
+
+	data, err := ioutil.ReadFile(pid_file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pid, err := strconv.Atoi(strings.TrimSpace(string(data)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for deadline := time.Now().Add(5 * time.Second); ; {
+		// a killed process nobody reaped is a zombie
+		stat, err := ioutil.ReadFile("/proc/" + strconv.Itoa(pid) + "/stat")
+		if syscall.Kill(pid, 0) != nil ||
+			(err == nil && strings.Contains(string(stat), ") Z ")) {
+			break
+		}
+		if time.Now().After(deadline) {
+			syscall.Kill(pid, syscall.SIGKILL)
+			t.Fatalf("background process %d outlived the hook", pid)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
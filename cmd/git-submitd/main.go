@@ -4,14 +4,23 @@
 package main
 
 import (
+	"bytes"
+	"context"
 	"flag"
+	"fmt"
 	"io"
 	"io/ioutil"
+	"net"
 	"net/http"
+	"os"
 	"os/exec"
+	"os/signal"
 	"strings"
+	"syscall"
+	"time"
 
 	"github.com/jtolds/gitserve/repo"
+	gs_ssh "github.com/jtolds/gitserve/ssh"
 	"github.com/spacemonkeygo/flagfile"
 	"github.com/spacemonkeygo/spacelog"
 	"github.com/spacemonkeygo/spacelog/setup"
@@ -22,7 +31,9 @@ import (
 )
 
 var (
-	addr       = flag.String("addr", ":0", "address to listen on for ssh")
+	addr = flag.String("addr", ":0",
+		"comma-separated addresses to listen on for ssh. unix:<path> is a "+
+			"Unix socket. ignored if systemd passes in sockets")
 	privateKey = flag.String("private_key", "id_rsa",
 		"path to server private key")
 	shellError = flag.String("shell_error",
@@ -40,47 +51,300 @@ var (
 		"the subprocess to run on a git repo submission")
 	auth = flag.String("auth", "",
 		"If set, will be run with incoming SSH keys prior to receiving packs. "+
-			"A successful exit status will let a receive go through")
+			"A successful exit status will let a receive go through. The user "+
+			"id to file submissions under may be returned in the JSON result, "+
+			"or printed to stdout with --hook_protocol=argv. If no user id is "+
+			"returned, the key identifies the user.")
+	authorizedKeys = flag.String("authorized_keys", "",
+		"If set, only keys in this authorized_keys file may connect, and their "+
+			"options are enforced. Reloaded on SIGHUP or when it changes.")
+	trustedUserCAKeys = flag.String("trusted_user_ca_keys", "",
+		"If set, user certificates signed by the CA keys in this file are "+
+			"accepted. Reloaded on SIGHUP or when it changes.")
+	revokedKeys = flag.String("revoked_keys", "",
+		"If set, a file of keys and certificates to refuse, along with "+
+			"certificates they signed. Requires --trusted_user_ca_keys. "+
+			"Reloaded on SIGHUP or when it changes.")
+	reloadInterval = flag.Duration("reload_interval", 10*time.Second,
+		"how often to check --authorized_keys and the certificate files for "+
+			"changes. 0 means only reload on SIGHUP")
 	newRepo = flag.String("new_repo", "",
 		"If set, will be run to initiate a new repo. the --repo argument given "+
 			"will be an empty folder that should be a bare git repo when this "+
 			"command is done.")
+	maxConns = flag.Int("max_conns", 0,
+		"if set, the most concurrent connections to allow")
+	maxConnsPerIP = flag.Int("max_conns_per_ip", 0,
+		"if set, the most concurrent connections to allow from one IP")
+	maxConnsPerUser = flag.Int("max_conns_per_user", 0,
+		"if set, the most concurrent connections to allow from one user")
+	connRate = flag.Float64("conn_rate", 0,
+		"if set, how many new connections per second to allow from one IP")
+	connBurst = flag.Int("conn_burst", 10,
+		"how many new connections one IP may make at once, with --conn_rate")
+	pushRate = flag.Float64("push_rate", 0,
+		"if set, how many pushes per second to allow from one user")
+	pushBurst = flag.Int("push_burst", 5,
+		"how many pushes one user may make at once, with --push_rate")
+	maxAuthFailures = flag.Int("max_auth_failures", 0,
+		"if set, ban IPs with this many failed logins within "+
+			"--auth_failure_window")
+	authFailureWindow = flag.Duration("auth_failure_window", 10*time.Minute,
+		"see --max_auth_failures")
+	banDuration = flag.Duration("ban_duration", 10*time.Minute,
+		"how long IPs are banned for, with --max_auth_failures")
+	handshakeTimeout = flag.Duration("handshake_timeout", 2*time.Minute,
+		"how long clients have to log in. 0 means no limit")
+	idleTimeout = flag.Duration("idle_timeout", 0,
+		"if set, close connections that send nothing for this long")
+	maxSessionDuration = flag.Duration("max_session_duration", 0,
+		"if set, close connections after this long")
+	keepaliveInterval = flag.Duration("keepalive_interval", 0,
+		"if set, how often to check that clients are still there")
+	keepaliveCountMax = flag.Int("keepalive_count_max", 3,
+		"how many keepalives in a row may go unanswered before the "+
+			"connection is closed")
+	proxyProtocolFrom = flag.String("proxy_protocol_from", "",
+		"comma-separated CIDR ranges of proxies that send PROXY protocol "+
+			"headers, e.g. an HAProxy with send-proxy. connections from them "+
+			"must have one")
+	auditLog = flag.String("audit_log", "",
+		"if set, a file to write a JSON record of every login attempt and "+
+			"command to")
+	auditLogMaxSize = flag.Int64("audit_log_max_size", 100*1024*1024,
+		"how big --audit_log may get in bytes before it's rotated. 0 means "+
+			"no limit")
+	auditLogMaxFiles = flag.Int("audit_log_max_files", 10,
+		"how many rotated --audit_log files to keep")
 	debugAddr = flag.String("debug_addr", "127.0.0.1:0",
 		"address to listen on for debug http endpoints")
 	maxPushSize = flag.Uint64("max_push_size", 256*1024*1024,
 		"the maximum push size in bytes")
+	submissionIndex = flag.String("submission_index", "",
+		"if set, a file to record every submission and its results in")
+	workers = flag.Int("workers", 0,
+		"if positive, queue submissions and run --inspect with this many "+
+			"workers. requires --submission_index")
+	allowDeletes = flag.Bool("allow_deletes", false,
+		"if true, pushes may delete refs. otherwise deletions are rejected")
+	shutdownTimeout = flag.Duration("shutdown_timeout", time.Minute,
+		"how long to let in-flight submissions finish after SIGTERM")
+	inspectTimeout = flag.Duration("inspect_timeout", 10*time.Minute,
+		"how long --inspect may run before it's killed. 0 means no limit")
+	authTimeout = flag.Duration("auth_timeout", 30*time.Second,
+		"how long --auth may run before the key is rejected. 0 means no limit")
+	newRepoTimeout = flag.Duration("new_repo_timeout", time.Minute,
+		"how long --new_repo may run before it's killed. 0 means no limit")
+	hookCPUTime = flag.Duration("hook_cpu_time", 0,
+		"if set, the most CPU time a hook process may use")
+	hookMemory = flag.Uint64("hook_memory", 0,
+		"if set, the most address space in bytes a hook process may use")
+	hookMaxOutput = flag.Int64("hook_max_output", 10*1024*1024,
+		"the most output in bytes a hook may write before it's killed. "+
+			"0 means no limit")
+	sandbox = flag.Bool("sandbox", false,
+		"if true, run --inspect in a sandbox with a read-only view of the "+
+			"submission and a throwaway checkout of it. Linux only")
+	sandboxPaths = flag.String("sandbox_paths",
+		strings.Join(repo.DefaultSandboxPaths, ","),
+		"comma-separated host paths to expose read-only to --sandbox")
+	sandboxCgroup = flag.String("sandbox_cgroup", "",
+		"if set, a delegated cgroup v2 directory to put each --sandbox in")
+	sandboxMemory = flag.Uint64("sandbox_memory", 0,
+		"if set, the most memory in bytes a --sandbox may use. needs "+
+			"--sandbox_cgroup")
+	sandboxPIDs = flag.Int64("sandbox_pids", 0,
+		"if set, the most processes a --sandbox may have. needs "+
+			"--sandbox_cgroup")
+	sandboxCPUs = flag.Float64("sandbox_cpus", 0,
+		"if set, how many CPUs a --sandbox may use. needs --sandbox_cgroup")
+	hookProtocol = flag.String("hook_protocol", "json",
+		"how --inspect, --auth, and --new_repo receive their arguments. "+
+			"\"json\" writes a JSON document to the hook's stdin and reads an "+
+			"optional JSON result from file descriptor 3. \"argv\" is the "+
+			"legacy flag-based interface.")
 
 	logger = spacelog.GetLogger()
 	mon    = monkit.Package()
 )
 
-func SubmissionHandler(repo_path string, output io.Writer,
-	meta ssh.ConnMetadata, key ssh.PublicKey, name string,
-	tags map[repo.Ref][]repo.Tag) (exit_status uint32, err error) {
-	defer mon.Task()(nil)(&err)
+// listen returns the sockets systemd passed in, if any, or listens on
+// --addr.
+func listen() []net.Listener {
+	listeners, err := gs_ssh.InheritedListeners()
+	if err != nil {
+		panic(err)
+	}
+	if len(listeners) > 0 {
+		logger.Noticef("using %d sockets from systemd, ignoring --addr",
+			len(listeners))
+		return listeners
+	}
+	listeners, err = gs_ssh.ListenAll(*addr)
+	if err != nil {
+		panic(err)
+	}
+	return listeners
+}
+
+func audit() repo.AuditSink {
+	if *auditLog == "" {
+		return nil
+	}
+	log, err := repo.OpenAuditLog(*auditLog, *auditLogMaxSize,
+		*auditLogMaxFiles)
+	if err != nil {
+		panic(err)
+	}
+	return log
+}
+
+func proxyProtocol() *gs_ssh.ProxyProtocol {
+	if *proxyProtocolFrom == "" {
+		return nil
+	}
+	proxies, err := gs_ssh.ParseTrustedProxies(*proxyProtocolFrom)
+	if err != nil {
+		panic(err)
+	}
+	return &gs_ssh.ProxyProtocol{TrustedProxies: proxies}
+}
+
+func connTimeouts() gs_ssh.Timeouts {
+	return gs_ssh.Timeouts{
+		HandshakeTimeout:   *handshakeTimeout,
+		IdleTimeout:        *idleTimeout,
+		MaxSessionDuration: *maxSessionDuration,
+		KeepaliveInterval:  *keepaliveInterval,
+		KeepaliveCountMax:  *keepaliveCountMax}
+}
+
+func connLimits() *gs_ssh.Limits {
+	return &gs_ssh.Limits{
+		MaxConns:          *maxConns,
+		MaxConnsPerIP:     *maxConnsPerIP,
+		MaxConnsPerUser:   *maxConnsPerUser,
+		ConnRate:          *connRate,
+		ConnBurst:         *connBurst,
+		PushRate:          *pushRate,
+		PushBurst:         *pushBurst,
+		MaxAuthFailures:   *maxAuthFailures,
+		AuthFailureWindow: *authFailureWindow,
+		BanDuration:       *banDuration}
+}
+
+func hookLimits() repo.ProcessLimits {
+	return repo.ProcessLimits{
+		CPUTime: *hookCPUTime,
+		Memory:  *hookMemory,
+		Output:  *hookMaxOutput}
+}
+
+// inspectCommand prepares --inspect to run with args, in a sandbox if
+// --sandbox is set. The sandbox's worktree has the first submission tag
+// checked out. done must be called once the command has run.
+func inspectCommand(ctx context.Context, repo_path string,
+	updates []repo.RefUpdate, output io.Writer, args ...string) (
+	cmd *exec.Cmd, done func(), err error) {
+	if !*sandbox {
+		return exec.Command(*inspect, args...), func() {}, nil
+	}
+	box := &repo.Sandbox{
+		Paths:        strings.Split(*sandboxPaths, ","),
+		CgroupParent: *sandboxCgroup,
+		Memory:       *sandboxMemory,
+		PIDs:         *sandboxPIDs,
+		CPUs:         *sandboxCPUs}
+	var rev string
+	for _, update := range updates {
+		if update.Tag != "" {
+			rev = "refs/tags/" + string(update.Tag)
+			break
+		}
+	}
+	sandboxed, err := box.Command(ctx, repo_path, rev, *inspect, args...)
+	if err != nil {
+		return nil, nil, err
+	}
+	return sandboxed.Cmd, func() {
+		if sandboxed.MemoryExceeded() {
+			fmt.Fprintf(output, "\nerror: memory limit of %d bytes exceeded\n",
+				*sandboxMemory)
+		}
+		logger.Errore(sandboxed.Cleanup())
+	}, nil
+}
+
+func SubmissionHandler(ctx context.Context, repo_path string,
+	output io.Writer, meta ssh.ConnMetadata, key ssh.PublicKey, name string,
+	submission_id string, updates []repo.RefUpdate) (
+	exit_status uint32, err error) {
+	defer mon.Task()(&ctx)(&err)
+
+	hook_repo := repo_path
+	if *sandbox {
+		hook_repo = "/repo"
+	}
+
+	if *hookProtocol != "argv" {
+		req := newHookRequest(ctx, "inspect", meta, key)
+		req.Repo = hook_repo
+		req.Name = name
+		req.addUpdates(submission_id, updates)
+		if *sandbox {
+			req.Worktree = "/work"
+		}
+		cmd, done, err := inspectCommand(ctx, repo_path, updates, output)
+		if err != nil {
+			return 1, err
+		}
+		defer done()
+		exit_status, _, err = runHook(ctx, cmd, req, output)
+		return exit_status, err
+	}
 
 	var tag_names []string
-	for _, ref_tags := range tags {
-		for _, ref_tag := range ref_tags {
-			tag_names = append(tag_names, string(ref_tag))
+	for _, update := range updates {
+		if update.Tag != "" {
+			tag_names = append(tag_names, string(update.Tag))
 		}
 	}
 
-	cmd := exec.Command(*inspect,
-		"--repo", repo_path,
+	cmd, done, err := inspectCommand(ctx, repo_path, updates, output,
+		"--repo", hook_repo,
 		"--user", meta.User(),
 		"--remote", meta.RemoteAddr().String(),
 		"--key", strings.TrimSpace(string(ssh.MarshalAuthorizedKey(key))),
 		"--name", name,
 		"--tags", strings.Join(tag_names, "\x00"))
+	if err != nil {
+		return 1, err
+	}
+	defer done()
 	cmd.Stdout = output
 	cmd.Stderr = output
-	return repo.RunExec(cmd)
+	return repo.RunLimited(ctx, hookLimits(), cmd, output)
 }
 
-func NewRepoHandler(repo_path string, output io.Writer, meta ssh.ConnMetadata,
-	key ssh.PublicKey, name string) (err error) {
-	defer mon.Task()(nil)(&err)
+func NewRepoHandler(ctx context.Context, repo_path string, output io.Writer,
+	meta ssh.ConnMetadata, key ssh.PublicKey, name string) (err error) {
+	defer mon.Task()(&ctx)(&err)
+
+	if *hookProtocol != "argv" {
+		req := newHookRequest(ctx, "new_repo", meta, key)
+		req.Repo = repo_path
+		req.Name = name
+		exit_status, _, err := runHook(ctx, exec.Command(*newRepo), req,
+			output)
+		if err != nil {
+			return err
+		}
+		if exit_status != 0 {
+			return fmt.Errorf("new_repo hook failed with status %d", exit_status)
+		}
+		return nil
+	}
+
 	cmd := exec.Command(*newRepo,
 		"--repo", repo_path,
 		"--user", meta.User(),
@@ -89,26 +353,68 @@ func NewRepoHandler(repo_path string, output io.Writer, meta ssh.ConnMetadata,
 		"--name", name)
 	cmd.Stdout = output
 	cmd.Stderr = output
-	return cmd.Run()
+	exit_status, err := repo.RunLimited(ctx, hookLimits(), cmd, output)
+	if err != nil {
+		return err
+	}
+	if exit_status != 0 {
+		return fmt.Errorf("new_repo hook failed with status %d", exit_status)
+	}
+	return nil
 }
 
-func AuthHandler(meta ssh.ConnMetadata, key ssh.PublicKey) (user_id *string,
-	err error) {
-	defer mon.Task()(nil)(&err)
+func AuthHandler(ctx context.Context, meta ssh.ConnMetadata,
+	key ssh.PublicKey) (user *repo.User, err error) {
+	defer mon.Task()(&ctx)(&err)
 	if *auth == "" {
 		return nil, nil
 	}
-	return nil, exec.Command(*auth,
+
+	if *hookProtocol != "argv" {
+		exit_status, result, err := runHook(ctx, exec.Command(*auth),
+			newHookRequest(ctx, "auth", meta, key), nil)
+		if err != nil {
+			return nil, err
+		}
+		if exit_status != 0 {
+			return nil, fmt.Errorf("auth hook failed with status %d", exit_status)
+		}
+		if result == nil || result.UserId == "" {
+			return nil, nil
+		}
+		return &repo.User{
+			Id:          result.UserId,
+			DisplayName: result.DisplayName,
+			Groups:      result.Groups}, nil
+	}
+
+	var stdout bytes.Buffer
+	cmd := exec.Command(*auth,
 		"--user", meta.User(),
 		"--remote", meta.RemoteAddr().String(),
-		"--key", strings.TrimSpace(string(ssh.MarshalAuthorizedKey(key)))).Run()
+		"--key", strings.TrimSpace(string(ssh.MarshalAuthorizedKey(key))))
+	cmd.Stdout = &stdout
+	exit_status, err := repo.RunLimited(ctx, hookLimits(), cmd, nil)
+	if err != nil {
+		return nil, err
+	}
+	if exit_status != 0 {
+		return nil, fmt.Errorf("auth hook failed with status %d", exit_status)
+	}
+	user_id := strings.TrimSpace(stdout.String())
+	if user_id == "" {
+		return nil, nil
+	}
+	return &repo.User{Id: user_id}, nil
 }
 
 func main() {
+	repo.SandboxInit()
 	flagfile.Load()
 	setup.MustSetup("git-submitd")
 	environment.Register(monkit.Default)
 	go http.ListenAndServe(*debugAddr, present.HTTP(monkit.Default))
+	listeners := listen()
 
 	private_bytes, err := ioutil.ReadFile(*privateKey)
 	if err != nil {
@@ -119,19 +425,119 @@ func main() {
 		panic(err)
 	}
 
+	switch *hookProtocol {
+	case "json", "argv":
+	default:
+		panic(fmt.Sprintf("unknown --hook_protocol %#v", *hookProtocol))
+	}
+
 	var new_repo repo.NewRepoHandler
 	if *newRepo != "" {
 		new_repo = NewRepoHandler
 	}
 
-	panic((&repo.RepoSubmissions{
+	// without --auth, anyone may connect, unless only certificates are
+	// accepted
+	var auth_handler repo.AuthHandler
+	if *auth != "" {
+		auth_handler = AuthHandler
+	}
+
+	rs := &repo.RepoSubmissions{
 		PrivateKey:        private_key,
 		ShellError:        *shellError + "\r\n",
 		MOTD:              *motd + "\r\n",
 		StoragePath:       func(string, string) string { return *storage },
 		Clean:             *clean,
 		SubmissionHandler: SubmissionHandler,
-		AuthHandler:       AuthHandler,
+		AuthHandler:       auth_handler,
 		NewRepoHandler:    new_repo,
-		MaxPushSize:       int64(*maxPushSize)}).ListenAndServe("tcp", *addr))
+		MaxPushSize:       int64(*maxPushSize),
+		AllowDeletes:      *allowDeletes,
+		Workers:           *workers,
+		SubmissionTimeout: *inspectTimeout,
+		AuthTimeout:       *authTimeout,
+		NewRepoTimeout:    *newRepoTimeout,
+		Limits:            connLimits(),
+		Timeouts:          connTimeouts(),
+		ProxyProtocol:     proxyProtocol(),
+		Audit:             audit()}
+
+	var key_files []*repo.AuthorizedKeysFile
+	if *authorizedKeys != "" {
+		keys, err := repo.LoadAuthorizedKeysFile(*authorizedKeys)
+		if err != nil {
+			panic(err)
+		}
+		rs.KeySource = keys
+		key_files = append(key_files, keys)
+	}
+
+	if *trustedUserCAKeys != "" {
+		cas, err := repo.LoadAuthorizedKeysFile(*trustedUserCAKeys)
+		if err != nil {
+			panic(err)
+		}
+		rs.CertAuthority = &repo.CertAuthority{CAs: cas}
+		key_files = append(key_files, cas)
+		if *revokedKeys != "" {
+			revoked, err := repo.LoadAuthorizedKeysFile(*revokedKeys)
+			if err != nil {
+				panic(err)
+			}
+			rs.CertAuthority.Revoked = revoked
+			key_files = append(key_files, revoked)
+		}
+	} else if *revokedKeys != "" {
+		panic("--revoked_keys requires --trusted_user_ca_keys")
+	}
+
+	go reloadOnHangup(key_files)
+	if *reloadInterval > 0 {
+		for _, keys := range key_files {
+			go keys.Watch(context.Background(), *reloadInterval)
+		}
+	}
+
+	if *submissionIndex != "" {
+		store, err := repo.OpenFileSubmissionStore(*submissionIndex)
+		if err != nil {
+			panic(err)
+		}
+		defer store.Close()
+		rs.Store = store
+	}
+
+	shutdown_done := make(chan struct{})
+	go func() {
+		defer close(shutdown_done)
+		sigs := make(chan os.Signal, 1)
+		signal.Notify(sigs, syscall.SIGTERM, os.Interrupt)
+		sig := <-sigs
+		logger.Noticef("got %v, shutting down", sig)
+		ctx, cancel := context.WithTimeout(context.Background(), *shutdownTimeout)
+		defer cancel()
+		logger.Errore(rs.Shutdown(ctx))
+	}()
+
+	err = rs.Serve(listeners...)
+	if err != gs_ssh.ErrServerClosed {
+		panic(err)
+	}
+	<-shutdown_done
+}
+
+// reloadOnHangup reloads key_files on every SIGHUP.
+func reloadOnHangup(key_files []*repo.AuthorizedKeysFile) {
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGHUP)
+	for range sigs {
+		logger.Noticef("got SIGHUP, reloading")
+		for _, keys := range key_files {
+			err := keys.Reload()
+			if err != nil {
+				logger.Errorf("reload failed, keeping previous version: %v", err)
+			}
+		}
+	}
 }
@@ -4,46 +4,59 @@
 # See LICENSE for copying information
 #
 
+import os
 import sys
-import time
+import json
 import shutil
-import argparse
 import tempfile
 from subprocess import check_call, check_output, STDOUT
 
-parser = argparse.ArgumentParser()
-parser.add_argument('--repo')
-parser.add_argument('--user')
-parser.add_argument('--remote')
-parser.add_argument('--key')
-parser.add_argument('--name')
-parser.add_argument('--tags')
-args = parser.parse_args()
+# git-submitd sends a JSON description of the submission on stdin. See the
+# README for the fields. (Run git-submitd with --hook_protocol=argv for the
+# old flag-based interface.)
+req = json.load(sys.stdin)
 
-tags = args.tags.split("\x00")
+# deleted refs have no tag
+tags = [ref["tag"] for ref in req.get("refs", []) if ref.get("tag")]
 
 print
 print "Thanks for pushing some code!"
 print "==============================================================="
-print "You are user: %s" % args.user
-print "You pushed to repo: %s" % args.repo
-print "You came from: %s" % args.remote
-print "The repo name is: %s" % args.name
-print "Your public key is: %s..." % args.key[:40]
-print "Tags pushed: %s..." % ", ".join(tags)
+print "You are user: %s" % req["user"]
+print "You pushed to repo: %s" % req["repo"]
+print "You came from: %s" % req["remote"]
+print "The repo name is: %s" % req["name"]
+print "Your public key is: %s..." % req["key"][:40]
+print "Your key fingerprint is: %s" % req["key_fingerprint"]
+print "Your submission id is: %s" % req.get("submission_id", "")
+print "Tags pushed: %s" % ", ".join(tags)
 print
 
-if tags:
+if "worktree" in req:
+  # with --sandbox, the first tag is already checked out for us, and the repo
+  # is read-only.
+  print "You pushed:"
+  check_call(["find", req["worktree"], "-printf", "./%P\n"])
+  print
+elif tags:
   print "You pushed:"
   try:
     worktree = tempfile.mkdtemp()
     # git ls-tree -r is probably better than doing a checkout and then a find,
     # but for demonstrative purposes, showing users how to get the working tree
     # on disk seems useful.
-    check_output(["git", "--git-dir", args.repo, "--work-tree", worktree,
+    check_output(["git", "--git-dir", req["repo"], "--work-tree", worktree,
                 "checkout", "-f", tags[0]], stderr=STDOUT)
     check_call(["find", worktree, "-printf", "./%P\n"])
   finally:
     shutil.rmtree(worktree)
 
   print
+
+# Optionally, hooks can return a structured result on file descriptor 3.
+try:
+  with os.fdopen(3, "w") as result:
+    json.dump({"message": "Submission %s received." %
+        req.get("submission_id", "")}, result)
+except OSError:
+  pass
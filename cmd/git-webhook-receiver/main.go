@@ -0,0 +1,51 @@
+// Copyright (C) 2014 JT Olds
+// See LICENSE for copying information
+
+// git-webhook-receiver accepts git-hostd webhooks and prints their payloads,
+// one JSON object per line, for testing webhook configuration.
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"net/http"
+	"os"
+	"sync"
+
+	"github.com/jtolds/gitserve/repo"
+	"github.com/spacemonkeygo/flagfile"
+	"github.com/spacemonkeygo/spacelog"
+	"github.com/spacemonkeygo/spacelog/setup"
+)
+
+var (
+	addr = flag.String("addr", "127.0.0.1:8080",
+		"address to listen on for webhooks")
+	secret = flag.String("secret", "",
+		"if set, webhooks without a valid signature with this secret are "+
+			"refused")
+	fail = flag.Int("fail", 0,
+		"answer this many webhooks with a 500 first, to test retries")
+
+	logger = spacelog.GetLogger()
+)
+
+func main() {
+	flagfile.Load()
+	setup.MustSetup("git-webhook-receiver")
+
+	// Received is called from concurrent requests
+	var out_mtx sync.Mutex
+	out := json.NewEncoder(os.Stdout)
+	rcv := &repo.WebhookReceiver{
+		Secret: *secret,
+		Fail:   *fail,
+		Received: func(payload *repo.WebhookPayload) {
+			out_mtx.Lock()
+			defer out_mtx.Unlock()
+			logger.Errore(out.Encode(payload))
+		}}
+
+	logger.Noticef("listening on %s", *addr)
+	panic(http.ListenAndServe(*addr, rcv))
+}
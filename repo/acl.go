@@ -0,0 +1,360 @@
+// Copyright (C) 2014 JT Olds
+// See LICENSE for copying information
+
+package repo
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"path"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// Permission is what a user may do to a repo. Each level includes the ones
+// below it.
+type Permission int
+
+const (
+	PermissionNone Permission = iota
+	PermissionRead
+	PermissionWrite
+	// PermissionAdmin is write access plus anything reserved for repo
+	// admins.
+	PermissionAdmin
+)
+
+var permissionNames = []string{"none", "read", "write", "admin"}
+
+func (p Permission) String() string {
+	if p >= 0 && int(p) < len(permissionNames) {
+		return permissionNames[p]
+	}
+	return fmt.Sprintf("Permission(%d)", int(p))
+}
+
+// ParsePermission parses "none", "read", "write" or "admin".
+func ParsePermission(s string) (Permission, error) {
+	for i, name := range permissionNames {
+		if s == name {
+			return Permission(i), nil
+		}
+	}
+	return PermissionNone, fmt.Errorf("unknown permission %#v", s)
+}
+
+// ACL decides what a connected key may do to a repo. repo is the repo's
+// canonical name under RepoHosting.RepoBase, like team/project, without
+// surrounding slashes or a .git suffix. If RepoHosting.Repo is set, or
+// neither it nor RepoBase are, there's only one repo, and repo is empty.
+type ACL interface {
+	Permission(ctx context.Context, meta ssh.ConnMetadata, key ssh.PublicKey,
+		repo string) (Permission, error)
+}
+
+// StaticACL is an ACL read from a config file by ParseACL.
+type StaticACL struct {
+	// users maps marshaled keys to user names
+	users   map[string]string
+	groups  map[string][]string
+	grants  []aclGrant
+	protect []aclProtection
+}
+
+type aclGrant struct {
+	pattern    string
+	principal  string
+	permission Permission
+}
+
+type aclProtection struct {
+	pattern string
+	rule    RefRule
+	// if set, only these principals may update matching refs
+	writers []string
+}
+
+var (
+	_ ACL           = (*StaticACL)(nil)
+	_ RefProtection = (*StaticACL)(nil)
+)
+
+// ParseACL parses an ACL config file. Blank lines and lines starting with #
+// are ignored. Other lines are one of:
+//
+//	user <name> <authorized_keys style key>
+//	group <name> <member> [<member>...]
+//	repo <pattern> <principal> <none|read|write|admin>
+//	protect <pattern> <ref pattern> <rule> [<rule>...]
+//
+// user lines name keys; a user may have several. Users with certificates
+// are named by their certificate's first principal instead, and don't need
+// user lines. group lines collect users.
+// repo lines grant a principal a permission on every repo whose name matches
+// pattern, using path.Match. A * doesn't match across a /, so team/* covers
+// team/proj but not team/proj/sub, which needs team/*/* or a pattern of its
+// own. A principal is a user name, @group, a key fingerprint like
+// SHA256:..., or * for everyone. A key gets the highest permission any
+// matching repo line grants it, or none.
+//
+// protect lines add a RefRule for refs matching ref pattern in every repo
+// matching pattern, which matches as for repo lines. Rules are no-delete,
+// no-force, signed, and writers=<principal>[,<principal>...], which makes
+// the refs read-only to everyone else.
+func ParseACL(data []byte) (*StaticACL, error) {
+	acl := &StaticACL{
+		users:  map[string]string{},
+		groups: map[string][]string{}}
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for lineno := 1; scanner.Scan(); lineno++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		err := acl.parseLine(strings.Fields(line))
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %v", lineno, err)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return acl, nil
+}
+
+func (acl *StaticACL) parseLine(fields []string) error {
+	switch fields[0] {
+	case "user":
+		if len(fields) < 3 {
+			return fmt.Errorf("usage: user <name> <key>")
+		}
+		key, _, _, _, err := ssh.ParseAuthorizedKey(
+			[]byte(strings.Join(fields[2:], " ")))
+		if err != nil {
+			return err
+		}
+		acl.users[aclKeyId(key)] = fields[1]
+	case "group":
+		if len(fields) < 3 {
+			return fmt.Errorf("usage: group <name> <member>...")
+		}
+		acl.groups[fields[1]] = append(acl.groups[fields[1]], fields[2:]...)
+	case "repo":
+		if len(fields) != 4 {
+			return fmt.Errorf("usage: repo <pattern> <principal> <permission>")
+		}
+		if _, err := path.Match(fields[1], ""); err != nil {
+			return fmt.Errorf("bad pattern %#v: %v", fields[1], err)
+		}
+		permission, err := ParsePermission(fields[3])
+		if err != nil {
+			return err
+		}
+		acl.grants = append(acl.grants, aclGrant{
+			pattern:    fields[1],
+			principal:  fields[2],
+			permission: permission})
+	case "protect":
+		if len(fields) < 4 {
+			return fmt.Errorf("usage: protect <pattern> <ref pattern> <rule>...")
+		}
+		for _, pattern := range fields[1:3] {
+			if _, err := path.Match(pattern, ""); err != nil {
+				return fmt.Errorf("bad pattern %#v: %v", pattern, err)
+			}
+		}
+		protection := aclProtection{
+			pattern: fields[1],
+			rule:    RefRule{Pattern: fields[2]}}
+		for _, rule := range fields[3:] {
+			switch {
+			case rule == "no-delete":
+				protection.rule.NoDelete = true
+			case rule == "no-force":
+				protection.rule.NoForce = true
+			case rule == "signed":
+				protection.rule.RequireSigned = true
+			case strings.HasPrefix(rule, "writers="):
+				protection.writers = append(protection.writers,
+					strings.Split(strings.TrimPrefix(rule, "writers="), ",")...)
+			default:
+				return fmt.Errorf("unknown rule %#v", rule)
+			}
+		}
+		acl.protect = append(acl.protect, protection)
+	default:
+		return fmt.Errorf("unknown directive %#v", fields[0])
+	}
+	return nil
+}
+
+// LoadACL reads and parses the ACL config file at path.
+func LoadACL(path string) (*StaticACL, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	acl, err := ParseACL(data)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	return acl, nil
+}
+
+func aclKeyId(key ssh.PublicKey) string {
+	return string(key.Marshal())
+}
+
+// User returns the name the ACL gives key, or "" if it doesn't know it.
+func (acl *StaticACL) User(key ssh.PublicKey) string {
+	return acl.users[aclKeyId(key)]
+}
+
+// connUser returns who the connection is: the principal of its certificate,
+// if it used one, or else the name the ACL gives its key.
+func (acl *StaticACL) connUser(meta ssh.ConnMetadata,
+	key ssh.PublicKey) string {
+	if user := connUser(meta); user != "" {
+		return user
+	}
+	return acl.User(key)
+}
+
+func (acl *StaticACL) matches(principal, user string,
+	key ssh.PublicKey) bool {
+	switch {
+	case principal == "*":
+		return true
+	case strings.HasPrefix(principal, "SHA256:"):
+		return principal == ssh.FingerprintSHA256(key)
+	case strings.HasPrefix(principal, "@"):
+		if user == "" {
+			return false
+		}
+		for _, member := range acl.groups[principal[1:]] {
+			if member == user {
+				return true
+			}
+		}
+		return false
+	}
+	return user != "" && principal == user
+}
+
+func (acl *StaticACL) Permission(ctx context.Context, meta ssh.ConnMetadata,
+	key ssh.PublicKey, repo string) (permission Permission, err error) {
+	user := acl.connUser(meta, key)
+	for _, grant := range acl.grants {
+		if grant.permission <= permission {
+			continue
+		}
+		if matched, _ := path.Match(grant.pattern, repo); !matched {
+			continue
+		}
+		if acl.matches(grant.principal, user, key) {
+			permission = grant.permission
+		}
+	}
+	return permission, nil
+}
+
+func (acl *StaticACL) RefRules(ctx context.Context, meta ssh.ConnMetadata,
+	key ssh.PublicKey, repo string) (rules []RefRule, err error) {
+	user := acl.connUser(meta, key)
+	for _, protection := range acl.protect {
+		if matched, _ := path.Match(protection.pattern, repo); !matched {
+			continue
+		}
+		rule := protection.rule
+		if len(protection.writers) > 0 {
+			rule.ReadOnly = true
+			for _, writer := range protection.writers {
+				if acl.matches(writer, user, key) {
+					rule.ReadOnly = false
+					break
+				}
+			}
+		}
+		rules = append(rules, rule)
+	}
+	return rules, nil
+}
+
+// ACLFile is an ACL and RefProtection backed by an ACL config file, which
+// can be reloaded while connections are using it. If reloading fails, the
+// last successfully loaded version stays in effect.
+type ACLFile struct {
+	Path string
+
+	mtx  sync.Mutex
+	acl  *StaticACL
+	stat fileStat
+}
+
+var (
+	_ ACL           = (*ACLFile)(nil)
+	_ RefProtection = (*ACLFile)(nil)
+)
+
+// LoadACLFile loads the ACL config file at path.
+func LoadACLFile(path string) (*ACLFile, error) {
+	f := &ACLFile{Path: path}
+	return f, f.Reload()
+}
+
+// Reload rereads the file, replacing the current ACL if it parses.
+func (f *ACLFile) Reload() error {
+	stat, err := statFile(f.Path)
+	if err != nil {
+		return err
+	}
+	acl, err := LoadACL(f.Path)
+	if err != nil {
+		return err
+	}
+	f.mtx.Lock()
+	f.acl = acl
+	f.stat = stat
+	f.mtx.Unlock()
+	logger.Noticef("loaded ACL from %s", f.Path)
+	return nil
+}
+
+func (f *ACLFile) current() *StaticACL {
+	f.mtx.Lock()
+	defer f.mtx.Unlock()
+	return f.acl
+}
+
+func (f *ACLFile) loaded() fileStat {
+	f.mtx.Lock()
+	defer f.mtx.Unlock()
+	return f.stat
+}
+
+// Watch reloads the file whenever it changes, checking every interval,
+// until ctx is canceled. Reload errors are logged.
+func (f *ACLFile) Watch(ctx context.Context, interval time.Duration) {
+	watchFile(ctx, f.Path, interval, f.loaded, f.Reload)
+}
+
+// User is as for StaticACL.User.
+func (f *ACLFile) User(key ssh.PublicKey) string {
+	return f.current().User(key)
+}
+
+func (f *ACLFile) Permission(ctx context.Context, meta ssh.ConnMetadata,
+	key ssh.PublicKey, repo string) (Permission, error) {
+	return f.current().Permission(ctx, meta, key, repo)
+}
+
+func (f *ACLFile) RefRules(ctx context.Context, meta ssh.ConnMetadata,
+	key ssh.PublicKey, repo string) ([]RefRule, error) {
+	return f.current().RefRules(ctx, meta, key, repo)
+}
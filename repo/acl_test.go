@@ -0,0 +1,201 @@
+// Copyright (C) 2014 JT Olds
+// See LICENSE for copying information
+
+package repo
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"reflect"
+	"strings"
+	"testing"
+
+	"golang.org/x/crypto/ssh"
+)
+
+func testKey(t *testing.T) ssh.PublicKey {
+	pub, _, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, err := ssh.NewPublicKey(pub)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return key
+}
+
+func authorizedKey(key ssh.PublicKey) string {
+	return strings.TrimSpace(string(ssh.MarshalAuthorizedKey(key)))
+}
+
+// principalConn is a connection that authenticated with a certificate for
+// principal.
+func principalConn(principal string) ssh.ConnMetadata {
+	return &ssh.ServerConn{Permissions: &ssh.Permissions{
+		Extensions: map[string]string{userExtension: principal}}}
+}
+
+func TestParsePermission(t *testing.T) {
+	for _, test := range []struct {
+		in         string
+		permission Permission
+		err        bool
+	}{
+		{in: "none", permission: PermissionNone},
+		{in: "read", permission: PermissionRead},
+		{in: "write", permission: PermissionWrite},
+		{in: "admin", permission: PermissionAdmin},
+		{in: "Read", err: true},
+		{in: "", err: true},
+		{in: "owner", err: true},
+	} {
+		permission, err := ParsePermission(test.in)
+		if test.err != (err != nil) || permission != test.permission {
+			t.Errorf("%#v: got %v, %v", test.in, permission, err)
+		}
+		if !test.err && permission.String() != test.in {
+			t.Errorf("%#v: String() is %#v", test.in, permission.String())
+		}
+	}
+}
+
+func TestParseACLErrors(t *testing.T) {
+	key := authorizedKey(testKey(t))
+	for _, test := range []struct {
+		in  string
+		err string
+	}{
+		{in: "# comment\n\nbogus", err: "line 3: "},
+		{in: "user alice", err: "line 1: "},
+		{in: "user alice not-a-key", err: "line 1: "},
+		{in: "group staff", err: "line 1: "},
+		{in: "repo * * read extra", err: "line 1: "},
+		{in: "repo * *", err: "line 1: "},
+		{in: "repo * * owner", err: "line 1: "},
+		{in: "repo [ * read", err: "line 1: bad pattern"},
+		{in: "user alice " + key + "\nprotect * refs/heads/*",
+			err: "line 2: "},
+		{in: "protect * refs/heads/[ no-delete", err: "line 1: bad pattern"},
+		{in: "protect * refs/heads/* no-rebase", err: "line 1: unknown rule"},
+	} {
+		_, err := ParseACL([]byte(test.in))
+		if err == nil || !strings.HasPrefix(err.Error(), test.err) {
+			t.Errorf("%#v: got %v, expected %#v...", test.in, err, test.err)
+		}
+	}
+}
+
+func TestACLPermission(t *testing.T) {
+	ctx := context.Background()
+	alice, alice2, bob, stranger := testKey(t), testKey(t), testKey(t),
+		testKey(t)
+	acl, err := ParseACL([]byte(`
+# users
+user alice ` + authorizedKey(alice) + `
+user alice ` + authorizedKey(alice2) + `
+user bob ` + authorizedKey(bob) + `
+group staff alice ci-bot
+group empty nobody
+
+repo *            *        read
+repo team/*       @staff   write
+repo team/secret  *        none
+repo team/secret  bob      admin
+repo team/*/*     bob      read
+repo private      ` + ssh.FingerprintSHA256(stranger) + ` write
+repo locked       @empty   admin
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, test := range []struct {
+		name       string
+		meta       ssh.ConnMetadata
+		key        ssh.PublicKey
+		repo       string
+		permission Permission
+	}{
+		{"everyone reads", nil, stranger, "project", PermissionRead},
+		{"* doesn't cross /", nil, stranger, "team/project", PermissionNone},
+		{"* doesn't match nested", nil, alice, "team/a/b", PermissionNone},
+		{"pattern per level", nil, bob, "team/a/b", PermissionRead},
+		{"deeper still", nil, bob, "team/a/b/c", PermissionNone},
+		{"group", nil, alice, "team/project", PermissionWrite},
+		{"user's other key", nil, alice2, "team/project", PermissionWrite},
+		{"not in group", nil, bob, "team/project", PermissionNone},
+		{"none doesn't lower", nil, alice, "team/secret", PermissionWrite},
+		{"highest wins", nil, bob, "team/secret", PermissionAdmin},
+		{"fingerprint", nil, stranger, "private", PermissionWrite},
+		{"other fingerprint", nil, alice, "private", PermissionRead},
+		{"unnamed key isn't a user", nil, stranger, "locked", PermissionRead},
+		{"certificate principal", principalConn("ci-bot"), stranger,
+			"team/project", PermissionWrite},
+		{"principal beats key name", principalConn("bob"), alice,
+			"team/project", PermissionNone},
+		{"* matches the single repo", nil, stranger, "", PermissionRead},
+	} {
+		permission, err := acl.Permission(ctx, test.meta, test.key, test.repo)
+		if err != nil {
+			t.Fatalf("%s: %v", test.name, err)
+		}
+		if permission != test.permission {
+			t.Errorf("%s: got %v, expected %v", test.name, permission,
+				test.permission)
+		}
+	}
+
+	if acl.User(alice2) != "alice" || acl.User(stranger) != "" {
+		t.Errorf("User: got %#v and %#v", acl.User(alice2), acl.User(stranger))
+	}
+}
+
+func TestACLRefRules(t *testing.T) {
+	ctx := context.Background()
+	alice, bob := testKey(t), testKey(t)
+	acl, err := ParseACL([]byte(`
+user alice ` + authorizedKey(alice) + `
+user bob ` + authorizedKey(bob) + `
+group releasers alice
+protect *      refs/heads/master no-delete no-force
+protect proj   refs/tags/*       signed writers=@releasers,ci-bot
+protect other  refs/heads/*      no-delete
+protect */*    refs/heads/main   no-force
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	master := RefRule{Pattern: "refs/heads/master", NoDelete: true,
+		NoForce: true}
+	tags := RefRule{Pattern: "refs/tags/*", RequireSigned: true}
+	read_only_tags := tags
+	read_only_tags.ReadOnly = true
+	for _, test := range []struct {
+		name  string
+		meta  ssh.ConnMetadata
+		key   ssh.PublicKey
+		repo  string
+		rules []RefRule
+	}{
+		{"writer", nil, alice, "proj", []RefRule{master, tags}},
+		{"not a writer", nil, bob, "proj", []RefRule{master, read_only_tags}},
+		{"writer principal", principalConn("ci-bot"), bob, "proj",
+			[]RefRule{master, tags}},
+		{"other repo", nil, bob, "other", []RefRule{master,
+			{Pattern: "refs/heads/*", NoDelete: true}}},
+		{"* doesn't cross /", nil, bob, "team/proj/docs", nil},
+		{"nested", nil, bob, "team/proj", []RefRule{
+			{Pattern: "refs/heads/main", NoForce: true}}},
+	} {
+		rules, err := acl.RefRules(ctx, test.meta, test.key, test.repo)
+		if err != nil {
+			t.Fatalf("%s: %v", test.name, err)
+		}
+		if !reflect.DeepEqual(rules, test.rules) {
+			t.Errorf("%s: got %+v, expected %+v", test.name, rules, test.rules)
+		}
+	}
+}
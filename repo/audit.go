@@ -0,0 +1,378 @@
+// Copyright (C) 2014 JT Olds
+// See LICENSE for copying information
+
+package repo
+
+import (
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+
+	gs_ssh "github.com/jtolds/gitserve/ssh"
+	"golang.org/x/crypto/ssh"
+)
+
+// AuditEvent is a single audit record.
+type AuditEvent struct {
+	Time time.Time `json:"time"`
+	// Service is "hosting" for RepoHosting, or "submissions" for
+	// RepoSubmissions.
+	Service string `json:"service"`
+	// Type is "auth" for an authentication attempt with a key, or "command"
+	// for a command.
+	Type string `json:"type"`
+	// Session identifies the SSH connection the event belongs to.
+	Session string `json:"session"`
+	Remote  string `json:"remote"`
+	SSHUser string `json:"ssh_user"`
+	// User is who the user is, as far as the server knows: a certificate
+	// principal, an ACL user, or a submissions User Id.
+	User string `json:"user,omitempty"`
+	// Key is the SHA256 fingerprint of the key or certificate used.
+	Key string `json:"key,omitempty"`
+
+	// Result is "accepted" or "rejected", for auth events.
+	Result string `json:"result,omitempty"`
+	Error  string `json:"error,omitempty"`
+
+	Command string `json:"command,omitempty"`
+	Repo    string `json:"repo,omitempty"`
+	// Refs are the ref updates a push made.
+	Refs []RefUpdate `json:"refs,omitempty"`
+	// Submission is the submission id, for submission pushes.
+	Submission      string  `json:"submission,omitempty"`
+	BytesIn         int64   `json:"bytes_in,omitempty"`
+	BytesOut        int64   `json:"bytes_out,omitempty"`
+	DurationSeconds float64 `json:"duration_seconds,omitempty"`
+	ExitStatus      *uint32 `json:"exit_status,omitempty"`
+}
+
+// AuditSink receives audit events. Audit must be safe to call concurrently,
+// and shouldn't block for long, since connections wait on it.
+type AuditSink interface {
+	Audit(event *AuditEvent)
+}
+
+// AuditFunc is an AuditSink that calls itself.
+type AuditFunc func(event *AuditEvent)
+
+func (f AuditFunc) Audit(event *AuditEvent) { f(event) }
+
+// AuditLog is an AuditSink that writes events to a file as lines of JSON,
+// rotating it when it gets too big.
+type AuditLog struct {
+	Path string
+	// If positive, the file is rotated once it's MaxSize bytes, to Path.1,
+	// with Path.1 moving to Path.2 and so on.
+	MaxSize int64
+	// How many rotated files to keep. Older ones are removed.
+	MaxFiles int
+
+	mtx  sync.Mutex
+	fh   *os.File
+	size int64
+}
+
+// OpenAuditLog opens the audit log at path, appending to it if it exists.
+func OpenAuditLog(path string, max_size int64, max_files int) (
+	*AuditLog, error) {
+	l := &AuditLog{Path: path, MaxSize: max_size, MaxFiles: max_files}
+	err := l.open()
+	if err != nil {
+		return nil, err
+	}
+	return l, nil
+}
+
+// open opens Path. l.mtx must be held.
+func (l *AuditLog) open() error {
+	fh, err := os.OpenFile(l.Path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return err
+	}
+	info, err := fh.Stat()
+	if err != nil {
+		fh.Close()
+		return err
+	}
+	l.fh, l.size = fh, info.Size()
+	return nil
+}
+
+// rotate moves the log out of the way and starts a new one. l.mtx must be
+// held.
+func (l *AuditLog) rotate() error {
+	err := l.fh.Close()
+	l.fh = nil
+	if err != nil {
+		return err
+	}
+	if l.MaxFiles <= 0 {
+		err = os.Remove(l.Path)
+	} else {
+		os.Remove(fmt.Sprintf("%s.%d", l.Path, l.MaxFiles))
+		for i := l.MaxFiles - 1; i > 0; i-- {
+			err = os.Rename(fmt.Sprintf("%s.%d", l.Path, i),
+				fmt.Sprintf("%s.%d", l.Path, i+1))
+			if err != nil && !os.IsNotExist(err) {
+				return err
+			}
+		}
+		err = os.Rename(l.Path, l.Path+".1")
+	}
+	if err != nil {
+		return err
+	}
+	return l.open()
+}
+
+// Audit writes event to the log. Errors are logged, not returned, so that
+// a broken audit log doesn't stop the server.
+func (l *AuditLog) Audit(event *AuditEvent) { l.write(event) }
+
+// LogDelivery writes a webhook delivery attempt to the log. It can be used
+// as WebhookSender.DeliveryLog.
+func (l *AuditLog) LogDelivery(delivery *WebhookDelivery) { l.write(delivery) }
+
+func (l *AuditLog) write(record interface{}) {
+	data, err := json.Marshal(record)
+	if err != nil {
+		logger.Errorf("audit log: %v", err)
+		return
+	}
+	data = append(data, '\n')
+	l.mtx.Lock()
+	defer l.mtx.Unlock()
+	if l.fh == nil {
+		// a previous rotation failed
+		err = l.open()
+		if err != nil {
+			logger.Errorf("audit log: %v", err)
+			return
+		}
+	}
+	if l.MaxSize > 0 && l.size > 0 && l.size+int64(len(data)) > l.MaxSize {
+		err = l.rotate()
+		if err != nil {
+			logger.Errorf("audit log: rotating %s: %v", l.Path, err)
+			if l.fh == nil {
+				return
+			}
+		}
+	}
+	n, err := l.fh.Write(data)
+	l.size += int64(n)
+	if err != nil {
+		logger.Errorf("audit log: %v", err)
+	}
+}
+
+// Close closes the log file.
+func (l *AuditLog) Close() error {
+	l.mtx.Lock()
+	defer l.mtx.Unlock()
+	if l.fh == nil {
+		return nil
+	}
+	err := l.fh.Close()
+	l.fh = nil
+	return err
+}
+
+type auditKey struct{}
+
+// auditEvent returns the AuditEvent for the command ctx belongs to, for the
+// handler to fill in, or a throwaway one if the command isn't audited.
+func auditEvent(ctx context.Context) *AuditEvent {
+	if event, ok := ctx.Value(auditKey{}).(*AuditEvent); ok {
+		return event
+	}
+	return &AuditEvent{}
+}
+
+func newAuditEvent(service, event_type string,
+	meta ssh.ConnMetadata) *AuditEvent {
+	session := meta.SessionID()
+	if len(session) > 8 {
+		session = session[:8]
+	}
+	return &AuditEvent{
+		Time:    time.Now(),
+		Service: service,
+		Type:    event_type,
+		Session: hex.EncodeToString(session),
+		Remote:  meta.RemoteAddr().String(),
+		SSHUser: meta.User()}
+}
+
+// authAuditor sends sink an "auth" event for the result of each
+// authentication attempt. The key callback can't do that itself: x/crypto
+// also calls it for keys clients only ask about, and caches its answer for
+// the signed attempt. So it just notes which key each connection last
+// offered, and whose it is, for the events.
+type authAuditor struct {
+	sink    AuditSink
+	service string
+	user    func(meta ssh.ConnMetadata, perms *ssh.Permissions) string
+
+	mtx     sync.Mutex
+	offered map[ssh.ConnMetadata]*offeredKey
+}
+
+type offeredKey struct {
+	fingerprint string
+	user        string
+	// logged is true once an attempt with the key got an event
+	logged bool
+}
+
+// auditAuth makes sink get an "auth" event for every authentication attempt
+// on connections server makes with config. user returns who an accepted key
+// belongs to.
+func auditAuth(sink AuditSink, service string, config *ssh.ServerConfig,
+	server *gs_ssh.RestrictedServer,
+	user func(meta ssh.ConnMetadata, perms *ssh.Permissions) string) {
+	if sink == nil {
+		return
+	}
+	a := &authAuditor{sink: sink, service: service, user: user,
+		offered: map[ssh.ConnMetadata]*offeredKey{}}
+
+	key_callback := config.PublicKeyCallback
+	config.PublicKeyCallback = func(meta ssh.ConnMetadata,
+		key ssh.PublicKey) (*ssh.Permissions, error) {
+		perms, err := key_callback(meta, key)
+		a.offer(meta, key, perms, err)
+		return perms, err
+	}
+	log_callback := config.AuthLogCallback
+	config.AuthLogCallback = func(meta ssh.ConnMetadata, method string,
+		err error) {
+		a.attempted(meta, method, err)
+		if log_callback != nil {
+			log_callback(meta, method, err)
+		}
+	}
+	server.HandshakeError = a.handshakeError
+}
+
+func (a *authAuditor) offer(meta ssh.ConnMetadata, key ssh.PublicKey,
+	perms *ssh.Permissions, err error) {
+	offered := &offeredKey{fingerprint: ssh.FingerprintSHA256(key)}
+	if err == nil {
+		offered.user = a.user(meta, perms)
+	}
+	a.mtx.Lock()
+	a.offered[meta] = offered
+	a.mtx.Unlock()
+}
+
+// attempted records the final result of an attempt.
+func (a *authAuditor) attempted(meta ssh.ConnMetadata, method string,
+	err error) {
+	if method == "none" {
+		// clients start with it to find out what methods there are
+		return
+	}
+	event := newAuditEvent(a.service, "auth", meta)
+	a.mtx.Lock()
+	if offered := a.offered[meta]; offered != nil && method == "publickey" {
+		event.Key = offered.fingerprint
+		if err == nil {
+			event.User = offered.user
+		}
+		offered.logged = true
+	}
+	if err == nil {
+		delete(a.offered, meta)
+	}
+	a.mtx.Unlock()
+	a.audit(event, err)
+}
+
+// handshakeError records a key that was offered, but never used in an
+// attempt that finished, e.g. because its signature was bad.
+func (a *authAuditor) handshakeError(meta ssh.ConnMetadata, err error) {
+	a.mtx.Lock()
+	offered := a.offered[meta]
+	delete(a.offered, meta)
+	a.mtx.Unlock()
+	if offered == nil || offered.logged {
+		return
+	}
+	event := newAuditEvent(a.service, "auth", meta)
+	event.Key = offered.fingerprint
+	a.audit(event, err)
+}
+
+func (a *authAuditor) audit(event *AuditEvent, err error) {
+	if err != nil {
+		event.Result = "rejected"
+		event.Error = err.Error()
+	} else {
+		event.Result = "accepted"
+	}
+	a.sink.Audit(event)
+}
+
+// auditCommands wraps handler so that sink gets an event for every command.
+// identify returns who the connection belongs to.
+func auditCommands(sink AuditSink, service string,
+	handler gs_ssh.CommandHandler,
+	identify func(meta ssh.ConnMetadata) (user string, key ssh.PublicKey)) (
+	rv gs_ssh.CommandHandler) {
+	if sink == nil {
+		return handler
+	}
+	return func(ctx context.Context, command string, env []string,
+		stdin io.Reader, stdout, stderr io.Writer, meta ssh.ConnMetadata) (
+		exit_status uint32, err error) {
+		event := newAuditEvent(service, "command", meta)
+		event.Command = command
+		user, key := identify(meta)
+		event.User = user
+		if key != nil {
+			event.Key = ssh.FingerprintSHA256(key)
+		}
+		in := &countingReader{Reader: stdin}
+		out := &countingWriter{Writer: stdout}
+		exit_status, err = handler(context.WithValue(ctx, auditKey{}, event),
+			command, env, in, out, stderr, meta)
+		event.BytesIn, event.BytesOut = in.N, out.N
+		event.DurationSeconds = time.Since(event.Time).Seconds()
+		if err != nil {
+			event.Error = err.Error()
+		} else {
+			event.ExitStatus = &exit_status
+		}
+		sink.Audit(event)
+		return exit_status, err
+	}
+}
+
+type countingReader struct {
+	Reader io.Reader
+	N      int64
+}
+
+func (c *countingReader) Read(p []byte) (n int, err error) {
+	n, err = c.Reader.Read(p)
+	c.N += int64(n)
+	return n, err
+}
+
+type countingWriter struct {
+	Writer io.Writer
+	N      int64
+}
+
+func (c *countingWriter) Write(p []byte) (n int, err error) {
+	n, err = c.Writer.Write(p)
+	c.N += int64(n)
+	return n, err
+}
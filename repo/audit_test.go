@@ -0,0 +1,132 @@
+// Copyright (C) 2014 JT Olds
+// See LICENSE for copying information
+
+package repo
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	gs_ssh "github.com/jtolds/gitserve/ssh"
+	"golang.org/x/crypto/ssh"
+)
+
+func testSigner(t *testing.T) ssh.Signer {
+	_, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signer, err := ssh.NewSignerFromKey(priv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return signer
+}
+
+// badSigner makes signatures that don't verify.
+type badSigner struct{ ssh.Signer }
+
+func (s badSigner) Sign(rand io.Reader, data []byte) (*ssh.Signature, error) {
+	sig, err := s.Signer.Sign(rand, data)
+	if err != nil {
+		return nil, err
+	}
+	sig.Blob[0] ^= 0xff
+	return sig, nil
+}
+
+func TestAuditAuth(t *testing.T) {
+	good, unknown := testSigner(t), testSigner(t)
+
+	var mtx sync.Mutex
+	var events []*AuditEvent
+	config := &ssh.ServerConfig{PublicKeyCallback: func(meta ssh.ConnMetadata,
+		key ssh.PublicKey) (*ssh.Permissions, error) {
+		if !bytes.Equal(key.Marshal(), good.PublicKey().Marshal()) {
+			return nil, fmt.Errorf("unknown key")
+		}
+		return keyPermissions(key), nil
+	}}
+	config.AddHostKey(testSigner(t))
+	server := &gs_ssh.RestrictedServer{SSHConfig: config}
+	auditAuth(AuditFunc(func(event *AuditEvent) {
+		mtx.Lock()
+		events = append(events, event)
+		mtx.Unlock()
+	}), "hosting", config, server,
+		func(meta ssh.ConnMetadata, perms *ssh.Permissions) string {
+			return "alice"
+		})
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go server.ServeListeners([]net.Listener{listener})
+	defer server.Close()
+
+	good_key := ssh.FingerprintSHA256(good.PublicKey())
+	for _, test := range []struct {
+		name    string
+		signers []ssh.Signer
+		events  []AuditEvent
+	}{
+		{"accepted", []ssh.Signer{good}, []AuditEvent{
+			{Key: good_key, User: "alice", Result: "accepted"}}},
+		{"unknown key", []ssh.Signer{unknown}, []AuditEvent{
+			{Key: ssh.FingerprintSHA256(unknown.PublicKey()),
+				Result: "rejected", Error: "unknown key"}}},
+		{"bad signature", []ssh.Signer{badSigner{good}}, []AuditEvent{
+			{Key: good_key, Result: "rejected"}}},
+		{"second key", []ssh.Signer{unknown, good}, []AuditEvent{
+			{Key: ssh.FingerprintSHA256(unknown.PublicKey()),
+				Result: "rejected", Error: "unknown key"},
+			{Key: good_key, User: "alice", Result: "accepted"}}},
+	} {
+		mtx.Lock()
+		events = nil
+		mtx.Unlock()
+		conn, err := ssh.Dial("tcp", listener.Addr().String(),
+			&ssh.ClientConfig{
+				User:            "git",
+				Auth:            []ssh.AuthMethod{ssh.PublicKeys(test.signers...)},
+				HostKeyCallback: ssh.InsecureIgnoreHostKey()})
+		if err == nil {
+			conn.Close()
+		}
+
+		var got []*AuditEvent
+		for deadline := time.Now().Add(5 * time.Second); ; {
+			mtx.Lock()
+			got = append([]*AuditEvent(nil), events...)
+			mtx.Unlock()
+			if len(got) >= len(test.events) || time.Now().After(deadline) {
+				break
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+		if len(got) != len(test.events) {
+			t.Errorf("%s: got %d events, expected %d", test.name, len(got),
+				len(test.events))
+			continue
+		}
+		for i, event := range got {
+			expected := test.events[i]
+			if event.Type != "auth" || event.Service != "hosting" ||
+				event.SSHUser != "git" || event.Key != expected.Key ||
+				event.User != expected.User || event.Result != expected.Result ||
+				(expected.Error != "" && event.Error != expected.Error) ||
+				(expected.Result == "rejected" && event.Error == "") {
+				t.Errorf("%s: event %d: got %+v, expected %+v", test.name, i,
+					event, expected)
+			}
+		}
+	}
+}
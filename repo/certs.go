@@ -0,0 +1,127 @@
+// Copyright (C) 2014 JT Olds
+// See LICENSE for copying information
+
+package repo
+
+import (
+	"fmt"
+	"time"
+
+	gs_ssh "github.com/jtolds/gitserve/ssh"
+	"golang.org/x/crypto/ssh"
+)
+
+// CertAuthority accepts SSH user certificates signed by trusted CAs. A
+// certificate's first principal is who the user is, e.g. to an ACL, since
+// the SSH user name is usually just "git".
+type CertAuthority struct {
+	// CAs holds the trusted CA keys. Options on a CA's entry, like from= or
+	// gitserve-repos, apply to every certificate it signs.
+	CAs KeySource
+	// If set, keys in Revoked are refused, whether they're plain keys,
+	// certificates, keys with certificates, or CAs.
+	Revoked KeySource
+}
+
+// userExtension is the ssh.Permissions extension holding the principal a
+// certificate identified the user as.
+const userExtension = "gitserve-user@gitserve"
+
+// connUser returns the certificate principal the client authenticated as,
+// or "" if it didn't use a certificate.
+func connUser(meta ssh.ConnMetadata) string {
+	perms := gs_ssh.Permissions(meta)
+	if perms == nil {
+		return ""
+	}
+	return perms.Extensions[userExtension]
+}
+
+func (ca *CertAuthority) revoked(key ssh.PublicKey) bool {
+	return ca.Revoked != nil && ca.Revoked.Lookup(key) != nil
+}
+
+// authenticateKey checks certificates, and refuses revoked plain keys. If
+// key is a plain key that isn't revoked, handled is false, and the server
+// should check key itself. Plain keys are refused outright if the server has
+// no keys of its own.
+func (ca *CertAuthority) authenticateKey(meta ssh.ConnMetadata,
+	key ssh.PublicKey, has_keys bool) (perms *ssh.Permissions, handled bool,
+	err error) {
+	if cert, ok := key.(*ssh.Certificate); ok {
+		perms, err = ca.authenticate(meta, cert)
+		return perms, true, err
+	}
+	if ca.revoked(key) {
+		logger.Warnf("Rejecting revoked key %s from %s",
+			ssh.FingerprintSHA256(key), meta.RemoteAddr())
+		return nil, true, fmt.Errorf("key revoked")
+	}
+	if !has_keys {
+		logger.Warnf("User has no certificate, rejecting")
+		return nil, true, fmt.Errorf("certificate required")
+	}
+	return nil, false, nil
+}
+
+// authenticate checks cert, returning the ssh.Permissions for the
+// connection.
+func (ca *CertAuthority) authenticate(meta ssh.ConnMetadata,
+	cert *ssh.Certificate) (perms *ssh.Permissions, err error) {
+	defer mon.Task()(nil)(&err)
+	perms, err = ca.checkCert(meta, cert)
+	if err != nil {
+		logger.Warnf("Rejecting certificate %s (serial %d, key id %#v) from %s: "+
+			"%v", ssh.FingerprintSHA256(cert.Key), cert.Serial, cert.KeyId,
+			meta.RemoteAddr(), err)
+		return nil, err
+	}
+	logger.Infof("User %#v authorized by certificate",
+		perms.Extensions[userExtension])
+	return perms, nil
+}
+
+func (ca *CertAuthority) checkCert(meta ssh.ConnMetadata,
+	cert *ssh.Certificate) (*ssh.Permissions, error) {
+	if cert.CertType != ssh.UserCert {
+		return nil, fmt.Errorf("not a user certificate")
+	}
+	if len(cert.ValidPrincipals) == 0 {
+		return nil, fmt.Errorf("certificate has no principals")
+	}
+	ca_entry := ca.CAs.Lookup(cert.SignatureKey)
+	if ca_entry == nil {
+		return nil, fmt.Errorf("certificate signed by unknown authority")
+	}
+	checker := &ssh.CertChecker{
+		IsUserAuthority: func(auth ssh.PublicKey) bool {
+			return ca.CAs.Lookup(auth) != nil
+		},
+		IsRevoked: func(cert *ssh.Certificate) bool {
+			return ca.revoked(cert) || ca.revoked(cert.Key) ||
+				ca.revoked(cert.SignatureKey)
+		},
+		// no critical options are supported besides source-address, which
+		// the ssh package enforces. in particular, certificates with a
+		// force-command are refused, like keys with command=.
+	}
+	principal := cert.ValidPrincipals[0]
+	err := checker.CheckCert(principal, cert)
+	if err != nil {
+		return nil, err
+	}
+	err = ca_entry.Check(meta.RemoteAddr(), time.Now())
+	if err != nil {
+		return nil, fmt.Errorf("certificate authority: %v", err)
+	}
+
+	// the connection's key is the certificate, with the CA's options
+	perms := (&AuthorizedKey{Key: cert, KeyOptions: ca_entry.KeyOptions}).
+		permissions()
+	perms.Extensions[userExtension] = principal
+	perms.CriticalOptions = map[string]string{}
+	for name, value := range cert.CriticalOptions {
+		perms.CriticalOptions[name] = value
+	}
+	return perms, nil
+}
@@ -0,0 +1,268 @@
+// Copyright (C) 2014 JT Olds
+// See LICENSE for copying information
+
+package repo
+
+import (
+	"context"
+	"crypto/rand"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	gs_ssh "github.com/jtolds/gitserve/ssh"
+	"golang.org/x/crypto/ssh"
+)
+
+// remoteConn is connection metadata with just a remote address.
+type remoteConn struct {
+	ssh.ConnMetadata
+	remote net.Addr
+}
+
+func (c remoteConn) RemoteAddr() net.Addr { return c.remote }
+func (c remoteConn) User() string         { return "git" }
+
+// testCert returns a certificate for key signed by ca, valid for an hour
+// either side of now for alice, after modify has its way with it.
+func testCert(t *testing.T, ca ssh.Signer, key ssh.PublicKey,
+	modify func(cert *ssh.Certificate)) *ssh.Certificate {
+	now := time.Now()
+	cert := &ssh.Certificate{
+		Key:             key,
+		Serial:          1,
+		CertType:        ssh.UserCert,
+		KeyId:           "alice@example.com",
+		ValidPrincipals: []string{"alice", "git"},
+		ValidAfter:      uint64(now.Add(-time.Hour).Unix()),
+		ValidBefore:     uint64(now.Add(time.Hour).Unix())}
+	if modify != nil {
+		modify(cert)
+	}
+	if err := cert.SignCert(rand.Reader, ca); err != nil {
+		t.Fatal(err)
+	}
+	return cert
+}
+
+func TestCertAuthority(t *testing.T) {
+	ca, other_ca, user := testSigner(t), testSigner(t), testKey(t)
+	revoked_key, revoked_ca := testKey(t), testSigner(t)
+	revoked_cert := testCert(t, ca, user, func(cert *ssh.Certificate) {
+		cert.Serial = 2
+	})
+	authority := &CertAuthority{
+		CAs: testKeys{
+			{Key: ca.PublicKey()},
+			{Key: revoked_ca.PublicKey()},
+			{Key: other_ca.PublicKey(),
+				KeyOptions: KeyOptions{From: []string{"192.0.2.0/24"},
+					ReadOnly: true}}},
+		Revoked: testKeys{{Key: revoked_key}, {Key: revoked_cert},
+			{Key: revoked_ca.PublicKey()}}}
+	local := &net.TCPAddr{IP: net.ParseIP("127.0.0.1"), Port: 1234}
+	past := uint64(time.Now().Add(-2 * time.Hour).Unix())
+	future := uint64(time.Now().Add(2 * time.Hour).Unix())
+
+	for _, test := range []struct {
+		name      string
+		key       ssh.PublicKey
+		remote    net.Addr
+		has_keys  bool
+		unhandled bool
+		user      string
+		read_only bool
+		err       string
+	}{
+		{name: "cert", key: testCert(t, ca, user, nil), user: "alice"},
+		{name: "first principal", user: "bob",
+			key: testCert(t, ca, user, func(cert *ssh.Certificate) {
+				cert.ValidPrincipals = []string{"bob", "alice"}
+			})},
+		{name: "no principals", err: "certificate has no principals",
+			key: testCert(t, ca, user, func(cert *ssh.Certificate) {
+				cert.ValidPrincipals = nil
+			})},
+		{name: "host cert", err: "not a user certificate",
+			key: testCert(t, ca, user, func(cert *ssh.Certificate) {
+				cert.CertType = ssh.HostCert
+			})},
+		{name: "untrusted ca", key: testCert(t, testSigner(t), user, nil),
+			err: "certificate signed by unknown authority"},
+		{name: "expired", err: "ssh: cert has expired",
+			key: testCert(t, ca, user, func(cert *ssh.Certificate) {
+				cert.ValidBefore = past
+			})},
+		{name: "not yet valid", err: "ssh: cert is not yet valid",
+			key: testCert(t, ca, user, func(cert *ssh.Certificate) {
+				cert.ValidAfter = future
+			})},
+		{name: "revoked cert", key: revoked_cert,
+			err: "ssh: certificate serial 2 revoked"},
+		{name: "other serial", user: "alice",
+			key: testCert(t, ca, user, func(cert *ssh.Certificate) {
+				cert.Serial = 3
+			})},
+		{name: "revoked key in cert", err: "ssh: certificate serial",
+			key: testCert(t, ca, revoked_key, nil)},
+		{name: "revoked ca", key: testCert(t, revoked_ca, user, nil),
+			err: "ssh: certificate serial"},
+		{name: "force-command", err: "ssh: unsupported critical option",
+			key: testCert(t, ca, user, func(cert *ssh.Certificate) {
+				cert.CriticalOptions = map[string]string{
+					"force-command": "true"}
+			})},
+		{name: "ca options", remote: &net.TCPAddr{
+			IP: net.ParseIP("192.0.2.1"), Port: 1234},
+			key: testCert(t, other_ca, user, nil), user: "alice",
+			read_only: true},
+		{name: "ca from", key: testCert(t, other_ca, user, nil),
+			err: "certificate authority: key not allowed from"},
+		{name: "plain key", key: user, has_keys: true, unhandled: true},
+		{name: "plain key without keys", key: user,
+			err: "certificate required"},
+		{name: "revoked plain key", key: revoked_key, has_keys: true,
+			err: "key revoked"},
+	} {
+		remote := test.remote
+		if remote == nil {
+			remote = local
+		}
+		perms, handled, err := authority.authenticateKey(
+			remoteConn{remote: remote}, test.key, test.has_keys)
+		if handled == test.unhandled {
+			t.Errorf("%s: got handled %v", test.name, handled)
+		}
+		if test.err != "" {
+			if err == nil || !strings.HasPrefix(err.Error(), test.err) {
+				t.Errorf("%s: got %v, expected %#v...", test.name, err, test.err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: unexpected error: %v", test.name, err)
+			continue
+		}
+		if test.unhandled {
+			if perms != nil {
+				t.Errorf("%s: got permissions %+v", test.name, perms)
+			}
+			continue
+		}
+		_, read_only := perms.Extensions[readOnlyExtension]
+		if perms.Extensions[userExtension] != test.user ||
+			perms.Extensions[keyExtension] != string(test.key.Marshal()) ||
+			read_only != test.read_only {
+			t.Errorf("%s: got permissions %+v", test.name, perms)
+		}
+	}
+}
+
+func TestCertSubmissions(t *testing.T) {
+	ca, user, known := testSigner(t), testSigner(t), testSigner(t)
+	cert_signer := func(modify func(cert *ssh.Certificate)) ssh.Signer {
+		signer, err := ssh.NewCertSigner(
+			testCert(t, ca, user.PublicKey(), modify), user)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return signer
+	}
+	authority := &CertAuthority{CAs: testKeys{{Key: ca.PublicKey()}}}
+
+	for _, test := range []struct {
+		name   string
+		rs     *RepoSubmissions
+		signer ssh.Signer
+		user   string
+	}{
+		{name: "cert", rs: &RepoSubmissions{CertAuthority: authority},
+			signer: cert_signer(nil), user: "alice"},
+		{name: "source address",
+			rs: &RepoSubmissions{CertAuthority: authority},
+			signer: cert_signer(func(cert *ssh.Certificate) {
+				cert.CriticalOptions = map[string]string{
+					"source-address": "127.0.0.0/8"}
+			}),
+			user: "alice"},
+		{name: "wrong source address",
+			rs: &RepoSubmissions{CertAuthority: authority},
+			signer: cert_signer(func(cert *ssh.Certificate) {
+				cert.CriticalOptions = map[string]string{
+					"source-address": "192.0.2.0/24"}
+			})},
+		{name: "plain key needs keys",
+			rs:     &RepoSubmissions{CertAuthority: authority},
+			signer: known},
+		{name: "plain key from key source",
+			rs: &RepoSubmissions{CertAuthority: authority,
+				KeySource: testKeys{{Key: known.PublicKey()}}},
+			signer: known, user: userIdFromKey(known.PublicKey())},
+		{name: "plain key not in key source",
+			rs: &RepoSubmissions{CertAuthority: authority,
+				KeySource: testKeys{{Key: known.PublicKey()}}},
+			signer: user},
+		{name: "plain key from auth handler",
+			rs: &RepoSubmissions{CertAuthority: authority,
+				AuthHandler: func(ctx context.Context, meta ssh.ConnMetadata,
+					key ssh.PublicKey) (*User, error) {
+					return &User{Id: "carol"}, nil
+				}},
+			signer: known, user: "carol"},
+		{name: "auth handler names cert users",
+			rs: &RepoSubmissions{CertAuthority: authority,
+				AuthHandler: func(ctx context.Context, meta ssh.ConnMetadata,
+					key ssh.PublicKey) (*User, error) {
+					return &User{Id: "dave"}, nil
+				}},
+			signer: cert_signer(nil), user: "dave"},
+	} {
+		user := connectedUser(t, test.rs, test.signer)
+		if user != test.user {
+			t.Errorf("%s: got user %#v, expected %#v", test.name, user,
+				test.user)
+		}
+	}
+}
+
+// connectedUser connects to a server authenticating with rs, and returns who
+// rs thinks the client is, or "" if the client can't connect.
+func connectedUser(t *testing.T, rs *RepoSubmissions,
+	signer ssh.Signer) string {
+	config := &ssh.ServerConfig{PublicKeyCallback: rs.publicKeyCallback}
+	config.AddHostKey(testSigner(t))
+	server := &gs_ssh.RestrictedServer{SSHConfig: config,
+		Handler: func(ctx context.Context, command string, env []string,
+			stdin io.Reader, stdout, stderr io.Writer, meta ssh.ConnMetadata) (
+			uint32, error) {
+			user, _ := rs.identify(meta)
+			_, err := io.WriteString(stdout, user)
+			return 0, err
+		}}
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go server.ServeListeners([]net.Listener{listener})
+	defer server.Close()
+
+	conn, err := ssh.Dial("tcp", listener.Addr().String(), &ssh.ClientConfig{
+		User:            "git",
+		Auth:            []ssh.AuthMethod{ssh.PublicKeys(signer)},
+		HostKeyCallback: ssh.InsecureIgnoreHostKey()})
+	if err != nil {
+		return ""
+	}
+	defer conn.Close()
+	session, err := conn.NewSession()
+	if err != nil {
+		t.Fatal(err)
+	}
+	output, err := session.Output("whoami")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(output)
+}
@@ -0,0 +1,128 @@
+// Copyright (C) 2014 JT Olds
+// See LICENSE for copying information
+
+package repo
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+const historyTimeFormat = "2006-01-02 15:04:05 MST"
+
+// historyHandler serves the restricted commands users can run to look at
+// their past submissions:
+//
+//	submissions [repo]  - lists your submissions, optionally for one repo
+//	submission <id>     - shows a submission's refs, status and output
+func (rs *RepoSubmissions) historyHandler(ctx context.Context,
+	parts []string, stdout, stderr io.Writer, session *session) (
+	exit_status uint32, err error) {
+	defer mon.Task()(&ctx)(&err)
+	if rs.Store == nil {
+		_, err = fmt.Fprintf(stderr, "submission history is not available\r\n")
+		return 1, err
+	}
+
+	switch {
+	case parts[0] == "submissions" && len(parts) <= 2:
+		var repo_name string
+		if len(parts) == 2 {
+			repo_name = strings.Trim(parts[1], "'")
+		}
+		return rs.listSubmissions(ctx, stdout, session.user.Id, repo_name)
+	case parts[0] == "submission" && len(parts) == 2:
+		return rs.showSubmission(ctx, stdout, stderr, session.user.Id,
+			strings.Trim(parts[1], "'"))
+	}
+	_, err = fmt.Fprintf(stderr,
+		"usage: submissions [<repo>] | submission <id>\r\n")
+	return 1, err
+}
+
+// sameRepo compares repo names the way users type them, so that
+// ssh://host/myrepo and host:myrepo are the same.
+func sameRepo(a, b string) bool {
+	return strings.Trim(a, "/") == strings.Trim(b, "/")
+}
+
+func submissionStatus(sub *Submission) string {
+	switch {
+	case sub.Status == SubmissionQueued:
+		return "queued"
+	case sub.Finished.IsZero():
+		return "running"
+	case sub.Error != "":
+		return "error"
+	case sub.ExitStatus != 0:
+		return fmt.Sprintf("failed (%d)", sub.ExitStatus)
+	}
+	return "ok"
+}
+
+func (rs *RepoSubmissions) listSubmissions(ctx context.Context,
+	stdout io.Writer, user_id, repo_name string) (exit_status uint32,
+	err error) {
+	subs, err := rs.Store.Find(ctx, SubmissionQuery{UserId: user_id})
+	if err != nil {
+		return 1, err
+	}
+	w := tabwriter.NewWriter(stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintf(w, "ID\tREPO\tSTARTED\tSTATUS\n")
+	for _, sub := range subs {
+		if repo_name != "" && !sameRepo(repo_name, sub.RepoName) {
+			continue
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\n", sub.Id, sub.RepoName,
+			sub.Started.Local().Format(historyTimeFormat), submissionStatus(sub))
+	}
+	return 0, w.Flush()
+}
+
+func (rs *RepoSubmissions) showSubmission(ctx context.Context,
+	stdout, stderr io.Writer, user_id, id string) (exit_status uint32,
+	err error) {
+	sub, err := rs.Store.Get(ctx, id)
+	if err == ErrSubmissionNotFound || (err == nil && sub.UserId != user_id) {
+		// don't let users find out about other users' submission ids
+		_, err = fmt.Fprintf(stderr, "no such submission: %#v\r\n", id)
+		return 1, err
+	}
+	if err != nil {
+		return 1, err
+	}
+
+	fmt.Fprintf(stdout, "Submission: %s\n", sub.Id)
+	fmt.Fprintf(stdout, "Repo:       %s\n", sub.RepoName)
+	fmt.Fprintf(stdout, "Started:    %s\n",
+		sub.Started.Local().Format(historyTimeFormat))
+	if !sub.Finished.IsZero() {
+		fmt.Fprintf(stdout, "Finished:   %s (took %s)\n",
+			sub.Finished.Local().Format(historyTimeFormat),
+			sub.Finished.Sub(sub.Started).Round(time.Millisecond))
+	}
+	fmt.Fprintf(stdout, "Status:     %s\n", submissionStatus(sub))
+	if sub.Error != "" {
+		fmt.Fprintf(stdout, "Error:      %s\n", sub.Error)
+	}
+	fmt.Fprintf(stdout, "\nRefs:\n")
+	for _, update := range sub.Updates {
+		if update.IsDelete() {
+			fmt.Fprintf(stdout, "  %s deleted\n", update.Ref)
+			continue
+		}
+		fmt.Fprintf(stdout, "  %s %s -> tag %s\n", update.Ref, update.New,
+			update.Tag)
+	}
+	if sub.Output != "" {
+		fmt.Fprintf(stdout, "\nOutput:\n%s", sub.Output)
+		if !strings.HasSuffix(sub.Output, "\n") {
+			fmt.Fprintln(stdout)
+		}
+	}
+	return 0, nil
+}
@@ -5,13 +5,16 @@ package repo
 
 import (
 	"bytes"
+	"context"
 	"crypto/rand"
 	"crypto/rsa"
 	"fmt"
 	"io"
+	"net"
+	"os"
 	"os/exec"
-	"path/filepath"
 	"strings"
+	"sync"
 
 	gs_ssh "github.com/jtolds/gitserve/ssh"
 	"golang.org/x/crypto/ssh"
@@ -21,10 +24,17 @@ type RepoHosting struct {
 	ShellError string
 	MOTD       string
 
-	// if unset, one will be generated
+	// if neither PrivateKey or HostKeys are set, a key will be generated
 	PrivateKey ssh.Signer
+	// If set, these are used along with PrivateKey, which comes first, and
+	// all of them are announced to clients for OpenSSH's UpdateHostKeys. See
+	// LoadHostKeys.
+	HostKeys *HostKeys
 
-	// path to the directory containing repos to serve.
+	// path to the directory containing repos to serve. Repos may be nested,
+	// like team/project, and are found with or without a .git suffix, so
+	// ssh://host/team/project and host:team/project.git are the same repo.
+	// Repos whose paths resolve outside of RepoBase aren't served.
 	RepoBase string
 	// if set, overrides RepoBase + user-supplied repo name. if neither
 	// RepoBase or Repo are set, Repo defaults to "."
@@ -32,17 +42,79 @@ type RepoHosting struct {
 
 	// if empty, *all* users will be allowed.
 	AuthorizedKeys []ssh.PublicKey
+	// If set, overrides AuthorizedKeys. Unlike AuthorizedKeys, a KeySource
+	// with no keys allows no one. Key options like from= are enforced.
+	KeySource KeySource
+	// If set, user certificates signed by its CAs are accepted too, and its
+	// revoked keys are refused. If there are no AuthorizedKeys and no
+	// KeySource, only certificates are accepted.
+	CertAuthority *CertAuthority
+
+	// If set, decides who may read and write each repo. Fetching requires
+	// PermissionRead and pushing requires PermissionWrite. Otherwise, anyone
+	// who can connect may do both.
+	ACL ACL
+
+	// If set, decides which refs pushers may update, and how. Rejected ref
+	// updates are reported back to the client, and the rest of the push goes
+	// through. Since this works with an update hook, the repo's own
+	// core.hooksPath setting is ignored while it's in effect, though hooks
+	// in the repo's hooks directory still run.
+	Protection RefProtection
+
+	// If set, limits connections and pushes. Unless Limits.User is set,
+	// users are told apart by certificate principal or key fingerprint.
+	Limits *gs_ssh.Limits
+	// Timeouts for connections. See gs_ssh.Timeouts.
+	Timeouts gs_ssh.Timeouts
+	// If set, PROXY protocol headers are accepted from trusted proxies.
+	ProxyProtocol *gs_ssh.ProxyProtocol
+
+	// If set, gets an AuditEvent for every authentication attempt and
+	// command.
+	Audit AuditSink
+
+	// If set, sends webhooks about pushes.
+	Webhooks *WebhookSender
 
 	// If set, these commands override the default git-receive-pack and
 	// git-upload-pack
 	GitReceivePack string
 	GitUploadPack  string
+
+	mtx    sync.Mutex
+	server *gs_ssh.RestrictedServer
 }
 
-func (rh *RepoHosting) cmdHandler(command string,
-	stdin io.Reader, stdout, stderr io.Writer,
+// keyExtension is the ssh.Permissions extension the client's key is kept in.
+const keyExtension = "gitserve-key@gitserve"
+
+// connKey returns the key the client authenticated with.
+func connKey(meta ssh.ConnMetadata) (ssh.PublicKey, error) {
+	perms := gs_ssh.Permissions(meta)
+	if perms == nil || perms.Extensions[keyExtension] == "" {
+		return nil, fmt.Errorf("unauthenticated connection")
+	}
+	return ssh.ParsePublicKey([]byte(perms.Extensions[keyExtension]))
+}
+
+// connIdentity returns who the client is: the certificate principal it
+// authenticated as, or its key's fingerprint.
+func connIdentity(meta ssh.ConnMetadata) string {
+	if user := connUser(meta); user != "" {
+		return user
+	}
+	key, err := connKey(meta)
+	if err != nil {
+		return meta.User()
+	}
+	return ssh.FingerprintSHA256(key)
+}
+
+func (rh *RepoHosting) cmdHandler(ctx context.Context, command string,
+	env []string, stdin io.Reader, stdout, stderr io.Writer,
 	meta ssh.ConnMetadata) (exit_status uint32, err error) {
-	defer mon.Task()(nil)(&err)
+	defer mon.Task()(&ctx)(&err)
 
 	parts := strings.Split(command, " ")
 	if len(parts) != 2 {
@@ -65,36 +137,269 @@ func (rh *RepoHosting) cmdHandler(command string,
 		return 1, err
 	}
 
-	repo := strings.Trim(parts[1], "'/")
-	if strings.Contains(repo, "/") {
-		_, err = fmt.Fprintf(stderr, "invalid repo: %#v\r\n", repo)
+	// repo stays empty if there's only one repo to serve
+	var repo, repo_path string
+	switch {
+	case rh.Repo != "":
+		repo_path = rh.Repo
+	case rh.RepoBase == "":
+		repo_path = "."
+	default:
+		repo, err = cleanRepoName(parts[1])
+		if err != nil {
+			_, err = fmt.Fprintf(stderr, "%v\r\n", err)
+			return 1, err
+		}
+	}
+
+	need := PermissionRead
+	if parts[0] == "git-receive-pack" {
+		need = PermissionWrite
+	}
+	ok, err := rh.checkPermission(ctx, meta, repo, need, stderr)
+	if !ok || err != nil {
 		return 1, err
 	}
 
-	var repo_path string
-	if rh.Repo != "" {
-		repo_path = rh.Repo
-	} else if rh.RepoBase != "" {
-		repo_path = filepath.Join(rh.RepoBase, repo)
-	} else {
-		repo_path = "."
+	if repo_path == "" {
+		repo_path, err = findRepo(rh.RepoBase, repo)
+		if err == errRepoNotFound {
+			_, err = fmt.Fprintf(stderr, "repo %#v not found\r\n", repo)
+			return 1, err
+		}
+		if err != nil {
+			return 1, err
+		}
 	}
 
 	logger.Noticef("Remote request for repo %#v", repo_path)
-	cmd := exec.Command(os_cmd, repo_path)
+	if repo != "" {
+		auditEvent(ctx).Repo = repo
+	} else {
+		auditEvent(ctx).Repo = repo_path
+	}
+	cmd := gitCommand(ctx, env, os_cmd, repo_path)
 	cmd.Stdin = stdin
 	cmd.Stdout = stdout
 	cmd.Stderr = stderr
+	if parts[0] == "git-receive-pack" &&
+		(rh.Protection != nil || rh.Audit != nil || rh.Webhooks != nil) {
+		return rh.receivePack(ctx, cmd, meta, repo, repo_path)
+	}
 	return RunExec(cmd)
 }
 
+// receivePack runs git-receive-pack cmd, keeping track of the ref updates
+// pushed.
+func (rh *RepoHosting) receivePack(ctx context.Context, cmd *exec.Cmd,
+	meta ssh.ConnMetadata, repo, repo_path string) (exit_status uint32,
+	err error) {
+	defer mon.Task()(&ctx)(&err)
+	var updates []RefUpdate
+	commands := &commandList{
+		Reader: cmd.Stdin,
+		Command: func(update RefUpdate, extra io.Writer) error {
+			updates = append(updates, update)
+			return nil
+		}}
+	cmd.Stdin = commands
+	// the report-status response says which updates were made
+	status := &statusRewriter{
+		Writer:   cmd.Stdout,
+		Stderr:   cmd.Stderr,
+		Commands: commands}
+	cmd.Stdout = status
+	if rh.Protection != nil {
+		exit_status, err = rh.protectedReceivePack(ctx, cmd, status, meta,
+			repo, repo_path)
+	} else {
+		exit_status, err = RunExec(cmd)
+	}
+	if flush_err := status.Flush(); err == nil {
+		err = flush_err
+	}
+	if err == nil && commands.Err != nil {
+		err = commands.Err
+	}
+	if len(updates) == 0 {
+		return exit_status, err
+	}
+	// some updates may have been rejected
+	applied, reported := status.reportedUpdates(updates)
+	if !reported {
+		// e.g. the client went away, or didn't ask for a report. look at the
+		// refs instead, whether or not ctx is canceled.
+		var applied_err error
+		applied, applied_err = appliedUpdates(context.Background(), repo_path,
+			updates)
+		if applied_err != nil {
+			logger.Errorf("checking pushed refs in %#v: %v", repo_path,
+				applied_err)
+		}
+	}
+	auditEvent(ctx).Refs = applied
+	if rh.Webhooks != nil && len(applied) > 0 {
+		name := repo
+		if name == "" {
+			name = repo_path
+		}
+		user, key := rh.identify(meta)
+		fingerprint := ""
+		if key != nil {
+			fingerprint = ssh.FingerprintSHA256(key)
+		}
+		rh.Webhooks.pushed(name, user, fingerprint, applied)
+	}
+	return exit_status, err
+}
+
+// appliedUpdates returns which of updates are in effect in the repo at
+// repo_path.
+func appliedUpdates(ctx context.Context, repo_path string,
+	updates []RefUpdate) (applied []RefUpdate, err error) {
+	defer mon.Task()(&ctx)(&err)
+	args := []string{"for-each-ref", "--format=%(objectname) %(refname)"}
+	for _, update := range updates {
+		args = append(args, string(update.Ref))
+	}
+	cmd := exec.CommandContext(ctx, "git", args...)
+	cmd.Dir = repo_path
+	out, err := cmd.Output()
+	if err != nil {
+		return nil, err
+	}
+	current := map[Ref]string{}
+	for _, line := range strings.Split(string(out), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) == 2 {
+			current[Ref(fields[1])] = fields[0]
+		}
+	}
+	for _, update := range updates {
+		id, exists := current[update.Ref]
+		if (update.IsDelete() && !exists) || (exists && id == update.New) {
+			applied = append(applied, update)
+		}
+	}
+	return applied, nil
+}
+
+// protectedReceivePack runs git-receive-pack cmd, checking each ref update
+// against the RefRules for the connection. cmd.Stdout must be status, which
+// the caller flushes.
+func (rh *RepoHosting) protectedReceivePack(ctx context.Context,
+	cmd *exec.Cmd, status *statusRewriter, meta ssh.ConnMetadata, repo,
+	repo_path string) (exit_status uint32, err error) {
+	defer mon.Task()(&ctx)(&err)
+	key, err := connKey(meta)
+	if err != nil {
+		return 1, err
+	}
+	rules, err := rh.Protection.RefRules(ctx, meta, key, repo)
+	if err != nil {
+		return 1, err
+	}
+	if len(rules) == 0 {
+		return RunExec(cmd)
+	}
+
+	hooks, err := writeHooks()
+	if err != nil {
+		return 1, err
+	}
+	defer os.RemoveAll(hooks)
+	requests_r, requests_w, err := os.Pipe()
+	if err != nil {
+		return 1, err
+	}
+	defer requests_r.Close()
+	verdicts_r, verdicts_w, err := os.Pipe()
+	if err != nil {
+		requests_w.Close()
+		return 1, err
+	}
+	defer verdicts_w.Close()
+
+	guard := newRefGuard(ctx, repo_path, rules)
+	status.Rewrite = guard.rewriteReport
+	if cmd.Env == nil {
+		cmd.Env = os.Environ()
+	}
+	cmd.Env = append(cmd.Env, "GIT_CONFIG_COUNT=1",
+		"GIT_CONFIG_KEY_0=core.hooksPath", "GIT_CONFIG_VALUE_0="+hooks)
+	cmd.ExtraFiles = []*os.File{requests_w, verdicts_r}
+
+	err = cmd.Start()
+	requests_w.Close()
+	verdicts_r.Close()
+	if err != nil {
+		return execExitStatus(err)
+	}
+	go guard.serve(requests_r, verdicts_w)
+	return execExitStatus(cmd.Wait())
+}
+
+// checkPermission returns true if the connection has at least need on repo,
+// as far as both the ACL and the key's options are concerned. If not, it
+// tells the user.
+func (rh *RepoHosting) checkPermission(ctx context.Context,
+	meta ssh.ConnMetadata, repo string, need Permission, stderr io.Writer) (
+	ok bool, err error) {
+	have := PermissionAdmin
+	if rh.ACL != nil {
+		key, err := connKey(meta)
+		if err != nil {
+			return false, err
+		}
+		have, err = rh.ACL.Permission(ctx, meta, key, repo)
+		if err != nil {
+			return false, err
+		}
+	}
+	if limit := keyLimit(meta, repo); limit < have {
+		have = limit
+	}
+	return checkedPermission(meta, repo, have, need, stderr)
+}
+
+// checkedPermission returns true if have is at least need. If not, it tells
+// the user.
+func checkedPermission(meta ssh.ConnMetadata, repo string, have,
+	need Permission, stderr io.Writer) (ok bool, err error) {
+	if have >= need {
+		return true, nil
+	}
+	logger.Noticef("%s from %s has %s access to %#v, needs %s", meta.User(),
+		meta.RemoteAddr(), have, repo, need)
+	if have == PermissionNone {
+		// don't reveal which repos exist
+		_, err = fmt.Fprintf(stderr, "repo %#v not found\r\n", repo)
+	} else {
+		_, err = fmt.Fprintf(stderr, "you don't have %s access to %#v\r\n",
+			need, repo)
+	}
+	return false, err
+}
+
 func (rh *RepoHosting) publicKeyCallback(
 	meta ssh.ConnMetadata, key ssh.PublicKey) (rv *ssh.Permissions, err error) {
 	defer mon.Task()(nil)(&err)
 
+	if rh.CertAuthority != nil {
+		perms, handled, err := rh.CertAuthority.authenticateKey(meta, key,
+			rh.KeySource != nil || len(rh.AuthorizedKeys) > 0)
+		if handled {
+			return perms, err
+		}
+	}
+
+	if rh.KeySource != nil {
+		return authorizeKey(rh.KeySource, meta, key)
+	}
+
 	if len(rh.AuthorizedKeys) == 0 {
 		logger.Noticef("All users authorized")
-		return nil, nil
+		return keyPermissions(key), nil
 	}
 
 	for _, auth_key := range rh.AuthorizedKeys {
@@ -103,7 +408,7 @@ func (rh *RepoHosting) publicKeyCallback(
 		if bytes.Equal(ssh.MarshalAuthorizedKey(auth_key),
 			ssh.MarshalAuthorizedKey(key)) {
 			logger.Infof("User authorized")
-			return nil, nil
+			return keyPermissions(key), nil
 		}
 	}
 
@@ -111,12 +416,61 @@ func (rh *RepoHosting) publicKeyCallback(
 	return nil, fmt.Errorf("invalid user")
 }
 
+// userName returns the name of the user with principal (if they used a
+// certificate) and key, or "" if they have none.
+func (rh *RepoHosting) userName(principal string, key ssh.PublicKey) string {
+	if principal != "" {
+		return principal
+	}
+	named, ok := rh.ACL.(interface {
+		User(key ssh.PublicKey) string
+	})
+	if !ok || key == nil {
+		return ""
+	}
+	return named.User(key)
+}
+
+// identify returns who the connection belongs to, for auditing.
+func (rh *RepoHosting) identify(meta ssh.ConnMetadata) (user string,
+	key ssh.PublicKey) {
+	key, _ = connKey(meta)
+	return rh.userName(connUser(meta), key), key
+}
+
+// authUser returns who an accepted key belongs to, for auditing.
+func (rh *RepoHosting) authUser(meta ssh.ConnMetadata,
+	perms *ssh.Permissions) string {
+	if perms == nil {
+		return ""
+	}
+	key, _ := ssh.ParsePublicKey([]byte(perms.Extensions[keyExtension]))
+	return rh.userName(perms.Extensions[userExtension], key)
+}
+
+func keyPermissions(key ssh.PublicKey) *ssh.Permissions {
+	return &ssh.Permissions{
+		Extensions: map[string]string{keyExtension: string(key.Marshal())}}
+}
+
 func (rh *RepoHosting) ListenAndServe(network, address string) (err error) {
+	defer mon.Task()(nil)(&err)
+	listener, err := net.Listen(network, address)
+	if err != nil {
+		return err
+	}
+	return rh.Serve(listener)
+}
+
+// Serve serves connections from all of listeners until Shutdown or Close is
+// called. See gs_ssh.RestrictedServer.ServeListeners.
+func (rh *RepoHosting) Serve(listeners ...net.Listener) (err error) {
 	defer mon.Task()(nil)(&err)
 	config := &ssh.ServerConfig{PublicKeyCallback: rh.publicKeyCallback}
 
-	if rh.PrivateKey == nil {
-		logger.Noticef("No private key specified, generating a new one")
+	if rh.PrivateKey == nil && rh.HostKeys == nil {
+		logger.Warnf("No private key specified, generating a new one. Clients " +
+			"will see a different host key every restart")
 		rsa_key, err := rsa.GenerateKey(rand.Reader, 2048)
 		if err != nil {
 			return err
@@ -126,11 +480,60 @@ func (rh *RepoHosting) ListenAndServe(network, address string) (err error) {
 			return err
 		}
 	}
-	config.AddHostKey(rh.PrivateKey)
+	var keys []ssh.Signer
+	if rh.PrivateKey != nil {
+		keys = append(keys, rh.PrivateKey)
+	}
+	server := rh.getServer()
+	if rh.HostKeys != nil {
+		keys = append(keys, rh.HostKeys.Active...)
+		server.HostKeys = append(handshakeKeys(keys), rh.HostKeys.Staged...)
+	}
+	server.SSHConfig = config
+	for _, key := range handshakeKeys(keys) {
+		server.AddHostKey(key)
+	}
+	auditAuth(rh.Audit, "hosting", config, server, rh.authUser)
+	server.ShellError = rh.ShellError
+	server.MOTD = rh.MOTD
+	server.Handler = auditCommands(rh.Audit, "hosting", rh.cmdHandler,
+		rh.identify)
+	server.AllowedEnv = gitEnv
+	server.Timeouts = rh.Timeouts
+	server.ProxyProtocol = rh.ProxyProtocol
+	if rh.Limits != nil {
+		limits := *rh.Limits
+		if limits.User == nil {
+			limits.User = connIdentity
+		}
+		server.Limits = &limits
+	}
+	return server.ServeListeners(listeners)
+}
+
+func (rh *RepoHosting) getServer() *gs_ssh.RestrictedServer {
+	rh.mtx.Lock()
+	defer rh.mtx.Unlock()
+	if rh.server == nil {
+		rh.server = &gs_ssh.RestrictedServer{}
+	}
+	return rh.server
+}
+
+// Shutdown gracefully stops the server. See gs_ssh.RestrictedServer.Shutdown.
+// Webhook deliveries in progress are waited for too.
+func (rh *RepoHosting) Shutdown(ctx context.Context) error {
+	err := rh.getServer().Shutdown(ctx)
+	if rh.Webhooks != nil {
+		wait_err := rh.Webhooks.Wait(ctx)
+		if err == nil {
+			err = wait_err
+		}
+	}
+	return err
+}
 
-	return (&gs_ssh.RestrictedServer{
-		SSHConfig:  config,
-		ShellError: rh.ShellError,
-		MOTD:       rh.MOTD,
-		Handler:    rh.cmdHandler}).ListenAndServe(network, address)
+// Close forcibly stops the server.
+func (rh *RepoHosting) Close() error {
+	return rh.getServer().Close()
 }
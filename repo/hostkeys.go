@@ -0,0 +1,205 @@
+// Copyright (C) 2014 JT Olds
+// See LICENSE for copying information
+
+package repo
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// HostKeys are a server's SSH host keys.
+type HostKeys struct {
+	// Active keys are offered to clients during the handshake. Only the first
+	// key of each type is used.
+	Active []ssh.Signer
+	// Staged keys aren't used in the handshake, but are announced to clients
+	// along with the Active keys, so that clients with OpenSSH's
+	// UpdateHostKeys option learn them before they become active.
+	Staged []ssh.Signer
+}
+
+// hostKeyTypes are the host keys LoadHostKeys generates, in order of
+// preference.
+var hostKeyTypes = []struct {
+	name     string
+	generate func() (crypto.PrivateKey, error)
+}{
+	{"ed25519", func() (crypto.PrivateKey, error) {
+		_, key, err := ed25519.GenerateKey(rand.Reader)
+		return key, err
+	}},
+	{"ecdsa", func() (crypto.PrivateKey, error) {
+		return ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	}},
+	{"rsa", func() (crypto.PrivateKey, error) {
+		return rsa.GenerateKey(rand.Reader, 3072)
+	}},
+}
+
+// stagedSuffix marks a host key file as staged.
+const stagedSuffix = ".next"
+
+// LoadHostKeys loads the host keys in dir, creating dir and generating
+// ssh_host_ed25519_key, ssh_host_ecdsa_key and ssh_host_rsa_key in it if
+// they're missing. Any other ssh_host_*_key files are loaded as Active keys
+// too, and ssh_host_*_key.next files are loaded as Staged keys.
+//
+// To rotate a key, write the new one to e.g. ssh_host_ed25519_key.next, and
+// restart the server. Once clients have had time to learn the new key, move it
+// over ssh_host_ed25519_key and restart again.
+func LoadHostKeys(dir string) (keys *HostKeys, err error) {
+	defer mon.Task()(nil)(&err)
+	err = os.MkdirAll(dir, 0700)
+	if err != nil {
+		return nil, err
+	}
+	for _, key_type := range hostKeyTypes {
+		path := filepath.Join(dir, "ssh_host_"+key_type.name+"_key")
+		_, err := os.Stat(path)
+		if err == nil {
+			continue
+		}
+		if !os.IsNotExist(err) {
+			return nil, err
+		}
+		logger.Noticef("Generating host key %#v", path)
+		private_key, err := key_type.generate()
+		if err != nil {
+			return nil, err
+		}
+		err = writeHostKey(path, private_key)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	active, err := filepath.Glob(filepath.Join(dir, "ssh_host_*_key"))
+	if err != nil {
+		return nil, err
+	}
+	staged, err := filepath.Glob(filepath.Join(dir,
+		"ssh_host_*_key"+stagedSuffix))
+	if err != nil {
+		return nil, err
+	}
+	keys = &HostKeys{}
+	keys.Active, err = loadHostKeyFiles(sortHostKeyFiles(active))
+	if err != nil {
+		return nil, err
+	}
+	keys.Staged, err = loadHostKeyFiles(sortHostKeyFiles(staged))
+	if err != nil {
+		return nil, err
+	}
+	return keys, nil
+}
+
+// sortHostKeyFiles sorts paths so that generated key types come first, in
+// order of preference.
+func sortHostKeyFiles(paths []string) []string {
+	rank := func(path string) int {
+		name := strings.TrimSuffix(filepath.Base(path), stagedSuffix)
+		for i, key_type := range hostKeyTypes {
+			if name == "ssh_host_"+key_type.name+"_key" {
+				return i
+			}
+		}
+		return len(hostKeyTypes)
+	}
+	sort.SliceStable(paths, func(i, j int) bool {
+		if rank(paths[i]) != rank(paths[j]) {
+			return rank(paths[i]) < rank(paths[j])
+		}
+		return paths[i] < paths[j]
+	})
+	return paths
+}
+
+func loadHostKeyFiles(paths []string) (signers []ssh.Signer, err error) {
+	for _, path := range paths {
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		signer, err := ssh.ParsePrivateKey(data)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", path, err)
+		}
+		logger.Noticef("Loaded host key %#v (%s)", path,
+			ssh.FingerprintSHA256(signer.PublicKey()))
+		signers = append(signers, signer)
+	}
+	return signers, nil
+}
+
+// writeHostKey writes private_key to path, and its public key to path.pub.
+func writeHostKey(path string, private_key crypto.PrivateKey) error {
+	signer, err := ssh.NewSignerFromKey(private_key)
+	if err != nil {
+		return err
+	}
+	der, err := x509.MarshalPKCS8PrivateKey(private_key)
+	if err != nil {
+		return err
+	}
+	err = writeFileAtomic(path, pem.EncodeToMemory(&pem.Block{
+		Type: "PRIVATE KEY", Bytes: der}), 0600)
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(path+".pub",
+		ssh.MarshalAuthorizedKey(signer.PublicKey()), 0644)
+}
+
+// writeFileAtomic writes data to path so that readers never see a partial
+// file.
+func writeFileAtomic(path string, data []byte, perm os.FileMode) error {
+	fh, err := ioutil.TempFile(filepath.Dir(path),
+		"."+filepath.Base(path)+".tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(fh.Name())
+	_, err = fh.Write(data)
+	if err == nil {
+		err = fh.Chmod(perm)
+	}
+	if err == nil {
+		err = fh.Sync()
+	}
+	if close_err := fh.Close(); err == nil {
+		err = close_err
+	}
+	if err != nil {
+		return err
+	}
+	return os.Rename(fh.Name(), path)
+}
+
+// handshakeKeys returns the first key of each type in keys.
+func handshakeKeys(keys []ssh.Signer) (rv []ssh.Signer) {
+	seen := map[string]bool{}
+	for _, key := range keys {
+		if seen[key.PublicKey().Type()] {
+			continue
+		}
+		seen[key.PublicKey().Type()] = true
+		rv = append(rv, key)
+	}
+	return rv
+}
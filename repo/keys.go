@@ -0,0 +1,402 @@
+// Copyright (C) 2014 JT Olds
+// See LICENSE for copying information
+
+package repo
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	gs_ssh "github.com/jtolds/gitserve/ssh"
+	"golang.org/x/crypto/ssh"
+)
+
+// AuthorizedKey is a key line from an authorized_keys file.
+type AuthorizedKey struct {
+	Key     ssh.PublicKey
+	Comment string
+	Options []string
+	KeyOptions
+}
+
+// KeyOptions are the authorized_keys options gitserve enforces. gitserve
+// never offers ptys, forwarding, agents, X11 or user rc files, so restrict
+// and the no-* options are always satisfied, and the options that turn those
+// back on are accepted but have no effect.
+type KeyOptions struct {
+	// From is the from="pattern-list" option. If set, the key may only
+	// connect from addresses matching one of the patterns, and none of the
+	// negated (!) ones. Patterns are IP address wildcards or CIDR ranges;
+	// host names aren't looked up.
+	From []string
+	// ExpiryTime is the expiry-time= option. If set, the key may not connect
+	// after it.
+	ExpiryTime time.Time
+	// Command is the command= option. gitserve only runs git, so keys with a
+	// forced command are refused instead of being allowed to run something
+	// else.
+	Command string
+
+	// Repos is the gitserve-repos="pattern-list" option. If set, the key may
+	// only use repos matching one of the patterns, using path.Match.
+	Repos []string
+	// ReadOnly is the gitserve-read-only option. If set, the key may fetch
+	// but not push.
+	ReadOnly bool
+}
+
+// ignoredKeyOptions are OpenSSH options that don't matter to gitserve.
+var ignoredKeyOptions = map[string]bool{
+	"restrict": true, "no-agent-forwarding": true,
+	"no-port-forwarding": true, "no-pty": true, "no-user-rc": true,
+	"no-x11-forwarding": true, "agent-forwarding": true,
+	"port-forwarding": true, "pty": true, "user-rc": true,
+	"x11-forwarding": true, "no-touch-required": true,
+	"verify-required": true, "environment": true, "permitopen": true,
+	"permitlisten": true, "tunnel": true}
+
+// ParseKeyOptions parses the options ssh.ParseAuthorizedKey returns. Options
+// gitserve doesn't know are an error.
+func ParseKeyOptions(options []string) (rv KeyOptions, err error) {
+	for _, option := range options {
+		name, value, has_value := strings.Cut(option, "=")
+		name = strings.ToLower(name)
+		if has_value {
+			unquoted, err := strconv.Unquote(value)
+			if err != nil {
+				return rv, fmt.Errorf("bad option %s: %v", option, err)
+			}
+			value = unquoted
+		}
+		switch {
+		case ignoredKeyOptions[name]:
+		case !has_value && name == "gitserve-read-only":
+			rv.ReadOnly = true
+		case has_value && name == "from":
+			for _, pattern := range strings.Split(value, ",") {
+				bare := strings.TrimPrefix(pattern, "!")
+				if strings.Contains(bare, "/") {
+					_, _, err = net.ParseCIDR(bare)
+				} else {
+					_, err = path.Match(bare, "")
+				}
+				if err != nil {
+					return rv, fmt.Errorf("bad from pattern %#v", pattern)
+				}
+				rv.From = append(rv.From, pattern)
+			}
+		case has_value && name == "expiry-time":
+			rv.ExpiryTime, err = parseExpiryTime(value)
+			if err != nil {
+				return rv, err
+			}
+		case has_value && name == "command":
+			rv.Command = value
+		case has_value && name == "gitserve-repos":
+			for _, pattern := range strings.Split(value, ",") {
+				pattern = strings.Trim(pattern, "/")
+				if _, err := path.Match(pattern, ""); err != nil {
+					return rv, fmt.Errorf("bad repo pattern %#v", pattern)
+				}
+				rv.Repos = append(rv.Repos, pattern)
+			}
+		default:
+			return rv, fmt.Errorf("unsupported option %s", option)
+		}
+	}
+	return rv, nil
+}
+
+// parseExpiryTime parses YYYYMMDD[HHMM[SS]], in local time, or UTC with a Z
+// suffix, like OpenSSH.
+func parseExpiryTime(value string) (time.Time, error) {
+	loc := time.Local
+	if strings.HasSuffix(value, "Z") {
+		loc = time.UTC
+		value = strings.TrimSuffix(value, "Z")
+	}
+	layout := map[int]string{
+		8:  "20060102",
+		12: "200601021504",
+		14: "20060102150405"}[len(value)]
+	if layout == "" {
+		return time.Time{}, fmt.Errorf("bad expiry-time %#v", value)
+	}
+	return time.ParseInLocation(layout, value, loc)
+}
+
+// Check returns an error if the options don't let the key connect from
+// remote at now.
+func (o *KeyOptions) Check(remote net.Addr, now time.Time) error {
+	if o.Command != "" {
+		return fmt.Errorf("keys with a forced command are not supported")
+	}
+	if !o.ExpiryTime.IsZero() && now.After(o.ExpiryTime) {
+		return fmt.Errorf("key expired at %s", o.ExpiryTime)
+	}
+	if len(o.From) > 0 && !matchFrom(o.From, remote) {
+		return fmt.Errorf("key not allowed from %s", remote)
+	}
+	return nil
+}
+
+// matchFrom matches remote against a from= pattern list the way OpenSSH
+// does, minus host names: a negated match rejects, otherwise any match
+// accepts.
+func matchFrom(patterns []string, remote net.Addr) bool {
+	host, _, err := net.SplitHostPort(remote.String())
+	if err != nil {
+		host = remote.String()
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return false
+	}
+	if ip4 := ip.To4(); ip4 != nil {
+		ip = ip4
+	}
+	matched := false
+	for _, pattern := range patterns {
+		negated := strings.HasPrefix(pattern, "!")
+		pattern = strings.TrimPrefix(pattern, "!")
+		var ok bool
+		if strings.Contains(pattern, "/") {
+			_, network, err := net.ParseCIDR(pattern)
+			ok = err == nil && network.Contains(ip)
+		} else {
+			ok, _ = path.Match(pattern, ip.String())
+		}
+		if ok && negated {
+			return false
+		}
+		matched = matched || ok
+	}
+	return matched
+}
+
+const (
+	reposExtension    = "gitserve-repos@gitserve"
+	readOnlyExtension = "gitserve-read-only@gitserve"
+)
+
+// permissions returns the ssh.Permissions for a connection using k, which
+// carry the options needed after authentication.
+func (k *AuthorizedKey) permissions() *ssh.Permissions {
+	perms := keyPermissions(k.Key)
+	if len(k.Repos) > 0 {
+		perms.Extensions[reposExtension] = strings.Join(k.Repos, ",")
+	}
+	if k.ReadOnly {
+		perms.Extensions[readOnlyExtension] = ""
+	}
+	return perms
+}
+
+// authorizeKey looks key up in source and checks its options, returning the
+// ssh.Permissions for the connection.
+func authorizeKey(source KeySource, meta ssh.ConnMetadata,
+	key ssh.PublicKey) (*ssh.Permissions, error) {
+	entry := source.Lookup(key)
+	if entry == nil {
+		logger.Warnf("User not in authorized keys, rejecting")
+		return nil, fmt.Errorf("invalid user")
+	}
+	err := entry.Check(meta.RemoteAddr(), time.Now())
+	if err != nil {
+		logger.Warnf("Rejecting %s from %s: %v", ssh.FingerprintSHA256(key),
+			meta.RemoteAddr(), err)
+		return nil, err
+	}
+	logger.Infof("User authorized")
+	return entry.permissions(), nil
+}
+
+// keyLimit returns the most a connection's key options let it do to repo.
+func keyLimit(meta ssh.ConnMetadata, repo string) Permission {
+	perms := gs_ssh.Permissions(meta)
+	if perms == nil {
+		return PermissionAdmin
+	}
+	if repos, ok := perms.Extensions[reposExtension]; ok {
+		matched := false
+		for _, pattern := range strings.Split(repos, ",") {
+			if ok, _ := path.Match(pattern, repo); ok {
+				matched = true
+				break
+			}
+		}
+		if !matched {
+			return PermissionNone
+		}
+	}
+	if _, ok := perms.Extensions[readOnlyExtension]; ok {
+		return PermissionRead
+	}
+	return PermissionAdmin
+}
+
+// KeySource decides which keys may connect.
+type KeySource interface {
+	// Lookup returns the entry for key, or nil if key may not connect.
+	Lookup(key ssh.PublicKey) *AuthorizedKey
+}
+
+// ParseAuthorizedKeys parses an authorized_keys file, including the options
+// in KeyOptions. Unlike LoadAuthorizedKeys, any line that isn't blank, a
+// comment or a valid key with supported options is an error.
+func ParseAuthorizedKeys(data []byte) (rv []*AuthorizedKey, err error) {
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for lineno := 1; scanner.Scan(); lineno++ {
+		line := bytes.TrimSpace(scanner.Bytes())
+		if len(line) == 0 || line[0] == '#' {
+			continue
+		}
+		key, comment, options, _, err := ssh.ParseAuthorizedKey(line)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %v", lineno, err)
+		}
+		key_options, err := ParseKeyOptions(options)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %v", lineno, err)
+		}
+		rv = append(rv, &AuthorizedKey{
+			Key:        key,
+			Comment:    comment,
+			Options:    options,
+			KeyOptions: key_options})
+	}
+	return rv, scanner.Err()
+}
+
+// AuthorizedKeysFile is a KeySource backed by an authorized_keys file, which
+// can be reloaded while connections are using it. If reloading fails, the
+// keys from the last successful load stay in effect.
+type AuthorizedKeysFile struct {
+	Path string
+
+	mtx  sync.Mutex
+	keys map[string]*AuthorizedKey
+	stat fileStat
+}
+
+var _ KeySource = (*AuthorizedKeysFile)(nil)
+
+// LoadAuthorizedKeysFile loads the authorized_keys file at path.
+func LoadAuthorizedKeysFile(path string) (*AuthorizedKeysFile, error) {
+	f := &AuthorizedKeysFile{Path: path}
+	return f, f.Reload()
+}
+
+// Reload rereads the file, replacing the current keys if it parses.
+func (f *AuthorizedKeysFile) Reload() error {
+	stat, err := statFile(f.Path)
+	if err != nil {
+		return err
+	}
+	data, err := ioutil.ReadFile(f.Path)
+	if err != nil {
+		return err
+	}
+	entries, err := ParseAuthorizedKeys(data)
+	if err != nil {
+		return fmt.Errorf("%s: %v", f.Path, err)
+	}
+	keys := make(map[string]*AuthorizedKey, len(entries))
+	for _, entry := range entries {
+		keys[string(entry.Key.Marshal())] = entry
+	}
+	f.mtx.Lock()
+	f.keys = keys
+	f.stat = stat
+	f.mtx.Unlock()
+	logger.Noticef("loaded %d authorized keys from %s", len(keys), f.Path)
+	return nil
+}
+
+func (f *AuthorizedKeysFile) Lookup(key ssh.PublicKey) *AuthorizedKey {
+	f.mtx.Lock()
+	defer f.mtx.Unlock()
+	return f.keys[string(key.Marshal())]
+}
+
+func (f *AuthorizedKeysFile) loaded() fileStat {
+	f.mtx.Lock()
+	defer f.mtx.Unlock()
+	return f.stat
+}
+
+// Watch reloads the file whenever it changes, checking every interval,
+// until ctx is canceled. Reload errors are logged.
+func (f *AuthorizedKeysFile) Watch(ctx context.Context,
+	interval time.Duration) {
+	watchFile(ctx, f.Path, interval, f.loaded, f.Reload)
+}
+
+// fileStat is what watchFile compares to notice a file changed, including
+// being replaced by a rename.
+type fileStat struct {
+	mod_time time.Time
+	size     int64
+	info     os.FileInfo
+}
+
+func statFile(path string) (fileStat, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return fileStat{}, err
+	}
+	return fileStat{mod_time: info.ModTime(), size: info.Size(), info: info},
+		nil
+}
+
+func (s fileStat) changed(other fileStat) bool {
+	if s.info == nil || other.info == nil {
+		return s.info != other.info
+	}
+	return !s.mod_time.Equal(other.mod_time) || s.size != other.size ||
+		!os.SameFile(s.info, other.info)
+}
+
+// watchFile polls path every interval, calling reload when it no longer
+// matches what loaded returns, until ctx is canceled.
+func watchFile(ctx context.Context, path string, interval time.Duration,
+	loaded func() fileStat, reload func() error) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	var last_err string
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		stat, err := statFile(path)
+		if err == nil && !stat.changed(loaded()) {
+			last_err = ""
+			continue
+		}
+		if err == nil {
+			err = reload()
+		}
+		if err == nil {
+			last_err = ""
+			continue
+		}
+		// don't repeat the same complaint every interval
+		if msg := err.Error(); msg != last_err {
+			last_err = msg
+			logger.Errorf("reloading %s, keeping previous version: %v", path,
+				strings.TrimPrefix(msg, path+": "))
+		}
+	}
+}
@@ -0,0 +1,188 @@
+// Copyright (C) 2014 JT Olds
+// See LICENSE for copying information
+
+package repo
+
+import (
+	"net"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseKeyOptions(t *testing.T) {
+	local := func(value string, layout string) time.Time {
+		rv, err := time.ParseInLocation(layout, value, time.Local)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return rv
+	}
+
+	for _, test := range []struct {
+		options []string
+		parsed  KeyOptions
+		err     bool
+	}{
+		{options: nil},
+		{options: []string{"restrict", "no-pty", "No-Agent-Forwarding",
+			`environment="A=b"`, `permitopen="host:22"`}},
+		{options: []string{`from="10.0.0.1,192.168.*,!192.168.1.1"`},
+			parsed: KeyOptions{From: []string{"10.0.0.1", "192.168.*",
+				"!192.168.1.1"}}},
+		{options: []string{`FROM="10.0.0.0/8,!10.1.0.0/16,2001:db8::/32"`},
+			parsed: KeyOptions{From: []string{"10.0.0.0/8", "!10.1.0.0/16",
+				"2001:db8::/32"}}},
+		{options: []string{`from="10.0.0.0/33"`}, err: true},
+		{options: []string{`from="!host/8"`}, err: true},
+		{options: []string{`from="10.0.0.["`}, err: true},
+		{options: []string{`from=10.0.0.1`}, err: true},
+		{options: []string{`from`}, err: true},
+		{options: []string{`expiry-time="20300102"`},
+			parsed: KeyOptions{ExpiryTime: local("20300102", "20060102")}},
+		{options: []string{`expiry-time="203001021504"`},
+			parsed: KeyOptions{
+				ExpiryTime: local("203001021504", "200601021504")}},
+		{options: []string{`expiry-time="20300102150405Z"`},
+			parsed: KeyOptions{ExpiryTime: time.Date(2030, 1, 2, 15, 4, 5, 0,
+				time.UTC)}},
+		{options: []string{`expiry-time="2030010215"`}, err: true},
+		{options: []string{`expiry-time="2030-01-02"`}, err: true},
+		{options: []string{`expiry-time="20301332"`}, err: true},
+		{options: []string{`command="echo hi"`},
+			parsed: KeyOptions{Command: "echo hi"}},
+		{options: []string{`command="echo \"hi\""`},
+			parsed: KeyOptions{Command: `echo "hi"`}},
+		{options: []string{`gitserve-repos="/team/*/,proj"`,
+			"gitserve-read-only"},
+			parsed: KeyOptions{Repos: []string{"team/*", "proj"},
+				ReadOnly: true}},
+		{options: []string{`gitserve-repos="team/["`}, err: true},
+		{options: []string{`gitserve-read-only="yes"`}, err: true},
+		{options: []string{"cert-authority"}, err: true},
+		{options: []string{`principals="alice"`}, err: true},
+		{options: []string{`command="unterminated`}, err: true},
+	} {
+		parsed, err := ParseKeyOptions(test.options)
+		if test.err {
+			if err == nil {
+				t.Errorf("%#v: expected error, got %+v", test.options, parsed)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%#v: unexpected error: %v", test.options, err)
+			continue
+		}
+		if !reflect.DeepEqual(parsed, test.parsed) {
+			t.Errorf("%#v: got %+v, expected %+v", test.options, parsed,
+				test.parsed)
+		}
+	}
+}
+
+func TestMatchFrom(t *testing.T) {
+	for _, test := range []struct {
+		patterns string
+		remote   string
+		match    bool
+	}{
+		{"10.0.0.1", "10.0.0.1:22", true},
+		{"10.0.0.1", "10.0.0.2:22", false},
+		{"10.0.0.*", "10.0.0.200:22", true},
+		{"10.0.0.?", "10.0.0.20:22", false},
+		{"10.0.0.0/24", "10.0.0.200:22", true},
+		{"10.0.0.0/24", "10.0.1.1:22", false},
+		{"10.0.0.0/8,!10.1.0.0/16", "10.2.0.1:22", true},
+		{"10.0.0.0/8,!10.1.0.0/16", "10.1.0.1:22", false},
+		{"!10.1.0.0/16,10.0.0.0/8", "10.1.0.1:22", false},
+		{"!10.1.0.1", "10.2.0.1:22", false},
+		{"*,!192.168.*", "192.168.0.1:22", false},
+		{"*", "192.168.0.1:22", true},
+		{"10.0.0.1", "[::ffff:10.0.0.1]:22", true},
+		{"10.0.0.0/8", "[::ffff:10.0.0.1]:22", true},
+		{"2001:db8::/32", "[2001:db8::1]:22", true},
+		{"2001:db8::/32", "[2001:db9::1]:22", false},
+		{"2001:db8::*", "[2001:db8::1]:22", true},
+		{"10.0.0.1", "10.0.0.1", true},
+		{"*", "pipe", false},
+		{"10.0.0.[", "10.0.0.1:22", false},
+	} {
+		remote := &net.UnixAddr{Name: test.remote}
+		match := matchFrom(strings.Split(test.patterns, ","), remote)
+		if match != test.match {
+			t.Errorf("%#v from %#v: got %v", test.patterns, test.remote, match)
+		}
+	}
+}
+
+func TestKeyOptionsCheck(t *testing.T) {
+	now := time.Date(2030, 1, 2, 0, 0, 0, 0, time.UTC)
+	remote := &net.TCPAddr{IP: net.ParseIP("10.0.0.1"), Port: 22}
+	for _, test := range []struct {
+		name    string
+		options KeyOptions
+		err     string
+	}{
+		{"no options", KeyOptions{}, ""},
+		{"not expired", KeyOptions{ExpiryTime: now}, ""},
+		{"expired", KeyOptions{ExpiryTime: now.Add(-time.Second)},
+			"key expired"},
+		{"from", KeyOptions{From: []string{"10.0.0.0/8"}}, ""},
+		{"not from", KeyOptions{From: []string{"192.168.*"}},
+			"key not allowed from 10.0.0.1:22"},
+		{"command", KeyOptions{Command: "true"}, "keys with a forced command"},
+	} {
+		err := test.options.Check(remote, now)
+		if test.err == "" {
+			if err != nil {
+				t.Errorf("%s: unexpected error: %v", test.name, err)
+			}
+			continue
+		}
+		if err == nil || !strings.HasPrefix(err.Error(), test.err) {
+			t.Errorf("%s: got %v, expected %#v...", test.name, err, test.err)
+		}
+	}
+}
+
+func TestParseAuthorizedKeys(t *testing.T) {
+	alice, bob := testKey(t), testKey(t)
+	keys, err := ParseAuthorizedKeys([]byte(`
+# comment
+` + authorizedKey(alice) + ` alice@example.com
+from="10.0.0.0/8",gitserve-read-only ` + authorizedKey(bob) + `
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(keys) != 2 {
+		t.Fatalf("got %d keys", len(keys))
+	}
+	if keys[0].Comment != "alice@example.com" || len(keys[0].Options) != 0 ||
+		string(keys[0].Key.Marshal()) != string(alice.Marshal()) {
+		t.Errorf("got %+v", keys[0])
+	}
+	expected := KeyOptions{From: []string{"10.0.0.0/8"}, ReadOnly: true}
+	if !reflect.DeepEqual(keys[1].KeyOptions, expected) ||
+		string(keys[1].Key.Marshal()) != string(bob.Marshal()) {
+		t.Errorf("got %+v", keys[1])
+	}
+
+	for _, test := range []struct {
+		in  string
+		err string
+	}{
+		{in: "\nnot a key", err: "line 2: "},
+		{in: "# comment\ncert-authority " + authorizedKey(alice),
+			err: "line 2: unsupported option"},
+		{in: `from="10.0.0.0/33" ` + authorizedKey(alice),
+			err: "line 1: bad from pattern"},
+	} {
+		_, err := ParseAuthorizedKeys([]byte(test.in))
+		if err == nil || !strings.HasPrefix(err.Error(), test.err) {
+			t.Errorf("%#v: got %v, expected %#v...", test.in, err, test.err)
+		}
+	}
+}
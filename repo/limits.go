@@ -0,0 +1,133 @@
+// Copyright (C) 2014 JT Olds
+// See LICENSE for copying information
+
+package repo
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os/exec"
+	"sync"
+	"time"
+)
+
+// ProcessLimits caps the resources a hook subprocess run with RunLimited may
+// use. Zero values mean no limit.
+type ProcessLimits struct {
+	// CPUTime is the most CPU time the process may use (RLIMIT_CPU).
+	CPUTime time.Duration
+	// Memory is the most address space in bytes the process may use
+	// (RLIMIT_AS).
+	Memory uint64
+	// Output is the most the process may write to stdout and stderr
+	// combined before it's killed.
+	Output int64
+}
+
+// outputBudget is shared by a process's stdout and stderr writers, and calls
+// exceeded once they've been sent more than their limit.
+type outputBudget struct {
+	mtx       sync.Mutex
+	remaining int64
+	tripped   bool
+	exceeded  func()
+}
+
+type budgetWriter struct {
+	budget *outputBudget
+	w      io.Writer
+}
+
+func (b *budgetWriter) Write(p []byte) (n int, err error) {
+	b.budget.mtx.Lock()
+	if b.budget.tripped {
+		b.budget.mtx.Unlock()
+		return 0, fmt.Errorf("output limit exceeded")
+	}
+	b.budget.remaining -= int64(len(p))
+	if b.budget.remaining < 0 {
+		b.budget.tripped = true
+		b.budget.mtx.Unlock()
+		b.budget.exceeded()
+		return 0, fmt.Errorf("output limit exceeded")
+	}
+	b.budget.mtx.Unlock()
+	return b.w.Write(p)
+}
+
+func (b *outputBudget) wasTripped() bool {
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+	return b.tripped
+}
+
+// RunLimited runs cmd like RunExec, but in its own process group and subject
+// to limits. If ctx is canceled or a limit trips, the whole process group is
+// killed, so hooks can't leave stragglers behind. When the output or CPU
+// limit trips, an explanation is written to msgs, if it's not nil. If ctx
+// ended the process, ctx's error is returned.
+//
+// cmd should not have been created with exec.CommandContext.
+func RunLimited(ctx context.Context, limits ProcessLimits, cmd *exec.Cmd,
+	msgs io.Writer) (exit_status uint32, err error) {
+	defer mon.Task()(&ctx)(&err)
+	if limits.CPUTime > 0 || limits.Memory > 0 {
+		err = applyRlimits(cmd, limits)
+		if err != nil {
+			return 1, err
+		}
+	}
+
+	var budget *outputBudget
+	if limits.Output > 0 {
+		budget = &outputBudget{
+			remaining: limits.Output,
+			exceeded:  func() { killProcessGroup(cmd) }}
+		same := cmd.Stdout == cmd.Stderr
+		if cmd.Stdout != nil {
+			cmd.Stdout = &budgetWriter{budget: budget, w: cmd.Stdout}
+		}
+		if same {
+			cmd.Stderr = cmd.Stdout
+		} else if cmd.Stderr != nil {
+			cmd.Stderr = &budgetWriter{budget: budget, w: cmd.Stderr}
+		}
+	}
+
+	setProcessGroup(cmd)
+	// don't let a grandchild holding stdout open keep us waiting forever
+	cmd.WaitDelay = time.Second
+	err = cmd.Start()
+	if err != nil {
+		return 1, err
+	}
+
+	done := make(chan struct{})
+	go func() {
+		select {
+		case <-ctx.Done():
+			killProcessGroup(cmd)
+		case <-done:
+		}
+	}()
+	exit_status, err = execExitStatus(cmd.Wait())
+	close(done)
+
+	switch {
+	case budget != nil && budget.wasTripped():
+		if msgs != nil {
+			fmt.Fprintf(msgs, "\nerror: output limit of %d bytes exceeded, "+
+				"process killed\n", limits.Output)
+		}
+		return 1, fmt.Errorf("output limit of %d bytes exceeded", limits.Output)
+	case ctx.Err() != nil:
+		return 1, ctx.Err()
+	case cpuLimitExceeded(err):
+		if msgs != nil {
+			fmt.Fprintf(msgs, "\nerror: CPU time limit of %s exceeded, "+
+				"process killed\n", limits.CPUTime)
+		}
+	}
+	return exit_status, err
+}
@@ -0,0 +1,25 @@
+// Copyright (C) 2014 JT Olds
+// See LICENSE for copying information
+
+//go:build !unix
+
+package repo
+
+import (
+	"fmt"
+	"os/exec"
+)
+
+func setProcessGroup(cmd *exec.Cmd) {}
+
+func killProcessGroup(cmd *exec.Cmd) {
+	if cmd.Process != nil {
+		cmd.Process.Kill()
+	}
+}
+
+func applyRlimits(cmd *exec.Cmd, limits ProcessLimits) error {
+	return fmt.Errorf("CPU and memory limits are unsupported on this platform")
+}
+
+func cpuLimitExceeded(err error) bool { return false }
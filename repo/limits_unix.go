@@ -0,0 +1,59 @@
+// Copyright (C) 2014 JT Olds
+// See LICENSE for copying information
+
+//go:build unix
+
+package repo
+
+import (
+	"fmt"
+	"os/exec"
+	"syscall"
+	"time"
+
+	gs_ssh "github.com/jtolds/gitserve/ssh"
+)
+
+func setProcessGroup(cmd *exec.Cmd) {
+	if cmd.SysProcAttr == nil {
+		cmd.SysProcAttr = &syscall.SysProcAttr{}
+	}
+	cmd.SysProcAttr.Setpgid = true
+}
+
+func killProcessGroup(cmd *exec.Cmd) {
+	if cmd.Process != nil {
+		syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL)
+	}
+}
+
+// applyRlimits has cmd run by a shell that sets the limits with ulimit
+// before exec'ing the real command, since os/exec can't set rlimits on a
+// child directly.
+func applyRlimits(cmd *exec.Cmd, limits ProcessLimits) error {
+	script := ""
+	if limits.CPUTime > 0 {
+		// round up to whole seconds. the hard limit is a second later so the
+		// process gets SIGXCPU, which we can explain, before SIGKILL.
+		secs := int64((limits.CPUTime + time.Second - 1) / time.Second)
+		script += fmt.Sprintf("ulimit -S -t %d && ulimit -H -t %d && ",
+			secs, secs+1)
+	}
+	if limits.Memory > 0 {
+		script += fmt.Sprintf("ulimit -v %d && ", (limits.Memory+1023)/1024)
+	}
+	script += `exec "$0" "$@"`
+
+	shell, err := exec.LookPath("sh")
+	if err != nil {
+		return err
+	}
+	cmd.Args = append([]string{"sh", "-c", script, cmd.Path}, cmd.Args[1:]...)
+	cmd.Path = shell
+	return nil
+}
+
+func cpuLimitExceeded(err error) bool {
+	sig, ok := err.(*gs_ssh.ExitSignal)
+	return ok && sig.Signal == signalName(syscall.SIGXCPU)
+}
@@ -0,0 +1,125 @@
+// Copyright (C) 2014 JT Olds
+// See LICENSE for copying information
+
+//go:build unix
+
+package repo
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	gs_ssh "github.com/jtolds/gitserve/ssh"
+)
+
+// processGone returns true once pid has exited, reaped or not.
+func processGone(pid int) bool {
+	if syscall.Kill(pid, 0) != nil {
+		return true
+	}
+	stat, err := ioutil.ReadFile(fmt.Sprintf("/proc/%d/stat", pid))
+	return err == nil && strings.Contains(string(stat), ") Z ")
+}
+
+func TestRunLimited(t *testing.T) {
+	for _, test := range []struct {
+		name   string
+		limits ProcessLimits
+		script string
+		status uint32
+		output string
+		err    string
+		msg    string
+	}{
+		{name: "exit status", script: "echo hi; exit 3", status: 3,
+			output: "hi\n"},
+		{name: "signal", script: "kill -TERM $$", status: 1, err: "TERM"},
+		{name: "rlimits",
+			limits: ProcessLimits{CPUTime: 1500 * time.Millisecond,
+				Memory: 1 << 30},
+			script: "ulimit -S -t; ulimit -H -t; ulimit -v",
+			output: "2\n3\n1048576\n"},
+		{name: "cpu limit", limits: ProcessLimits{CPUTime: time.Second},
+			script: "while :; do :; done", status: 1,
+			err: "CPU time limit exceeded",
+			msg: "CPU time limit of 1s exceeded"},
+		{name: "output limit", limits: ProcessLimits{Output: 1000},
+			script: "while :; do echo 0123456789; done", status: 1,
+			err: "output limit of 1000 bytes exceeded",
+			msg: "output limit of 1000 bytes exceeded"},
+	} {
+		var output, msgs bytes.Buffer
+		cmd := exec.Command("sh", "-c", test.script)
+		cmd.Stdout = &output
+		status, err := RunLimited(context.Background(), test.limits, cmd, &msgs)
+		if status != test.status {
+			t.Errorf("%s: got status %d, expected %d", test.name, status,
+				test.status)
+		}
+		if test.err == "" && err != nil {
+			t.Errorf("%s: unexpected error: %v", test.name, err)
+		}
+		if test.err != "" && (err == nil ||
+			!strings.Contains(err.Error(), test.err)) {
+			t.Errorf("%s: got %v, expected %#v", test.name, err, test.err)
+		}
+		if test.output != "" && output.String() != test.output {
+			t.Errorf("%s: got output %#v, expected %#v", test.name,
+				output.String(), test.output)
+		}
+		if !strings.Contains(msgs.String(), test.msg) ||
+			(test.msg == "" && msgs.Len() > 0) {
+			t.Errorf("%s: got message %#v, expected %#v", test.name,
+				msgs.String(), test.msg)
+		}
+	}
+}
+
+func TestRunLimitedTimeout(t *testing.T) {
+	pid_file := filepath.Join(t.TempDir(), "pid")
+	ctx, cancel := context.WithTimeout(context.Background(),
+		100*time.Millisecond)
+	defer cancel()
+	// the background sleep is in the hook's process group, and holds its
+	// stdout open
+	var output bytes.Buffer
+	cmd := exec.Command("sh", "-c", "sleep 30 & echo $! > "+pid_file+
+		"; sleep 30")
+	cmd.Stdout = &output
+	start := time.Now()
+	_, err := RunLimited(ctx, ProcessLimits{}, cmd, nil)
+	if err != context.DeadlineExceeded {
+		t.Fatalf("got %v, expected the deadline to pass", err)
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("took %s to give up", elapsed)
+	}
+	if _, ok := err.(*gs_ssh.ExitSignal); ok {
+		t.Errorf("got an exit signal instead of the context's error")
+	}
+
+	data, err := ioutil.ReadFile(pid_file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pid, err := strconv.Atoi(strings.TrimSpace(string(data)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for deadline := time.Now().Add(5 * time.Second); !processGone(pid); {
+		if time.Now().After(deadline) {
+			syscall.Kill(pid, syscall.SIGKILL)
+			t.Fatalf("background process %d outlived the hook", pid)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
@@ -0,0 +1,225 @@
+// Copyright (C) 2014 JT Olds
+// See LICENSE for copying information
+
+package repo
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// RefRule protects the refs matching Pattern.
+type RefRule struct {
+	// Pattern matches full ref names, like refs/heads/master, using
+	// path.Match.
+	Pattern string
+	// NoDelete rejects deleting matching refs.
+	NoDelete bool
+	// NoForce rejects non-fast-forward updates of matching refs.
+	NoForce bool
+	// RequireSigned rejects updates that add commits to matching refs unless
+	// every added commit has a good signature, as git verify-commit sees it
+	// on the server. New refs only need commits new to the repo signed.
+	RequireSigned bool
+	// ReadOnly rejects all updates of matching refs, e.g. because only some
+	// writers may update them and the pusher isn't one of them.
+	ReadOnly bool
+}
+
+// RefProtection decides which refs a connected key may update, and how.
+type RefProtection interface {
+	// RefRules returns the rules for key pushing to repo. repo is as for
+	// ACL.Permission. Every rule matching a ref applies.
+	RefRules(ctx context.Context, meta ssh.ConnMetadata, key ssh.PublicKey,
+		repo string) ([]RefRule, error)
+}
+
+// refGuard checks pushed ref updates against RefRules. git-receive-pack
+// asks it about each ref through an update hook shim, so that rejected refs
+// get a proper ng in the report-status response instead of failing the
+// whole push.
+type refGuard struct {
+	ctx       context.Context
+	repo_path string
+	rules     []RefRule
+
+	mtx     sync.Mutex
+	reasons map[string]string
+}
+
+// updateShim is the update hook git-receive-pack runs while a refGuard is
+// active. It asks the refGuard about the ref on fd 3, reads the verdict from
+// fd 4, and if the update is allowed, runs the repo's own update hook.
+const updateShim = `#!/bin/sh
+printf '%s %s %s\n' "$1" "$2" "$3" >&3
+read -r verdict <&4
+case "$verdict" in
+ok) ;;
+"") echo "error: no verdict for $1" >&2; exit 1 ;;
+*) echo "error: $1: ${verdict#ng }" >&2; exit 1 ;;
+esac
+hook="${GIT_DIR:-.}/hooks/update"
+if [ -x "$hook" ]; then exec "$hook" "$@" 3>&- 4>&-; fi
+`
+
+// passThroughShim runs the repo's own hook, since core.hooksPath points
+// git-receive-pack away from it.
+const passThroughShim = `#!/bin/sh
+hook="${GIT_DIR:-.}/hooks/$(basename "$0")"
+if [ -x "$hook" ]; then exec "$hook" "$@" 3>&- 4>&-; fi
+`
+
+// receiveHooks are the hooks git-receive-pack (or commands it runs) may run,
+// besides update.
+var receiveHooks = []string{"pre-receive", "post-receive", "post-update",
+	"reference-transaction", "push-to-checkout", "proc-receive",
+	"pre-auto-gc"}
+
+func newRefGuard(ctx context.Context, repo_path string,
+	rules []RefRule) *refGuard {
+	return &refGuard{
+		ctx:       ctx,
+		repo_path: repo_path,
+		rules:     rules,
+		reasons:   map[string]string{}}
+}
+
+// writeHooks writes the hook shims into a new temporary directory, for use
+// as core.hooksPath.
+func writeHooks() (dir string, err error) {
+	dir, err = ioutil.TempDir("", "gitserve-hooks-")
+	if err != nil {
+		return "", err
+	}
+	err = ioutil.WriteFile(filepath.Join(dir, "update"), []byte(updateShim),
+		0755)
+	for _, name := range receiveHooks {
+		if err != nil {
+			break
+		}
+		err = ioutil.WriteFile(filepath.Join(dir, name),
+			[]byte(passThroughShim), 0755)
+	}
+	if err != nil {
+		os.RemoveAll(dir)
+		return "", err
+	}
+	return dir, nil
+}
+
+// serve answers update hook requests until requests is closed.
+func (g *refGuard) serve(requests io.Reader, verdicts io.Writer) {
+	scanner := bufio.NewScanner(requests)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		reason := "bad update hook request"
+		if len(fields) == 3 {
+			reason = g.check(RefUpdate{
+				Ref: Ref(fields[0]), Old: fields[1], New: fields[2]})
+		}
+		verdict := "ok"
+		if reason != "" {
+			verdict = "ng " + reason
+			g.mtx.Lock()
+			if len(fields) > 0 {
+				g.reasons[fields[0]] = reason
+			}
+			g.mtx.Unlock()
+		}
+		_, err := fmt.Fprintln(verdicts, verdict)
+		if err != nil {
+			logger.Errore(err)
+			return
+		}
+	}
+}
+
+// check returns why update isn't allowed, or "" if it is.
+func (g *refGuard) check(update RefUpdate) (reason string) {
+	var no_force, require_signed bool
+	for _, rule := range g.rules {
+		if matched, _ := path.Match(rule.Pattern, string(update.Ref)); !matched {
+			continue
+		}
+		switch {
+		case rule.ReadOnly:
+			return "no write access to protected ref"
+		case rule.NoDelete && update.IsDelete():
+			return "deletion of protected ref"
+		}
+		no_force = no_force || rule.NoForce
+		require_signed = require_signed || rule.RequireSigned
+	}
+	if update.IsDelete() {
+		return ""
+	}
+
+	if no_force && !update.IsCreate() {
+		err := g.git("merge-base", "--is-ancestor", update.Old,
+			update.New).Run()
+		if _, ok := err.(*exec.ExitError); ok {
+			return "non-fast-forward of protected ref"
+		}
+		if err != nil {
+			logger.Errorf("checking %s: %v", update.Ref, err)
+			return "internal error"
+		}
+	}
+
+	if require_signed {
+		// only check the commits the update adds to the ref
+		exclude := []string{"--not", "--all"}
+		if !update.IsCreate() {
+			exclude = []string{"^" + update.Old}
+		}
+		out, err := g.git(append([]string{"log", "--format=%H %G?",
+			update.New}, exclude...)...).Output()
+		if err != nil {
+			logger.Errorf("checking %s: %v", update.Ref, err)
+			return "internal error"
+		}
+		for _, line := range strings.Split(string(out), "\n") {
+			fields := strings.Fields(line)
+			if len(fields) == 2 && fields[1] != "G" {
+				return fmt.Sprintf("commit %s is not signed", fields[0])
+			}
+		}
+	}
+	return ""
+}
+
+func (g *refGuard) git(args ...string) *exec.Cmd {
+	cmd := exec.CommandContext(g.ctx, "git", args...)
+	cmd.Dir = g.repo_path
+	return cmd
+}
+
+// rewriteReport replaces the generic reason git-receive-pack gives for a
+// declined update with the refGuard's.
+func (g *refGuard) rewriteReport(lines []string) []string {
+	g.mtx.Lock()
+	defer g.mtx.Unlock()
+	rv := make([]string, 0, len(lines))
+	for _, line := range lines {
+		fields := strings.SplitN(strings.TrimSuffix(line, "\n"), " ", 3)
+		if len(fields) == 3 && fields[0] == "ng" &&
+			fields[2] == "hook declined" {
+			if reason, ok := g.reasons[fields[1]]; ok {
+				line = fmt.Sprintf("ng %s %s\n", fields[1], reason)
+			}
+		}
+		rv = append(rv, line)
+	}
+	return rv
+}
@@ -0,0 +1,133 @@
+// Copyright (C) 2014 JT Olds
+// See LICENSE for copying information
+
+package repo
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"os/exec"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// testRepo makes a bare repo with commits a, b (a child of a) and c
+// (another child of a), and refs/heads/master at b.
+func testRepo(t *testing.T) (repo_path string, a, b, c string) {
+	repo_path = t.TempDir()
+	git := func(args ...string) string {
+		cmd := exec.Command("git", args...)
+		cmd.Dir = repo_path
+		cmd.Env = append(os.Environ(),
+			"GIT_AUTHOR_NAME=test", "GIT_AUTHOR_EMAIL=test@example.com",
+			"GIT_COMMITTER_NAME=test", "GIT_COMMITTER_EMAIL=test@example.com")
+		cmd.Stdin = strings.NewReader("")
+		out, err := cmd.Output()
+		if err != nil {
+			t.Fatalf("git %v: %v", args, err)
+		}
+		return strings.TrimSpace(string(out))
+	}
+	git("init", "-q", "--bare")
+	tree := git("mktree")
+	a = git("commit-tree", tree, "-m", "a")
+	b = git("commit-tree", tree, "-p", a, "-m", "b")
+	c = git("commit-tree", tree, "-p", a, "-m", "c")
+	git("update-ref", "refs/heads/master", b)
+	return repo_path, a, b, c
+}
+
+func TestRefGuardCheck(t *testing.T) {
+	repo_path, a, b, c := testRepo(t)
+
+	master_rules := []RefRule{{Pattern: "refs/heads/*", NoForce: true},
+		{Pattern: "refs/heads/master", NoDelete: true}}
+	for _, test := range []struct {
+		name   string
+		rules  []RefRule
+		update RefUpdate
+		reason string
+	}{
+		{"no rules", nil,
+			RefUpdate{Ref: "refs/heads/master", Old: b, New: c}, ""},
+		{"other ref", master_rules,
+			RefUpdate{Ref: "refs/tags/v1", Old: b, New: zeroId}, ""},
+		{"read only", []RefRule{{Pattern: "refs/heads/*", ReadOnly: true}},
+			RefUpdate{Ref: "refs/heads/dev", Old: zeroId, New: a},
+			"no write access to protected ref"},
+		{"delete", master_rules,
+			RefUpdate{Ref: "refs/heads/master", Old: b, New: zeroId},
+			"deletion of protected ref"},
+		{"delete without no-delete", master_rules,
+			RefUpdate{Ref: "refs/heads/dev", Old: b, New: zeroId}, ""},
+		{"fast-forward", master_rules,
+			RefUpdate{Ref: "refs/heads/master", Old: a, New: b}, ""},
+		{"non-fast-forward", master_rules,
+			RefUpdate{Ref: "refs/heads/master", Old: b, New: c},
+			"non-fast-forward of protected ref"},
+		{"rewind", master_rules,
+			RefUpdate{Ref: "refs/heads/master", Old: b, New: a},
+			"non-fast-forward of protected ref"},
+		{"create", master_rules,
+			RefUpdate{Ref: "refs/heads/dev", Old: zeroId, New: c}, ""},
+		{"pattern doesn't cross /", master_rules,
+			RefUpdate{Ref: "refs/heads/team/dev", Old: b, New: c}, ""},
+		{"unsigned new commit", []RefRule{
+			{Pattern: "refs/heads/*", RequireSigned: true}},
+			RefUpdate{Ref: "refs/heads/master", Old: b, New: c},
+			"commit " + c + " is not signed"},
+		{"no new commits", []RefRule{
+			{Pattern: "refs/heads/*", RequireSigned: true}},
+			RefUpdate{Ref: "refs/heads/master", Old: b, New: a}, ""},
+		{"create with known commits", []RefRule{
+			{Pattern: "refs/heads/*", RequireSigned: true}},
+			RefUpdate{Ref: "refs/heads/dev", Old: zeroId, New: b}, ""},
+		{"create with a new commit", []RefRule{
+			{Pattern: "refs/heads/*", RequireSigned: true}},
+			RefUpdate{Ref: "refs/heads/dev", Old: zeroId, New: c},
+			"commit " + c + " is not signed"},
+	} {
+		guard := newRefGuard(context.Background(), repo_path, test.rules)
+		reason := guard.check(test.update)
+		if reason != test.reason {
+			t.Errorf("%s: got %#v, expected %#v", test.name, reason, test.reason)
+		}
+	}
+}
+
+func TestRefGuardServe(t *testing.T) {
+	repo_path, a, b, c := testRepo(t)
+	guard := newRefGuard(context.Background(), repo_path, []RefRule{
+		{Pattern: "refs/heads/master", NoForce: true}})
+
+	requests := strings.Join([]string{
+		"refs/heads/master " + a + " " + b,
+		"refs/heads/master " + b + " " + c,
+		"garbage",
+		""}, "\n")
+	var verdicts bytes.Buffer
+	guard.serve(strings.NewReader(requests), &verdicts)
+	expected := "ok\nng non-fast-forward of protected ref\n" +
+		"ng bad update hook request\n"
+	if verdicts.String() != expected {
+		t.Fatalf("got %#v, expected %#v", verdicts.String(), expected)
+	}
+
+	report := guard.rewriteReport([]string{
+		"unpack ok\n",
+		"ng refs/heads/master hook declined\n",
+		"ng refs/heads/dev hook declined\n",
+		"ng refs/heads/master failed to lock\n",
+		"ok refs/heads/other\n"})
+	expected_report := []string{
+		"unpack ok\n",
+		"ng refs/heads/master non-fast-forward of protected ref\n",
+		"ng refs/heads/dev hook declined\n",
+		"ng refs/heads/master failed to lock\n",
+		"ok refs/heads/other\n"}
+	if !reflect.DeepEqual(report, expected_report) {
+		t.Fatalf("got %#v, expected %#v", report, expected_report)
+	}
+}
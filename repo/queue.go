@@ -0,0 +1,369 @@
+// Copyright (C) 2014 JT Olds
+// See LICENSE for copying information
+
+package repo
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// queuePositionInterval is how often a waiting pusher is told where they
+// are in line, if it changed.
+const queuePositionInterval = 5 * time.Second
+
+// queuedSubmission is a submission waiting for or being processed by a
+// worker.
+type queuedSubmission struct {
+	sub    *Submission
+	meta   ssh.ConnMetadata
+	key    ssh.PublicKey
+	user   User
+	output *detachableWriter
+
+	done        chan struct{}
+	exit_status uint32
+	err         error
+}
+
+// detachableWriter forwards writes to a waiting pusher until they go away,
+// after which writes are quietly dropped. Writes always succeed, so a
+// SubmissionHandler never notices the pusher leaving.
+type detachableWriter struct {
+	mtx sync.Mutex
+	w   io.Writer
+}
+
+func (d *detachableWriter) Write(p []byte) (n int, err error) {
+	d.mtx.Lock()
+	defer d.mtx.Unlock()
+	if d.w != nil {
+		_, err = d.w.Write(p)
+		if err != nil {
+			d.w = nil
+		}
+	}
+	return len(p), nil
+}
+
+func (d *detachableWriter) Detach() {
+	d.mtx.Lock()
+	d.w = nil
+	d.mtx.Unlock()
+}
+
+// stringAddr is a net.Addr for a remote address we only have the string of.
+type stringAddr string
+
+func (a stringAddr) Network() string { return "tcp" }
+func (a stringAddr) String() string  { return string(a) }
+
+// storedConnMetadata stands in for the ssh.ConnMetadata of a submission that
+// was recovered from the Store after a restart.
+type storedConnMetadata struct {
+	user   string
+	remote stringAddr
+}
+
+func (m storedConnMetadata) User() string          { return m.user }
+func (m storedConnMetadata) SessionID() []byte     { return nil }
+func (m storedConnMetadata) ClientVersion() []byte { return nil }
+func (m storedConnMetadata) ServerVersion() []byte { return nil }
+func (m storedConnMetadata) RemoteAddr() net.Addr  { return m.remote }
+func (m storedConnMetadata) LocalAddr() net.Addr   { return stringAddr("") }
+
+type submissionQueue struct {
+	mtx      sync.Mutex
+	cv       *sync.Cond
+	pending  []*queuedSubmission
+	stopping bool
+
+	// ctx is what SubmissionHandlers run with. it's only canceled when
+	// workers are forcibly stopped.
+	ctx     context.Context
+	cancel  func()
+	workers sync.WaitGroup
+}
+
+func newSubmissionQueue() *submissionQueue {
+	q := &submissionQueue{}
+	q.cv = sync.NewCond(&q.mtx)
+	q.ctx, q.cancel = context.WithCancel(context.Background())
+	return q
+}
+
+// push adds job to the end of the queue. It returns false if the queue is
+// stopping.
+func (q *submissionQueue) push(job *queuedSubmission) bool {
+	q.mtx.Lock()
+	defer q.mtx.Unlock()
+	if q.stopping {
+		return false
+	}
+	q.pending = append(q.pending, job)
+	q.cv.Signal()
+	return true
+}
+
+// pop blocks until there's a job, returning nil once the queue is stopping.
+func (q *submissionQueue) pop() *queuedSubmission {
+	q.mtx.Lock()
+	defer q.mtx.Unlock()
+	for len(q.pending) == 0 && !q.stopping {
+		q.cv.Wait()
+	}
+	if q.stopping {
+		return nil
+	}
+	job := q.pending[0]
+	q.pending = q.pending[1:]
+	return job
+}
+
+// position returns job's 1-based place in line, or 0 if it isn't waiting.
+func (q *submissionQueue) position(job *queuedSubmission) int {
+	q.mtx.Lock()
+	defer q.mtx.Unlock()
+	for i, pending := range q.pending {
+		if pending == job {
+			return i + 1
+		}
+	}
+	return 0
+}
+
+// stop tells workers to quit once their current job is done. Jobs still
+// waiting stay queued in the Store for the next start, and their pushers are
+// told so.
+func (q *submissionQueue) stop() {
+	q.mtx.Lock()
+	pending := q.pending
+	q.stopping = true
+	q.pending = nil
+	q.cv.Broadcast()
+	q.mtx.Unlock()
+	for _, job := range pending {
+		fmt.Fprintf(job.output, "Submission %s will be processed once the "+
+			"server restarts.\n", job.sub.Id)
+		close(job.done)
+	}
+}
+
+// shutdown stops the queue and waits for running jobs, canceling them if
+// ctx expires first.
+func (q *submissionQueue) shutdown(ctx context.Context) error {
+	q.stop()
+	done := make(chan struct{})
+	go func() {
+		q.workers.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		q.cancel()
+		return ctx.Err()
+	}
+}
+
+func (rs *RepoSubmissions) getQueue() *submissionQueue {
+	rs.mtx.Lock()
+	defer rs.mtx.Unlock()
+	return rs.queue
+}
+
+// startQueue starts the worker pool for queued mode, picking back up any
+// submissions a previous process didn't finish.
+func (rs *RepoSubmissions) startQueue() (err error) {
+	defer mon.Task()(nil)(&err)
+	if rs.Store == nil {
+		return fmt.Errorf("queued submissions require a Store")
+	}
+	if rs.Clean {
+		return fmt.Errorf("queued submissions can't be used with Clean")
+	}
+
+	rs.mtx.Lock()
+	if rs.queue != nil {
+		rs.mtx.Unlock()
+		return nil
+	}
+	q := newSubmissionQueue()
+	rs.queue = q
+	rs.mtx.Unlock()
+
+	unfinished, err := rs.Store.Find(q.ctx, SubmissionQuery{})
+	if err != nil {
+		return err
+	}
+	for _, sub := range unfinished {
+		if sub.Status != SubmissionQueued && sub.Status != SubmissionRunning {
+			continue
+		}
+		job, err := recoverSubmission(sub)
+		if err != nil {
+			logger.Errorf("can't recover submission %s: %v", sub.Id, err)
+			sub.Status = SubmissionDone
+			sub.Finished = time.Now()
+			sub.ExitStatus = 1
+			sub.Error = fmt.Sprintf("lost during restart: %v", err)
+			rs.recordSubmission(q.ctx, sub)
+			continue
+		}
+		logger.Noticef("requeueing submission %s", sub.Id)
+		q.push(job)
+	}
+
+	for i := 0; i < rs.Workers; i++ {
+		q.workers.Add(1)
+		go rs.worker(q)
+	}
+	return nil
+}
+
+func recoverSubmission(sub *Submission) (*queuedSubmission, error) {
+	if sub.RepoPath == "" || sub.Key == "" {
+		return nil, fmt.Errorf("missing connection details")
+	}
+	key, _, _, _, err := ssh.ParseAuthorizedKey([]byte(sub.Key))
+	if err != nil {
+		return nil, err
+	}
+	sub.Status = SubmissionQueued
+	meta := storedConnMetadata{user: sub.SSHUser, remote: stringAddr(sub.Remote)}
+	return &queuedSubmission{
+		sub:  sub,
+		meta: meta,
+		key:  key,
+		user: User{
+			Id:          sub.UserId,
+			DisplayName: sub.DisplayName,
+			Groups:      sub.Groups},
+		output: &detachableWriter{},
+		done:   make(chan struct{})}, nil
+}
+
+func (rs *RepoSubmissions) worker(q *submissionQueue) {
+	defer q.workers.Done()
+	for {
+		job := q.pop()
+		if job == nil {
+			return
+		}
+		rs.processQueued(q, job)
+	}
+}
+
+func (rs *RepoSubmissions) processQueued(q *submissionQueue,
+	job *queuedSubmission) {
+	ctx := context.WithValue(q.ctx, userKey{}, &job.user)
+	defer close(job.done)
+
+	job.sub.Status = SubmissionRunning
+	rs.recordSubmission(ctx, job.sub)
+	fmt.Fprintf(job.output, "Processing submission %s...\n", job.sub.Id)
+
+	job.exit_status, job.err = rs.runSubmission(ctx, job.sub,
+		job.sub.RepoPath, job.output, job.meta, job.key)
+
+	if q.ctx.Err() != nil {
+		// we were forcibly stopped. try again after the restart.
+		job.sub.Status = SubmissionQueued
+		job.sub.Finished = time.Time{}
+		job.sub.ExitStatus = 0
+		job.sub.Error = ""
+		job.sub.Output = ""
+		rs.recordSubmission(context.Background(), job.sub)
+	}
+}
+
+func hasPushOption(options []string, name string) bool {
+	for _, option := range options {
+		if option == name {
+			return true
+		}
+	}
+	return false
+}
+
+// enqueue durably queues a pushed submission. Unless the pusher asked not to
+// wait (git push -o nowait), it then streams the submission's progress and
+// output until it's done or the pusher disconnects. Disconnecting doesn't
+// cancel the submission. If the submission can't be saved to the Store, it
+// can't be queued, since it would be lost on a restart, so it's processed
+// right away instead, as if not in queued mode.
+func (rs *RepoSubmissions) enqueue(ctx context.Context, sub *Submission,
+	output io.Writer, meta ssh.ConnMetadata, session *session,
+	push_options []string) (exit_status uint32, err error) {
+	defer mon.Task()(&ctx)(&err)
+	sub.Status = SubmissionQueued
+	sub.SSHUser = meta.User()
+	sub.Remote = meta.RemoteAddr().String()
+	sub.Key = strings.TrimSpace(string(ssh.MarshalAuthorizedKey(session.key)))
+	sub.DisplayName = session.user.DisplayName
+	sub.Groups = session.user.Groups
+	if rs.Store == nil {
+		err = fmt.Errorf("no Store")
+	} else {
+		err = rs.Store.Put(ctx, sub)
+	}
+	if err != nil {
+		mon.Meter("submissions_not_queued").Mark(1)
+		logger.Errorf("failed queueing submission %s, processing it now: %v",
+			sub.Id, err)
+		sub.Status = SubmissionRunning
+		return rs.runSubmission(ctx, sub, sub.RepoPath, output, meta,
+			session.key)
+	}
+
+	job := &queuedSubmission{
+		sub:    sub,
+		meta:   meta,
+		key:    session.key,
+		user:   session.user,
+		output: &detachableWriter{w: output},
+		done:   make(chan struct{})}
+
+	q := rs.getQueue()
+	if q == nil || !q.push(job) {
+		_, err = fmt.Fprintf(output, "Submission %s will be processed once the "+
+			"server restarts.\n", sub.Id)
+		return 0, err
+	}
+
+	if hasPushOption(push_options, "nowait") {
+		job.output.Detach()
+		_, err = fmt.Fprintf(output, "Submission %s queued. To check on it, run:\n"+
+			"  ssh <this host> submission %s\n", sub.Id, sub.Id)
+		return 0, err
+	}
+
+	ticker := time.NewTicker(queuePositionInterval)
+	defer ticker.Stop()
+	last_position := 0
+	for {
+		if position := q.position(job); position != last_position {
+			last_position = position
+			if position > 0 {
+				fmt.Fprintf(job.output, "Submission %s is number %d in line...\n",
+					sub.Id, position)
+			}
+		}
+		select {
+		case <-job.done:
+			return job.exit_status, job.err
+		case <-ctx.Done():
+			job.output.Detach()
+			return 1, ctx.Err()
+		case <-ticker.C:
+		}
+	}
+}
@@ -0,0 +1,84 @@
+// Copyright (C) 2014 JT Olds
+// See LICENSE for copying information
+
+package repo
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+var errRepoNotFound = fmt.Errorf("repo not found")
+
+// cleanRepoName turns the repo argument of a git command into a canonical
+// repo name, like team/project. ssh://host/team/project.git and
+// host:team/project both become team/project. Each path component must be
+// made of letters, digits, '-', '_' and '.', and may not start with '.' or
+// '-', which rules out "..", hidden directories and anything git could take
+// for an option.
+func cleanRepoName(arg string) (string, error) {
+	arg = strings.Trim(arg, "'")
+	name := strings.TrimSuffix(strings.Trim(arg, "/"), ".git")
+	if name == "" {
+		return "", fmt.Errorf("invalid repo: %#v", arg)
+	}
+	for _, component := range strings.Split(name, "/") {
+		if !validRepoComponent(component) {
+			return "", fmt.Errorf("invalid repo: %#v", arg)
+		}
+	}
+	return name, nil
+}
+
+func validRepoComponent(component string) bool {
+	if component == "" || component[0] == '.' || component[0] == '-' {
+		return false
+	}
+	for _, r := range component {
+		switch {
+		case 'a' <= r && r <= 'z', 'A' <= r && r <= 'Z', '0' <= r && r <= '9',
+			r == '-', r == '_', r == '.':
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+// findRepo returns the directory under base for the repo called name, as
+// returned by cleanRepoName. name.git is preferred over name. Symlinks are
+// resolved, and repos that resolve to somewhere outside of base are treated
+// as missing. If there's no such repo, findRepo returns errRepoNotFound.
+func findRepo(base, name string) (string, error) {
+	base, err := filepath.EvalSymlinks(base)
+	if err != nil {
+		return "", err
+	}
+	for _, candidate := range []string{name + ".git", name} {
+		path, err := filepath.EvalSymlinks(
+			filepath.Join(base, filepath.FromSlash(candidate)))
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return "", err
+		}
+		rel, err := filepath.Rel(base, path)
+		if err != nil || rel == "." || rel == ".." ||
+			strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+			logger.Warnf("repo %#v resolves to %#v, outside of %#v", name, path,
+				base)
+			return "", errRepoNotFound
+		}
+		info, err := os.Stat(path)
+		if err != nil {
+			return "", err
+		}
+		if info.IsDir() {
+			return path, nil
+		}
+	}
+	return "", errRepoNotFound
+}
@@ -0,0 +1,129 @@
+// Copyright (C) 2014 JT Olds
+// See LICENSE for copying information
+
+package repo
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestCleanRepoName(t *testing.T) {
+	for _, test := range []struct {
+		arg  string
+		name string
+	}{
+		{"proj", "proj"},
+		{"'proj'", "proj"},
+		{"/proj.git", "proj"},
+		{"'/team/proj.git/'", "team/proj"},
+		{"team/sub/proj", "team/sub/proj"},
+		{"proj.git.git", "proj.git"},
+		{"my_proj-2.0", "my_proj-2.0"},
+		{"", ""},
+		{"''", ""},
+		{"/", ""},
+		{".git", ""},
+		{"..", ""},
+		{"team/../../etc", ""},
+		{"team/./proj", ""},
+		{".hidden", ""},
+		{"team/.git", ""},
+		{"team//proj", ""},
+		{"-proj", ""},
+		{"--upload-pack=touch", ""},
+		{"~user/proj", ""},
+		{"proj name", ""},
+		{"proj;rm", ""},
+		{"team\\proj", ""},
+		{"café", ""},
+		{"proj\x00", ""},
+	} {
+		name, err := cleanRepoName(test.arg)
+		if test.name == "" {
+			if err == nil {
+				t.Errorf("%#v: expected error, got %#v", test.arg, name)
+			}
+			continue
+		}
+		if err != nil || name != test.name {
+			t.Errorf("%#v: got %#v, %v, expected %#v", test.arg, name, err,
+				test.name)
+		}
+	}
+}
+
+func TestFindRepo(t *testing.T) {
+	dir := t.TempDir()
+	base := filepath.Join(dir, "base")
+	outside := filepath.Join(dir, "outside")
+	for _, path := range []string{
+		"base/proj.git", "base/both", "base/both.git", "base/team/nested.git",
+		"base/plain", "outside/secret.git"} {
+		err := os.MkdirAll(filepath.Join(dir, path), 0755)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	err := ioutil.WriteFile(filepath.Join(base, "file.git"), nil, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for link, target := range map[string]string{
+		"alias.git":   "proj.git",
+		"escape.git":  filepath.Join(outside, "secret.git"),
+		"relative":    "../outside/secret.git",
+		"up":          "..",
+		"self":        ".",
+		"dangling":    "nowhere",
+		"team/parent": "../..",
+	} {
+		err := os.Symlink(target, filepath.Join(base, link))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	// a base reached through a symlink works too
+	linked_base := filepath.Join(dir, "linked")
+	err = os.Symlink("base", linked_base)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, test := range []struct {
+		name string
+		path string
+	}{
+		{"proj", "base/proj.git"},
+		{"both", "base/both.git"},
+		{"team/nested", "base/team/nested.git"},
+		{"plain", "base/plain"},
+		{"alias", "base/proj.git"},
+		{"missing", ""},
+		{"file", ""},
+		{"escape", ""},
+		{"relative", ""},
+		{"up/outside/secret", ""},
+		{"self", ""},
+		{"dangling", ""},
+		{"team/parent/outside/secret", ""},
+	} {
+		for _, b := range []string{base, linked_base} {
+			path, err := findRepo(b, test.name)
+			if test.path == "" {
+				if err != errRepoNotFound {
+					t.Errorf("%#v: got %#v, %v, expected not found", test.name,
+						path, err)
+				}
+				continue
+			}
+			expected, _ := filepath.EvalSymlinks(filepath.Join(dir, test.path))
+			if err != nil || path != expected {
+				t.Errorf("%#v: got %#v, %v, expected %#v", test.name, path, err,
+					expected)
+			}
+		}
+	}
+}
@@ -0,0 +1,217 @@
+// Copyright (C) 2014 JT Olds
+// See LICENSE for copying information
+
+package repo
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+// DefaultSandboxPaths are the host paths a Sandbox exposes read-only if
+// Sandbox.Paths is unset, enough for most interpreters and toolchains.
+var DefaultSandboxPaths = []string{
+	"/bin", "/sbin", "/lib", "/lib32", "/lib64", "/usr", "/etc"}
+
+// Sandbox runs untrusted graders against submissions. Inside the sandbox,
+// the grader sees:
+//
+//	/work    a throwaway checkout of the submission, writable
+//	/repo    the submission repo, read-only
+//	/grader  the grader itself, read-only
+//	/tmp     an empty tmpfs
+//
+// along with /dev/null, /dev/zero, /dev/random, /dev/urandom, /proc where
+// possible, and Paths. It runs in its own user, mount, pid, network, ipc and
+// uts namespaces, with no capabilities, and with no network beyond
+// loopback. Sandboxes are only supported on Linux, and require unprivileged
+// user namespaces (or running as root).
+//
+// Programs that use Sandbox must call SandboxInit at the top of main.
+type Sandbox struct {
+	// Host paths to expose read-only at the same place in the sandbox.
+	// Defaults to DefaultSandboxPaths. Paths that don't exist are skipped.
+	Paths []string
+
+	// If we're running as root, the sandbox runs as this host user and
+	// group instead. Both default to 65534 (nobody).
+	UID, GID int
+
+	// If set, each sandbox gets a new cgroup under this cgroup v2 directory,
+	// which must be delegated to us, and these limits are set when the
+	// cgroup supports them. Zero values mean no limit.
+	CgroupParent string
+	Memory       uint64
+	PIDs         int64
+	CPUs         float64
+
+	// Where throwaway worktrees go. Defaults to os.TempDir().
+	TempDir string
+}
+
+// SandboxedCommand is a command prepared by Sandbox.Command. Its Cmd may be
+// run like any other, e.g. with RunLimited, but the command must not have
+// been started more than once, and Cleanup must be called when it's done.
+type SandboxedCommand struct {
+	*exec.Cmd
+
+	dir    string
+	cgroup *os.File
+}
+
+// sandboxConfig tells SandboxInit how to set up the sandbox.
+type sandboxConfig struct {
+	Root   string   `json:"root"`
+	Work   string   `json:"work"`
+	Repo   string   `json:"repo"`
+	Grader string   `json:"grader"`
+	Paths  []string `json:"paths"`
+}
+
+const sandboxInitArg = "gitserve-sandbox-init"
+
+// SandboxInit must be called at the start of main, before flags are parsed,
+// by programs that use Sandbox. Sandboxed commands start out as a copy of
+// the program, which SandboxInit sets up the sandbox in and then replaces
+// with the grader. In any other case, SandboxInit returns immediately.
+func SandboxInit() {
+	if len(os.Args) < 3 || os.Args[1] != sandboxInitArg {
+		return
+	}
+	err := sandboxInit(os.Args[2], os.Args[3:])
+	fmt.Fprintf(os.Stderr, "sandbox: %v\n", err)
+	os.Exit(127)
+}
+
+func (s *Sandbox) paths() []string {
+	if s.Paths != nil {
+		return s.Paths
+	}
+	return DefaultSandboxPaths
+}
+
+// Command checks out rev from the bare repo at repo_path into a throwaway
+// worktree and prepares grader to run with args in a new sandbox. If rev is
+// empty, the worktree is left empty. The command starts in /work with a
+// minimal environment; callers may add to Env, and set Stdin, Stdout,
+// Stderr and ExtraFiles.
+func (s *Sandbox) Command(ctx context.Context, repo_path, rev, grader string,
+	args ...string) (cmd *SandboxedCommand, err error) {
+	defer mon.Task()(&ctx)(&err)
+	grader, err = exec.LookPath(grader)
+	if err != nil {
+		return nil, err
+	}
+	grader, err = filepath.Abs(grader)
+	if err != nil {
+		return nil, err
+	}
+	repo_path, err = filepath.Abs(repo_path)
+	if err != nil {
+		return nil, err
+	}
+
+	dir, err := ioutil.TempDir(s.TempDir, "gitserve-sandbox-")
+	if err != nil {
+		return nil, err
+	}
+	sandboxed := &SandboxedCommand{dir: dir}
+	defer func() {
+		if err != nil {
+			sandboxed.Cleanup()
+		}
+	}()
+
+	config := sandboxConfig{
+		Root:   filepath.Join(dir, "root"),
+		Work:   filepath.Join(dir, "work"),
+		Repo:   repo_path,
+		Grader: grader,
+		Paths:  s.paths()}
+	for _, path := range []string{config.Root, config.Work} {
+		err = os.Mkdir(path, 0755)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if rev != "" {
+		err = checkoutWorktree(ctx, repo_path, rev, config.Work,
+			filepath.Join(dir, "index"))
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	err = s.prepare(sandboxed, config, args)
+	if err != nil {
+		return nil, err
+	}
+	sandboxed.Dir = "/"
+	sandboxed.Env = []string{
+		"PATH=/usr/local/bin:/usr/bin:/bin",
+		"HOME=/work",
+		"TMPDIR=/tmp",
+		"LANG=C.UTF-8"}
+	return sandboxed, nil
+}
+
+// checkoutWorktree writes the tree at rev into work. Unlike git checkout or
+// git worktree, it leaves the repo itself alone.
+func checkoutWorktree(ctx context.Context, repo_path, rev, work,
+	index string) error {
+	for _, args := range [][]string{
+		{"read-tree", rev},
+		{"checkout-index", "--all"}} {
+		cmd := exec.CommandContext(ctx, "git", append([]string{
+			"--git-dir", repo_path, "--work-tree", work}, args...)...)
+		cmd.Dir = work
+		cmd.Env = append(os.Environ(), "GIT_INDEX_FILE="+index)
+		out, err := cmd.CombinedOutput()
+		if err != nil {
+			return fmt.Errorf("git %s %s: %v: %s", args[0], rev, err,
+				strings.TrimSpace(string(out)))
+		}
+	}
+	return os.Remove(index)
+}
+
+// Cleanup removes the sandbox's worktree and cgroup.
+func (c *SandboxedCommand) Cleanup() error {
+	var errs []string
+	if err := c.cleanupCgroup(); err != nil {
+		errs = append(errs, err.Error())
+	}
+	if err := os.RemoveAll(c.dir); err != nil {
+		errs = append(errs, err.Error())
+	}
+	if len(errs) > 0 {
+		return fmt.Errorf("sandbox cleanup: %s", strings.Join(errs, "; "))
+	}
+	return nil
+}
+
+// MemoryExceeded returns true if anything in the sandbox was killed for
+// going over Sandbox.Memory. It's always false without a cgroup.
+func (c *SandboxedCommand) MemoryExceeded() bool {
+	if c.cgroup == nil {
+		return false
+	}
+	events, err := ioutil.ReadFile(filepath.Join(c.cgroup.Name(),
+		"memory.events"))
+	if err != nil {
+		return false
+	}
+	for _, line := range bytes.Split(events, []byte("\n")) {
+		fields := bytes.Fields(line)
+		if len(fields) == 2 && string(fields[0]) == "oom_kill" {
+			return string(fields[1]) != "0"
+		}
+	}
+	return false
+}
@@ -0,0 +1,479 @@
+// Copyright (C) 2014 JT Olds
+// See LICENSE for copying information
+
+package repo
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+	"unsafe"
+)
+
+const (
+	sandboxNobody = 65534
+
+	// missing from package syscall
+	prSetNoNewPrivs         = 38
+	prCapAmbient            = 47
+	prCapAmbientClearAll    = 4
+	linuxCapabilityVersion3 = 0x20080522
+	stRelatime              = 0x1000
+	msRelatime              = 1 << 21
+)
+
+// sandboxDevices are bound into the sandbox's /dev.
+var sandboxDevices = []string{"null", "zero", "random", "urandom"}
+
+// sandboxExecutable returns the program sandboxes start out as, which calls
+// SandboxInit. Tests replace it with a copy of the test binary the sandbox
+// user can get to.
+var sandboxExecutable = os.Executable
+
+// prepare sets cmd up to run SandboxInit in fresh namespaces.
+func (s *Sandbox) prepare(cmd *SandboxedCommand, config sandboxConfig,
+	args []string) error {
+	exe, err := sandboxExecutable()
+	if err != nil {
+		return err
+	}
+	config_json, err := json.Marshal(config)
+	if err != nil {
+		return err
+	}
+
+	uid, gid := os.Getuid(), os.Getgid()
+	if uid == 0 {
+		uid, gid = s.UID, s.GID
+		if uid == 0 {
+			uid = sandboxNobody
+		}
+		if gid == 0 {
+			gid = sandboxNobody
+		}
+		// the sandbox has to be able to get to and write its worktree
+		err = os.Chmod(cmd.dir, 0755)
+		if err != nil {
+			return err
+		}
+		err = filepath.Walk(config.Work,
+			func(path string, info os.FileInfo, err error) error {
+				if err != nil {
+					return err
+				}
+				return os.Lchown(path, uid, gid)
+			})
+		if err != nil {
+			return err
+		}
+	}
+
+	cmd.Cmd = exec.Command(exe,
+		append([]string{sandboxInitArg, string(config_json)}, args...)...)
+	cmd.SysProcAttr = &syscall.SysProcAttr{
+		Cloneflags: syscall.CLONE_NEWUSER | syscall.CLONE_NEWNS |
+			syscall.CLONE_NEWPID | syscall.CLONE_NEWNET | syscall.CLONE_NEWIPC |
+			syscall.CLONE_NEWUTS,
+		UidMappings: []syscall.SysProcIDMap{
+			{ContainerID: 0, HostID: uid, Size: 1}},
+		GidMappings: []syscall.SysProcIDMap{
+			{ContainerID: 0, HostID: gid, Size: 1}},
+		// become the namespace's root, whatever our host user is
+		Credential: &syscall.Credential{Uid: 0, Gid: 0, NoSetGroups: true},
+		Pdeathsig:  syscall.SIGKILL}
+
+	if s.CgroupParent != "" {
+		err = s.makeCgroup(cmd)
+		if err != nil {
+			return err
+		}
+		cmd.SysProcAttr.UseCgroupFD = true
+		cmd.SysProcAttr.CgroupFD = int(cmd.cgroup.Fd())
+	}
+	return nil
+}
+
+// makeCgroup creates the sandbox's cgroup and sets whatever limits the
+// cgroup's enabled controllers allow.
+func (s *Sandbox) makeCgroup(cmd *SandboxedCommand) error {
+	path := filepath.Join(s.CgroupParent, filepath.Base(cmd.dir))
+	err := os.Mkdir(path, 0755)
+	if err != nil {
+		return err
+	}
+	cmd.cgroup, err = os.Open(path)
+	if err != nil {
+		os.Remove(path)
+		return err
+	}
+
+	limits := map[string]string{}
+	if s.Memory > 0 {
+		limits["memory.max"] = strconv.FormatUint(s.Memory, 10)
+		limits["memory.swap.max"] = "0"
+	}
+	if s.PIDs > 0 {
+		limits["pids.max"] = strconv.FormatInt(s.PIDs, 10)
+	}
+	if s.CPUs > 0 {
+		const period = 100000
+		limits["cpu.max"] = fmt.Sprintf("%d %d", int64(s.CPUs*period), period)
+	}
+	for name, value := range limits {
+		err = writeCgroupFile(filepath.Join(path, name), value)
+		if os.IsNotExist(err) {
+			logger.Warnf("cgroup %s doesn't support %s, not limiting it",
+				s.CgroupParent, name)
+			continue
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// writeCgroupFile writes an existing cgroup control file. Trying to create
+// one fails with a confusing permission error.
+func writeCgroupFile(path, value string) error {
+	fh, err := os.OpenFile(path, os.O_WRONLY, 0)
+	if err != nil {
+		return err
+	}
+	_, err = fh.WriteString(value)
+	if close_err := fh.Close(); err == nil {
+		err = close_err
+	}
+	return err
+}
+
+func (c *SandboxedCommand) cleanupCgroup() (err error) {
+	if c.cgroup == nil {
+		return nil
+	}
+	c.cgroup.Close()
+	// the sandbox's processes all die with its init process, but the kernel
+	// may take a moment to notice.
+	for i := 0; i < 20; i++ {
+		err = os.Remove(c.cgroup.Name())
+		if err == nil || os.IsNotExist(err) {
+			return nil
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	return err
+}
+
+// sandboxInit runs as root in the sandbox's new namespaces. It builds the
+// sandbox's filesystem on a tmpfs, pivots into it, drops every capability
+// and execs the grader.
+func sandboxInit(config_json string, args []string) error {
+	var config sandboxConfig
+	err := json.Unmarshal([]byte(config_json), &config)
+	if err != nil {
+		return err
+	}
+
+	// keep our mounts from propagating back out
+	err = syscall.Mount("", "/", "", syscall.MS_REC|syscall.MS_PRIVATE, "")
+	if err != nil {
+		return fmt.Errorf("making mounts private: %v", err)
+	}
+	root := config.Root
+	err = syscall.Mount("tmpfs", root, "tmpfs",
+		syscall.MS_NOSUID|syscall.MS_NODEV, "mode=0755")
+	if err != nil {
+		return fmt.Errorf("mounting root: %v", err)
+	}
+
+	for _, path := range config.Paths {
+		err = exposePath(root, path)
+		if err != nil {
+			return err
+		}
+	}
+	binds := []struct {
+		source, target string
+		read_only      bool
+	}{
+		{config.Work, "/work", false},
+		{config.Repo, "/repo", true},
+		{config.Grader, "/grader", true}}
+	for _, device := range sandboxDevices {
+		binds = append(binds, struct {
+			source, target string
+			read_only      bool
+		}{"/dev/" + device, "/dev/" + device, false})
+	}
+	for _, bind := range binds {
+		err = bindMount(bind.source, filepath.Join(root, bind.target),
+			bind.read_only)
+		if err != nil {
+			return err
+		}
+	}
+
+	err = os.MkdirAll(filepath.Join(root, "tmp"), 0755)
+	if err == nil {
+		err = syscall.Mount("tmpfs", filepath.Join(root, "tmp"), "tmpfs",
+			syscall.MS_NOSUID|syscall.MS_NODEV, "mode=1777")
+	}
+	if err != nil {
+		return fmt.Errorf("mounting /tmp: %v", err)
+	}
+	err = os.MkdirAll(filepath.Join(root, "proc"), 0755)
+	if err != nil {
+		return err
+	}
+	// this fails if the host's /proc is partially hidden, as in many
+	// containers. graders mostly do fine without it.
+	syscall.Mount("proc", filepath.Join(root, "proc"), "proc",
+		syscall.MS_NOSUID|syscall.MS_NODEV|syscall.MS_NOEXEC, "")
+
+	err = pivotRoot(root)
+	if err != nil {
+		return err
+	}
+	err = syscall.Mount("", "/", "", syscall.MS_REMOUNT|syscall.MS_RDONLY|
+		syscall.MS_NOSUID|syscall.MS_NODEV, "")
+	if err != nil {
+		return fmt.Errorf("making root read-only: %v", err)
+	}
+
+	syscall.Sethostname([]byte("sandbox"))
+	err = loopbackUp()
+	if err != nil {
+		return fmt.Errorf("bringing up loopback: %v", err)
+	}
+	err = os.Chdir("/work")
+	if err != nil {
+		return err
+	}
+	err = dropCapabilities()
+	if err != nil {
+		return err
+	}
+	return syscall.Exec("/grader", append([]string{"/grader"}, args...),
+		os.Environ())
+}
+
+// exposePath makes the host's path available read-only at the same place
+// under root. Symlinks are recreated rather than followed, so that e.g.
+// /lib -> usr/lib still works.
+func exposePath(root, path string) error {
+	info, err := os.Lstat(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	target := filepath.Join(root, path)
+	if info.Mode()&os.ModeSymlink != 0 {
+		link, err := os.Readlink(path)
+		if err != nil {
+			return err
+		}
+		err = os.MkdirAll(filepath.Dir(target), 0755)
+		if err != nil {
+			return err
+		}
+		return os.Symlink(link, target)
+	}
+	return bindMount(path, target, true)
+}
+
+// bindMount binds source at target, creating target as needed. If
+// read_only is true, every mount under target is made read-only.
+func bindMount(source, target string, read_only bool) error {
+	info, err := os.Stat(source)
+	if err != nil {
+		return err
+	}
+	if info.IsDir() {
+		err = os.MkdirAll(target, 0755)
+	} else {
+		err = os.MkdirAll(filepath.Dir(target), 0755)
+		if err == nil {
+			err = ioutil.WriteFile(target, nil, 0644)
+		}
+	}
+	if err != nil {
+		return err
+	}
+	err = syscall.Mount(source, target, "", syscall.MS_BIND|syscall.MS_REC,
+		"")
+	if err != nil {
+		return fmt.Errorf("binding %s: %v", source, err)
+	}
+	if !read_only {
+		return nil
+	}
+	mounts, err := mountsUnder(target)
+	if err != nil {
+		return err
+	}
+	for _, mount := range mounts {
+		err = remountReadOnly(mount)
+		if err != nil {
+			return fmt.Errorf("making %s read-only: %v", mount, err)
+		}
+	}
+	return nil
+}
+
+// remountReadOnly makes the bind mount at path read-only. The kernel won't
+// let us clear flags the host set, so those are kept.
+func remountReadOnly(path string) error {
+	var stat syscall.Statfs_t
+	err := syscall.Statfs(path, &stat)
+	if err != nil {
+		return err
+	}
+	flags := uintptr(syscall.MS_BIND | syscall.MS_REMOUNT | syscall.MS_RDONLY)
+	keep := uintptr(syscall.MS_NOSUID | syscall.MS_NODEV | syscall.MS_NOEXEC |
+		syscall.MS_NOATIME | syscall.MS_NODIRATIME)
+	flags |= uintptr(stat.Flags) & keep
+	if stat.Flags&stRelatime != 0 {
+		flags |= msRelatime
+	}
+	return syscall.Mount("", path, "", flags, "")
+}
+
+// mountsUnder lists path and every mount point below it, parents first.
+func mountsUnder(path string) (mounts []string, err error) {
+	fh, err := os.Open("/proc/self/mountinfo")
+	if err != nil {
+		return nil, err
+	}
+	defer fh.Close()
+	scanner := bufio.NewScanner(fh)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 5 {
+			continue
+		}
+		mount := unescapeMountPath(fields[4])
+		if mount == path || strings.HasPrefix(mount, path+"/") {
+			mounts = append(mounts, mount)
+		}
+	}
+	return mounts, scanner.Err()
+}
+
+// unescapeMountPath undoes the octal escaping /proc/self/mountinfo uses for
+// spaces and such.
+func unescapeMountPath(path string) string {
+	var out []byte
+	for i := 0; i < len(path); i++ {
+		if path[i] == '\\' && i+3 < len(path) {
+			if c, err := strconv.ParseUint(path[i+1:i+4], 8, 8); err == nil {
+				out = append(out, byte(c))
+				i += 3
+				continue
+			}
+		}
+		out = append(out, path[i])
+	}
+	return string(out)
+}
+
+func pivotRoot(root string) error {
+	old := filepath.Join(root, ".old")
+	err := os.Mkdir(old, 0700)
+	if err != nil {
+		return err
+	}
+	err = syscall.PivotRoot(root, old)
+	if err != nil {
+		return fmt.Errorf("pivot_root: %v", err)
+	}
+	err = os.Chdir("/")
+	if err != nil {
+		return err
+	}
+	err = syscall.Unmount("/.old", syscall.MNT_DETACH)
+	if err != nil {
+		return fmt.Errorf("unmounting old root: %v", err)
+	}
+	return os.Remove("/.old")
+}
+
+// loopbackUp brings up lo, the only interface in the sandbox's network
+// namespace.
+func loopbackUp() error {
+	fd, err := syscall.Socket(syscall.AF_INET,
+		syscall.SOCK_DGRAM|syscall.SOCK_CLOEXEC, 0)
+	if err != nil {
+		return err
+	}
+	defer syscall.Close(fd)
+	var ifreq struct {
+		name  [syscall.IFNAMSIZ]byte
+		flags uint16
+		_     [22]byte
+	}
+	copy(ifreq.name[:], "lo")
+	for _, req := range []uintptr{syscall.SIOCGIFFLAGS, syscall.SIOCSIFFLAGS} {
+		if req == syscall.SIOCSIFFLAGS {
+			ifreq.flags |= syscall.IFF_UP
+		}
+		_, _, errno := syscall.Syscall(syscall.SYS_IOCTL, uintptr(fd), req,
+			uintptr(unsafe.Pointer(&ifreq)))
+		if errno != 0 {
+			return errno
+		}
+	}
+	return nil
+}
+
+// dropCapabilities makes sure the grader, though root in its namespaces,
+// can't undo the sandbox, e.g. by remounting /repo read-write. Exec gives
+// root the capabilities in its bounding and inheritable sets, plus any
+// ambient ones, so all of them are emptied, along with the ones we have now.
+func dropCapabilities() error {
+	_, _, errno := syscall.RawSyscall(syscall.SYS_PRCTL, prSetNoNewPrivs, 1, 0)
+	if errno != 0 {
+		return fmt.Errorf("setting no_new_privs: %v", errno)
+	}
+	for capability := 0; ; capability++ {
+		_, _, errno := syscall.RawSyscall(syscall.SYS_PRCTL,
+			syscall.PR_CAPBSET_DROP, uintptr(capability), 0)
+		if errno == syscall.EINVAL {
+			// past the last capability the kernel knows about
+			if capability == 0 {
+				return fmt.Errorf("dropping capabilities: %v", errno)
+			}
+			break
+		}
+		if errno != 0 {
+			return fmt.Errorf("dropping capability %d: %v", capability, errno)
+		}
+	}
+	_, _, errno = syscall.RawSyscall6(syscall.SYS_PRCTL, prCapAmbient,
+		prCapAmbientClearAll, 0, 0, 0, 0)
+	// kernels before 4.3 have no ambient set to clear
+	if errno != 0 && errno != syscall.EINVAL {
+		return fmt.Errorf("clearing ambient capabilities: %v", errno)
+	}
+	header := struct {
+		version uint32
+		pid     int32
+	}{version: linuxCapabilityVersion3}
+	// effective, permitted and inheritable, for capabilities 0-31 and 32-63
+	var data [2]struct{ effective, permitted, inheritable uint32 }
+	_, _, errno = syscall.RawSyscall(syscall.SYS_CAPSET,
+		uintptr(unsafe.Pointer(&header)), uintptr(unsafe.Pointer(&data[0])), 0)
+	if errno != 0 {
+		return fmt.Errorf("clearing capabilities: %v", errno)
+	}
+	return nil
+}
@@ -0,0 +1,227 @@
+// Copyright (C) 2014 JT Olds
+// See LICENSE for copying information
+
+package repo
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"syscall"
+	"testing"
+	"time"
+	"unsafe"
+)
+
+// sandboxTestEnv tells the test binary it's the grader in a sandbox.
+const sandboxTestEnv = "GITSERVE_SANDBOX_TEST=1"
+
+func TestMain(m *testing.M) {
+	SandboxInit()
+	os.Exit(m.Run())
+}
+
+// sandboxTestDir returns a new directory the sandbox user can get to, even
+// if we're root and it's nobody.
+func sandboxTestDir(t *testing.T) string {
+	dir, err := ioutil.TempDir("", "gitserve-sandbox-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	err = os.Chmod(dir, 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return dir
+}
+
+func TestSandbox(t *testing.T) {
+	probe := exec.Command("true")
+	probe.SysProcAttr = &syscall.SysProcAttr{
+		Cloneflags: syscall.CLONE_NEWUSER | syscall.CLONE_NEWNS |
+			syscall.CLONE_NEWNET,
+		UidMappings: []syscall.SysProcIDMap{
+			{ContainerID: 0, HostID: os.Getuid(), Size: 1}},
+		GidMappings: []syscall.SysProcIDMap{
+			{ContainerID: 0, HostID: os.Getgid(), Size: 1}}}
+	if err := probe.Run(); err != nil {
+		t.Skipf("user namespaces unavailable: %v", err)
+	}
+
+	// the test binary is both the sandbox's init and its grader
+	exe, err := os.Executable()
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := ioutil.ReadFile(exe)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir := sandboxTestDir(t)
+	grader := filepath.Join(dir, "repo.test")
+	err = ioutil.WriteFile(grader, data, 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func(old func() (string, error)) { sandboxExecutable = old }(
+		sandboxExecutable)
+	sandboxExecutable = func() (string, error) { return grader, nil }
+
+	repo_path := filepath.Join(dir, "repo")
+	err = os.Mkdir(repo_path, 0755)
+	if err == nil {
+		err = ioutil.WriteFile(filepath.Join(repo_path, "HEAD"), []byte("x"),
+			0644)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sandbox := &Sandbox{TempDir: dir}
+	cmd, err := sandbox.Command(context.Background(), repo_path, "", grader,
+		"-test.run=^TestSandboxGrader$", "-test.v")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cmd.Cleanup()
+	if cmd.cgroup != nil || cmd.MemoryExceeded() {
+		t.Errorf("got a cgroup without a CgroupParent")
+	}
+	cmd.Env = append(cmd.Env, sandboxTestEnv)
+	var output bytes.Buffer
+	cmd.Stdout = &output
+	cmd.Stderr = &output
+	status, err := RunExec(cmd.Cmd)
+	if err != nil || status != 0 ||
+		!bytes.Contains(output.Bytes(), []byte("--- PASS: TestSandboxGrader")) {
+		t.Fatalf("grader failed with %d, %v:\n%s", status, err, output.String())
+	}
+}
+
+// TestSandboxGrader runs in the sandbox TestSandbox sets up, and checks it
+// from the inside.
+func TestSandboxGrader(t *testing.T) {
+	if os.Getenv("GITSERVE_SANDBOX_TEST") != "1" {
+		return
+	}
+	// don't go writing all over the host
+	if hostname, _ := os.Hostname(); hostname != "sandbox" {
+		t.Fatalf("not in a sandbox")
+	}
+
+	// filesystem
+	if wd, _ := os.Getwd(); wd != "/work" {
+		t.Errorf("started in %#v", wd)
+	}
+	if _, err := ioutil.ReadFile("/repo/HEAD"); err != nil {
+		t.Errorf("can't read /repo: %v", err)
+	}
+	for _, path := range []string{"/repo/HEAD", "/repo/new", "/new",
+		"/grader", "/usr/new"} {
+		err := ioutil.WriteFile(path, nil, 0644)
+		if err == nil {
+			t.Errorf("%s is writable", path)
+		}
+	}
+	for _, path := range []string{"/work/new", "/tmp/new"} {
+		err := ioutil.WriteFile(path, []byte("x"), 0644)
+		if err != nil {
+			t.Errorf("%s isn't writable: %v", path, err)
+		}
+	}
+	err := syscall.Mount("", "/repo", "", syscall.MS_BIND|syscall.MS_REMOUNT,
+		"")
+	if err == nil {
+		t.Errorf("remounted /repo read-write")
+	}
+
+	// network
+	ifaces, err := net.Interfaces()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ifaces) != 1 || ifaces[0].Name != "lo" ||
+		ifaces[0].Flags&net.FlagUp == 0 {
+		t.Errorf("got interfaces %+v", ifaces)
+	}
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Errorf("can't use loopback: %v", err)
+	} else {
+		conn.Close()
+	}
+	listener.Close()
+	conn, err = net.DialTimeout("tcp", "192.0.2.1:80", time.Second)
+	if err == nil {
+		conn.Close()
+		t.Errorf("reached another host")
+	}
+
+	// capabilities
+	header := struct {
+		version uint32
+		pid     int32
+	}{version: linuxCapabilityVersion3}
+	var data [2]struct{ effective, permitted, inheritable uint32 }
+	_, _, errno := syscall.RawSyscall(syscall.SYS_CAPGET,
+		uintptr(unsafe.Pointer(&header)), uintptr(unsafe.Pointer(&data[0])), 0)
+	if errno != 0 {
+		t.Fatal(errno)
+	}
+	if data[0] != data[1] || data[0].effective != 0 ||
+		data[0].permitted != 0 || data[0].inheritable != 0 {
+		t.Errorf("got capabilities %+v", data)
+	}
+	for capability := 0; ; capability++ {
+		set, _, errno := syscall.RawSyscall(syscall.SYS_PRCTL,
+			syscall.PR_CAPBSET_READ, uintptr(capability), 0)
+		if errno == syscall.EINVAL {
+			break
+		}
+		if errno != 0 || set != 0 {
+			t.Errorf("capability %d is in the bounding set", capability)
+		}
+		const prCapAmbientIsSet = 1
+		set, _, errno = syscall.RawSyscall6(syscall.SYS_PRCTL, prCapAmbient,
+			prCapAmbientIsSet, uintptr(capability), 0, 0, 0)
+		if errno == 0 && set != 0 {
+			t.Errorf("capability %d is ambient", capability)
+		}
+	}
+}
+
+func TestSandboxCgroup(t *testing.T) {
+	// a plain directory stands in for a cgroup without any controllers
+	parent := t.TempDir()
+	sandbox := &Sandbox{CgroupParent: parent, Memory: 1 << 30, PIDs: 100,
+		CPUs: 1.5}
+	cmd := &SandboxedCommand{dir: filepath.Join(t.TempDir(),
+		"gitserve-sandbox-1")}
+	err := sandbox.makeCgroup(cmd)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cmd.cgroup == nil ||
+		cmd.cgroup.Name() != filepath.Join(parent, "gitserve-sandbox-1") {
+		t.Fatalf("got cgroup %v", cmd.cgroup)
+	}
+	if cmd.MemoryExceeded() {
+		t.Errorf("memory exceeded without memory.events")
+	}
+	err = cmd.cleanupCgroup()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(cmd.cgroup.Name()); !os.IsNotExist(err) {
+		t.Errorf("cgroup left behind: %v", err)
+	}
+}
@@ -0,0 +1,23 @@
+// Copyright (C) 2014 JT Olds
+// See LICENSE for copying information
+
+//go:build !linux
+
+package repo
+
+import (
+	"fmt"
+)
+
+var errSandboxUnsupported = fmt.Errorf("sandboxes are only supported on Linux")
+
+func (s *Sandbox) prepare(cmd *SandboxedCommand, config sandboxConfig,
+	args []string) error {
+	return errSandboxUnsupported
+}
+
+func (c *SandboxedCommand) cleanupCgroup() error { return nil }
+
+func sandboxInit(config_json string, args []string) error {
+	return errSandboxUnsupported
+}
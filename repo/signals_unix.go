@@ -0,0 +1,14 @@
+// Copyright (C) 2014 JT Olds
+// See LICENSE for copying information
+
+//go:build unix
+
+package repo
+
+import "syscall"
+
+func init() {
+	// RFC 4254 names these too, but not every platform has them
+	signalNames[syscall.SIGUSR1] = "USR1"
+	signalNames[syscall.SIGUSR2] = "USR2"
+}
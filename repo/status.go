@@ -0,0 +1,355 @@
+// Copyright (C) 2014 JT Olds
+// See LICENSE for copying information
+
+package repo
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// statusRewriter sits between git-receive-pack's stdout and the client, and
+// lets Rewrite change the report-status (or report-status-v2) response. For
+// submissions, the client only knows about the refs it pushed, so the
+// submission tags tagger added are hidden, and any tag failures are folded
+// into the status of the ref the tag was for. Once the report is done, any
+// Message is shown to the user.
+type statusRewriter struct {
+	Writer io.Writer
+	// Stderr gets the Message if the client didn't negotiate a sideband.
+	Stderr   io.Writer
+	Commands *commandList
+	// Rewrite, if set, gets the lines of the report, minus the final
+	// flush-pkt, and returns the lines to send instead.
+	Rewrite func(lines []string) []string
+	// Message, if set, returns a message for the user, shown after the
+	// report.
+	Message func() string
+
+	pending      []byte
+	advertised   bool
+	report       []byte
+	report_lines []string
+	report_done  bool
+	// reported is the whole report as receive-pack sent it, once it's done
+	reported  []string
+	announced bool
+	err       error
+}
+
+func (s *statusRewriter) sideband() (max_payload int) {
+	switch {
+	case s.Commands.hasCapability("side-band-64k"):
+		return 65515
+	case s.Commands.hasCapability("side-band"):
+		return 995
+	}
+	return 0
+}
+
+func (s *statusRewriter) reportStatus() bool {
+	return s.Commands.hasCapability("report-status") ||
+		s.Commands.hasCapability("report-status-v2")
+}
+
+// nextPktLine pops the next complete pkt-line off of buf. ok is false if buf
+// doesn't contain a complete pkt-line yet.
+func nextPktLine(buf []byte) (payload, rest []byte, ok bool, err error) {
+	if len(buf) < 4 {
+		return nil, buf, false, nil
+	}
+	line, err := readPktLine(bytes.NewReader(buf))
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		return nil, buf, false, nil
+	}
+	if err != nil {
+		return nil, buf, false, err
+	}
+	return line, buf[len(line)+4:], true, nil
+}
+
+func (s *statusRewriter) Write(p []byte) (n int, err error) {
+	if s.err != nil {
+		return 0, s.err
+	}
+	if s.advertised && s.report_done {
+		return s.Writer.Write(p)
+	}
+	s.pending = append(s.pending, p...)
+	for !(s.advertised && s.report_done) {
+		line, rest, ok, err := nextPktLine(s.pending)
+		if err != nil {
+			s.err = err
+			return 0, err
+		}
+		if !ok {
+			return len(p), nil
+		}
+		s.pending = rest
+		err = s.handlePktLine(line)
+		if err != nil {
+			s.err = err
+			return 0, err
+		}
+	}
+	if len(s.pending) > 0 {
+		_, err = s.Writer.Write(s.pending)
+		s.pending = nil
+		if err != nil {
+			s.err = err
+			return 0, err
+		}
+	}
+	return len(p), nil
+}
+
+func (s *statusRewriter) handlePktLine(line []byte) error {
+	if !s.advertised {
+		// the ref advertisement passes through untouched
+		if line == nil {
+			s.advertised = true
+		}
+		return writePktLine(s.Writer, line)
+	}
+
+	// by the time receive-pack says anything else, it has read the commands,
+	// so the capabilities are known.
+	if !s.reportStatus() && s.sideband() == 0 {
+		s.report_done = true
+		return writePktLine(s.Writer, line)
+	}
+
+	if s.sideband() == 0 {
+		if line == nil {
+			s.report_done = true
+		}
+		return s.writeReportLine(line)
+	}
+
+	if line == nil {
+		// the sideband stream is over. announce the tags before it ends.
+		s.report_done = true
+		s.announced = true
+		err := s.writeBand(2, []byte(s.message()))
+		if err != nil {
+			return err
+		}
+		return writePktLine(s.Writer, nil)
+	}
+	if len(line) == 0 || line[0] != 1 || !s.reportStatus() {
+		return writePktLine(s.Writer, line)
+	}
+	// band 1 carries the report-status pkt-lines, possibly split across
+	// several sideband packets.
+	s.report = append(s.report, line[1:]...)
+	for {
+		report_line, rest, ok, err := nextPktLine(s.report)
+		if err != nil {
+			return err
+		}
+		if !ok {
+			return nil
+		}
+		s.report = rest
+		err = s.writeReportLine(report_line)
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// writeReportLine collects report-status lines until the report's flush-pkt,
+// then writes the rewritten report.
+func (s *statusRewriter) writeReportLine(line []byte) error {
+	if line != nil {
+		s.report_lines = append(s.report_lines, string(line))
+		return nil
+	}
+	s.reported = s.report_lines
+	var out bytes.Buffer
+	for _, report_line := range s.rewrite(s.report_lines) {
+		err := writePktLine(&out, []byte(report_line))
+		if err != nil {
+			return err
+		}
+	}
+	err := writePktLine(&out, nil)
+	if err != nil {
+		return err
+	}
+	s.report_lines = nil
+	if s.sideband() == 0 {
+		_, err = s.Writer.Write(out.Bytes())
+		if err != nil {
+			return err
+		}
+		s.announced = true
+		_, err = io.WriteString(s.Stderr, s.message())
+		return err
+	}
+	return s.writeBand(1, out.Bytes())
+}
+
+func (s *statusRewriter) writeBand(band byte, data []byte) error {
+	max_payload := s.sideband()
+	for len(data) > 0 {
+		chunk := data
+		if len(chunk) > max_payload {
+			chunk = chunk[:max_payload]
+		}
+		data = data[len(chunk):]
+		err := writePktLine(s.Writer, append([]byte{band}, chunk...))
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *statusRewriter) rewrite(lines []string) []string {
+	if s.Rewrite == nil {
+		return lines
+	}
+	return s.Rewrite(lines)
+}
+
+// reportedUpdates returns which of updates receive-pack's report says were
+// made. ok is false if there was no whole report to go by, e.g. because the
+// client didn't ask for one.
+func (s *statusRewriter) reportedUpdates(updates []RefUpdate) (
+	applied []RefUpdate, ok bool) {
+	if s.reported == nil {
+		return nil, false
+	}
+	made := map[Ref]bool{}
+	for _, line := range s.reported {
+		fields := strings.Fields(line)
+		if len(fields) == 2 && fields[0] == "ok" {
+			made[Ref(fields[1])] = true
+		}
+	}
+	for _, update := range updates {
+		if made[update.Ref] {
+			applied = append(applied, update)
+		}
+	}
+	return applied, true
+}
+
+func (s *statusRewriter) message() string {
+	if s.Message == nil {
+		return ""
+	}
+	return s.Message()
+}
+
+// submittedMessage tells the user which submission tags were created.
+func (t *tagger) submittedMessage() string {
+	var msg bytes.Buffer
+	for _, update := range t.updates() {
+		if update.Tag == "" {
+			continue
+		}
+		fmt.Fprintf(&msg, "Submitted %s as tag %s\n", update.Ref, update.Tag)
+	}
+	return msg.String()
+}
+
+// Flush writes out anything still being held back, e.g. because
+// git-receive-pack exited partway through its report, and shows the Message
+// on Stderr if there was no chance to do so in-band.
+func (s *statusRewriter) Flush() error {
+	if s.err != nil {
+		return s.err
+	}
+	if !s.report_done && (len(s.report_lines) > 0 || len(s.report) > 0) {
+		// the report was cut off. send what there is of it.
+		var out bytes.Buffer
+		for _, report_line := range s.rewrite(s.report_lines) {
+			err := writePktLine(&out, []byte(report_line))
+			if err != nil {
+				return err
+			}
+		}
+		out.Write(s.report)
+		s.report_lines, s.report = nil, nil
+		var err error
+		if s.sideband() == 0 {
+			_, err = s.Writer.Write(out.Bytes())
+		} else {
+			err = s.writeBand(1, out.Bytes())
+		}
+		if err != nil {
+			return err
+		}
+	}
+	if len(s.pending) > 0 {
+		_, err := s.Writer.Write(s.pending)
+		s.pending = nil
+		if err != nil {
+			return err
+		}
+	}
+	if !s.announced {
+		s.announced = true
+		_, err := io.WriteString(s.Stderr, s.message())
+		return err
+	}
+	return nil
+}
+
+// rewriteReport removes the status of submission tags from a report-status
+// response, marking the pushed ref as failed if its tag failed.
+func rewriteReport(lines []string, updates []RefUpdate) []string {
+	tag_refs := make(map[string]string, len(updates))
+	for _, update := range updates {
+		if update.Tag != "" {
+			tag_refs["refs/tags/"+string(update.Tag)] = string(update.Ref)
+		}
+	}
+
+	tag_failures := make(map[string]string)
+	for _, line := range lines {
+		fields := strings.SplitN(strings.TrimSuffix(line, "\n"), " ", 3)
+		if len(fields) < 2 || fields[0] != "ng" {
+			continue
+		}
+		if ref, ok := tag_refs[fields[1]]; ok {
+			reason := "failed"
+			if len(fields) == 3 {
+				reason = fields[2]
+			}
+			tag_failures[ref] = "submission tag " + reason
+		}
+	}
+
+	var rv []string
+	skipping := false
+	for _, line := range lines {
+		fields := strings.SplitN(strings.TrimSuffix(line, "\n"), " ", 3)
+		switch fields[0] {
+		case "ok", "ng":
+			if len(fields) < 2 {
+				break
+			}
+			_, skipping = tag_refs[fields[1]]
+			if skipping {
+				continue
+			}
+			if reason, ok := tag_failures[fields[1]]; ok && fields[0] == "ok" {
+				line = fmt.Sprintf("ng %s %s\n", fields[1], reason)
+			}
+		case "option":
+			// report-status-v2 options belong to the preceding ref
+			if skipping {
+				continue
+			}
+		default:
+			skipping = false
+		}
+		rv = append(rv, line)
+	}
+	return rv
+}
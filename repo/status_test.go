@@ -0,0 +1,315 @@
+// Copyright (C) 2014 JT Olds
+// See LICENSE for copying information
+
+package repo
+
+import (
+	"bytes"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestNextPktLine(t *testing.T) {
+	for _, test := range []struct {
+		in      string
+		payload string
+		rest    string
+		ok      bool
+		err     bool
+	}{
+		{in: "", rest: ""},
+		{in: "00", rest: "00"},
+		{in: "0009hel", rest: "0009hel"},
+		{in: "0009hello", payload: "hello", ok: true},
+		{in: "0009hello0000", payload: "hello", rest: "0000", ok: true},
+		{in: "0000rest", rest: "rest", ok: true},
+		{in: "zzzzhello", err: true},
+	} {
+		payload, rest, ok, err := nextPktLine([]byte(test.in))
+		if test.err {
+			if err == nil {
+				t.Errorf("%#v: expected error", test.in)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%#v: unexpected error: %v", test.in, err)
+			continue
+		}
+		if string(payload) != test.payload || string(rest) != test.rest ||
+			ok != test.ok {
+			t.Errorf("%#v: got %#v, %#v, %v", test.in, string(payload),
+				string(rest), ok)
+		}
+	}
+}
+
+func TestRewriteReport(t *testing.T) {
+	updates := []RefUpdate{
+		{Ref: "refs/heads/a", Tag: "submissions/1/refs/heads/a"},
+		{Ref: "refs/heads/b", Tag: "submissions/1/refs/heads/b"},
+		{Ref: "refs/heads/gone"}}
+	for _, test := range []struct {
+		name string
+		in   []string
+		out  []string
+	}{
+		{
+			name: "tags hidden",
+			in: []string{"unpack ok\n",
+				"ok refs/heads/a\n",
+				"ok refs/tags/submissions/1/refs/heads/a\n",
+				"ok refs/heads/b\n",
+				"ok refs/tags/submissions/1/refs/heads/b\n",
+				"ok refs/heads/gone\n"},
+			out: []string{"unpack ok\n",
+				"ok refs/heads/a\n",
+				"ok refs/heads/b\n",
+				"ok refs/heads/gone\n"},
+		},
+		{
+			name: "tag failure folded into its ref",
+			in: []string{"unpack ok\n",
+				"ok refs/heads/a\n",
+				"ng refs/tags/submissions/1/refs/heads/a already exists\n",
+				"ok refs/heads/b\n",
+				"ng refs/tags/submissions/1/refs/heads/b\n"},
+			out: []string{"unpack ok\n",
+				"ng refs/heads/a submission tag already exists\n",
+				"ng refs/heads/b submission tag failed\n"},
+		},
+		{
+			name: "ref failure kept",
+			in: []string{"unpack ok\n",
+				"ng refs/heads/a non-fast-forward\n",
+				"ng refs/tags/submissions/1/refs/heads/a failed\n"},
+			out: []string{"unpack ok\n",
+				"ng refs/heads/a non-fast-forward\n"},
+		},
+		{
+			name: "v2 options follow their ref",
+			in: []string{"unpack ok\n",
+				"ok refs/heads/a\n",
+				"option refname refs/heads/a\n",
+				"option new-oid 1111\n",
+				"ok refs/tags/submissions/1/refs/heads/a\n",
+				"option refname refs/tags/submissions/1/refs/heads/a\n",
+				"ok refs/heads/b\n",
+				"option forced-update\n"},
+			out: []string{"unpack ok\n",
+				"ok refs/heads/a\n",
+				"option refname refs/heads/a\n",
+				"option new-oid 1111\n",
+				"ok refs/heads/b\n",
+				"option forced-update\n"},
+		},
+		{
+			name: "unpack failure",
+			in:   []string{"unpack index-pack abnormal exit\n"},
+			out:  []string{"unpack index-pack abnormal exit\n"},
+		},
+	} {
+		out := rewriteReport(test.in, updates)
+		if !reflect.DeepEqual(out, test.out) {
+			t.Errorf("%s: got %#v, expected %#v", test.name, out, test.out)
+		}
+	}
+}
+
+// band encodes data as sideband pkt-lines on the given band.
+func band(n byte, data string, max_payload int) string {
+	var buf bytes.Buffer
+	for len(data) > 0 {
+		chunk := data
+		if len(chunk) > max_payload {
+			chunk = chunk[:max_payload]
+		}
+		data = data[len(chunk):]
+		writePktLine(&buf, append([]byte{n}, chunk...))
+	}
+	return buf.String()
+}
+
+func TestStatusRewriter(t *testing.T) {
+	advertisement := pkt(newId+" refs/heads/master\x00report-status\n", "")
+	report := pkt("unpack ok\n", "ok refs/heads/a\n",
+		"ok refs/tags/submissions/1/refs/heads/a\n", "")
+	rewritten := pkt("unpack ok\n", "ok refs/heads/a\n", "")
+	long_message := strings.Repeat("x", 2000)
+
+	for _, test := range []struct {
+		name         string
+		capabilities []string
+		message      string
+		in           string
+		out          string
+		stderr       string
+	}{
+		{
+			name:         "no sideband",
+			capabilities: []string{"report-status"},
+			message:      "hi\n",
+			in:           advertisement + report,
+			out:          advertisement + rewritten,
+			stderr:       "hi\n",
+		},
+		{
+			name:         "sideband",
+			capabilities: []string{"report-status", "side-band-64k"},
+			message:      "hi\n",
+			in: advertisement + band(1, report[:10], 65515) +
+				band(2, "progress\n", 65515) +
+				band(1, report[10:], 65515) + "0000",
+			out: advertisement + band(2, "progress\n", 65515) +
+				band(1, rewritten, 65515) + band(2, "hi\n", 65515) + "0000",
+		},
+		{
+			name:         "small sideband",
+			capabilities: []string{"report-status-v2", "side-band"},
+			message:      long_message,
+			in:           advertisement + band(1, report, 995) + "0000",
+			out: advertisement + band(1, rewritten, 995) +
+				band(2, long_message, 995) + "0000",
+		},
+		{
+			name:         "sideband without report-status",
+			capabilities: []string{"side-band-64k"},
+			message:      "hi\n",
+			in: advertisement + band(2, "progress\n", 65515) +
+				band(1, "whatever", 65515) + "0000",
+			out: advertisement + band(2, "progress\n", 65515) +
+				band(1, "whatever", 65515) + band(2, "hi\n", 65515) + "0000",
+		},
+		{
+			name:    "no report",
+			message: "hi\n",
+			in:      advertisement + "0000",
+			out:     advertisement + "0000",
+			stderr:  "hi\n",
+		},
+		{
+			name:         "cut off",
+			capabilities: []string{"report-status"},
+			message:      "hi\n",
+			in:           advertisement + report[:20],
+			out:          advertisement + report[:20],
+			stderr:       "hi\n",
+		},
+		{
+			name:         "sideband cut off",
+			capabilities: []string{"report-status", "side-band-64k"},
+			message:      "hi\n",
+			in:           advertisement + band(1, report[:20], 65515),
+			out:          advertisement + band(1, report[:20], 65515),
+			stderr:       "hi\n",
+		},
+	} {
+		for _, chunk_size := range []int{1, 7, len(test.in)} {
+			var out, stderr bytes.Buffer
+			s := &statusRewriter{
+				Writer:   &out,
+				Stderr:   &stderr,
+				Commands: &commandList{Capabilities: test.capabilities},
+				Rewrite: func(lines []string) []string {
+					return rewriteReport(lines, []RefUpdate{{Ref: "refs/heads/a",
+						Tag: "submissions/1/refs/heads/a"}})
+				},
+				Message: func() string { return test.message }}
+			for in := test.in; len(in) > 0; {
+				chunk := in
+				if len(chunk) > chunk_size {
+					chunk = chunk[:chunk_size]
+				}
+				in = in[len(chunk):]
+				n, err := s.Write([]byte(chunk))
+				if err != nil || n != len(chunk) {
+					t.Fatalf("%s/%d: write returned %d, %v", test.name, chunk_size,
+						n, err)
+				}
+			}
+			err := s.Flush()
+			if err != nil {
+				t.Fatalf("%s/%d: flush: %v", test.name, chunk_size, err)
+			}
+			if out.String() != test.out {
+				t.Errorf("%s/%d: got\n%#v\nexpected\n%#v", test.name, chunk_size,
+					out.String(), test.out)
+			}
+			if stderr.String() != test.stderr {
+				t.Errorf("%s/%d: got stderr %#v, expected %#v", test.name,
+					chunk_size, stderr.String(), test.stderr)
+			}
+		}
+	}
+}
+
+func TestReportedUpdates(t *testing.T) {
+	advertisement := pkt(newId+" refs/heads/master\x00report-status\n", "")
+	updates := []RefUpdate{
+		{Ref: "refs/heads/a", Old: zeroId, New: newId},
+		{Ref: "refs/heads/b", Old: oldId, New: newId},
+		{Ref: "refs/heads/c", Old: oldId, New: zeroId}}
+	for _, test := range []struct {
+		name         string
+		capabilities []string
+		in           string
+		applied      []RefUpdate
+		ok           bool
+	}{
+		{
+			name:         "report",
+			capabilities: []string{"report-status"},
+			in: advertisement + pkt("unpack ok\n", "ok refs/heads/a\n",
+				"ng refs/heads/b non-fast-forward\n", "ok refs/heads/c\n", ""),
+			applied: []RefUpdate{updates[0], updates[2]},
+			ok:      true,
+		},
+		{
+			name:         "v2 sideband report",
+			capabilities: []string{"report-status-v2", "side-band-64k"},
+			in: advertisement + band(1, pkt("unpack ok\n", "ok refs/heads/b\n",
+				"option forced-update\n", ""), 65515) + "0000",
+			applied: []RefUpdate{updates[1]},
+			ok:      true,
+		},
+		{
+			name:         "unpack failed",
+			capabilities: []string{"report-status"},
+			in: advertisement + pkt("unpack index-pack abnormal exit\n",
+				"ng refs/heads/a unpacker error\n", ""),
+			ok: true,
+		},
+		{
+			name:         "cut off",
+			capabilities: []string{"report-status"},
+			in:           advertisement + pkt("unpack ok\n", "ok refs/heads/a\n"),
+		},
+		{
+			name: "no report",
+			in:   advertisement + "0000",
+		},
+	} {
+		var out, stderr bytes.Buffer
+		s := &statusRewriter{
+			Writer:   &out,
+			Stderr:   &stderr,
+			Commands: &commandList{Capabilities: test.capabilities}}
+		_, err := s.Write([]byte(test.in))
+		if err == nil {
+			err = s.Flush()
+		}
+		if err != nil {
+			t.Fatalf("%s: %v", test.name, err)
+		}
+		if out.String() != test.in {
+			t.Errorf("%s: got %#v, expected it unchanged", test.name,
+				out.String())
+		}
+		applied, ok := s.reportedUpdates(updates)
+		if !reflect.DeepEqual(applied, test.applied) || ok != test.ok {
+			t.Errorf("%s: got %+v, %v, expected %+v, %v", test.name, applied, ok,
+				test.applied, test.ok)
+		}
+	}
+}
@@ -0,0 +1,296 @@
+// Copyright (C) 2014 JT Olds
+// See LICENSE for copying information
+
+package repo
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"os"
+	"sort"
+	"sync"
+	"time"
+)
+
+// ErrSubmissionNotFound is returned by SubmissionStore.Get for unknown ids.
+var ErrSubmissionNotFound = errors.New("submission not found")
+
+type SubmissionStatus string
+
+const (
+	SubmissionQueued  SubmissionStatus = "queued"
+	SubmissionRunning SubmissionStatus = "running"
+	SubmissionDone    SubmissionStatus = "done"
+)
+
+// Submission is the record of a single push to RepoSubmissions.
+type Submission struct {
+	Id       string           `json:"id"`
+	UserId   string           `json:"user_id"`
+	RepoName string           `json:"repo_name"`
+	Updates  []RefUpdate      `json:"updates"`
+	Status   SubmissionStatus `json:"status,omitempty"`
+
+	// These describe the push well enough to run the SubmissionHandler after
+	// the pusher has disconnected, or after a restart, in queued mode.
+	RepoPath    string   `json:"repo_path,omitempty"`
+	SSHUser     string   `json:"ssh_user,omitempty"`
+	Remote      string   `json:"remote,omitempty"`
+	Key         string   `json:"key,omitempty"`
+	DisplayName string   `json:"display_name,omitempty"`
+	Groups      []string `json:"groups,omitempty"`
+
+	Started time.Time `json:"started"`
+	// Finished is zero until the SubmissionHandler is done.
+	Finished   time.Time `json:"finished"`
+	ExitStatus uint32    `json:"exit_status"`
+	Error      string    `json:"error,omitempty"`
+	// Output is what the SubmissionHandler wrote to the user, possibly
+	// truncated.
+	Output string `json:"output,omitempty"`
+}
+
+// SubmissionQuery selects submissions. Zero-valued fields match everything.
+type SubmissionQuery struct {
+	UserId   string
+	RepoName string
+	// if set, only submissions started at or after After, and strictly before
+	// Before, match.
+	After  time.Time
+	Before time.Time
+	// if positive, at most Limit of the most recent matches are returned.
+	Limit int
+}
+
+func (q SubmissionQuery) matches(sub *Submission) bool {
+	return (q.UserId == "" || q.UserId == sub.UserId) &&
+		(q.RepoName == "" || q.RepoName == sub.RepoName) &&
+		(q.After.IsZero() || !sub.Started.Before(q.After)) &&
+		(q.Before.IsZero() || sub.Started.Before(q.Before))
+}
+
+// SubmissionStore persists Submissions.
+type SubmissionStore interface {
+	// Put creates or replaces the submission with sub.Id.
+	Put(ctx context.Context, sub *Submission) error
+	// Get returns ErrSubmissionNotFound if there is no such submission.
+	Get(ctx context.Context, id string) (*Submission, error)
+	// Find returns matching submissions, oldest first.
+	Find(ctx context.Context, q SubmissionQuery) ([]*Submission, error)
+}
+
+// FileSubmissionStore is a SubmissionStore kept in a single append-only file
+// of JSON records. The whole index is held in memory, and the latest record
+// for an id wins. Once most of the file is superseded records, it's
+// rewritten with just the latest ones.
+type FileSubmissionStore struct {
+	path string
+
+	mtx    sync.Mutex
+	file   *os.File
+	byId   map[string]*Submission
+	sorted []*Submission
+	// records is how many records the file holds.
+	records int
+}
+
+var _ SubmissionStore = (*FileSubmissionStore)(nil)
+
+// compactSlack is how many superseded records, beyond one per submission,
+// the file may have before it's compacted. Submissions get a few records
+// each as they run, so this keeps compaction from happening on every other
+// Put.
+const compactSlack = 1024
+
+// OpenFileSubmissionStore opens or creates the index at path.
+func OpenFileSubmissionStore(path string) (*FileSubmissionStore, error) {
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, err
+	}
+	s := &FileSubmissionStore{
+		path: path, file: file, byId: make(map[string]*Submission)}
+	err = s.load()
+	if err == nil && s.needsCompaction() {
+		err = s.compact()
+	}
+	if err != nil {
+		s.file.Close()
+		return nil, err
+	}
+	return s, nil
+}
+
+// load reads the file into memory. If a crash cut off the last record, the
+// file is repaired, so that the next record starts on a new line.
+func (s *FileSubmissionStore) load() error {
+	reader := bufio.NewReader(s.file)
+	var complete int64
+	for {
+		line, err := reader.ReadBytes('\n')
+		if err == io.EOF {
+			if len(line) == 0 {
+				return nil
+			}
+			return s.repair(line, complete)
+		}
+		if err != nil {
+			return err
+		}
+		complete += int64(len(line))
+		s.loadRecord(line)
+	}
+}
+
+// loadRecord indexes the record in line, returning false if it's bad.
+func (s *FileSubmissionStore) loadRecord(line []byte) bool {
+	if len(bytes.TrimSpace(line)) == 0 {
+		return true
+	}
+	var sub Submission
+	err := json.Unmarshal(line, &sub)
+	if err != nil {
+		logger.Warnf("skipping bad submission record in %s: %v", s.path, err)
+		return false
+	}
+	s.records++
+	s.index(&sub)
+	return true
+}
+
+// repair handles a final line without a newline, which starts at offset. If
+// it's a whole record, only the newline is missing. Otherwise the write was
+// torn, and the line is cut off.
+func (s *FileSubmissionStore) repair(line []byte, offset int64) error {
+	if s.loadRecord(line) {
+		_, err := s.file.Write([]byte("\n"))
+		return err
+	}
+	logger.Warnf("truncating torn submission record at the end of %s", s.path)
+	return s.file.Truncate(offset)
+}
+
+func (s *FileSubmissionStore) needsCompaction() bool {
+	return s.records >= 2*len(s.byId)+compactSlack
+}
+
+// compact replaces the file with one holding only the latest record for
+// each submission. s.mtx must be held (or s not yet shared).
+func (s *FileSubmissionStore) compact() error {
+	var data bytes.Buffer
+	for _, sub := range s.sorted {
+		record, err := json.Marshal(sub)
+		if err != nil {
+			return err
+		}
+		data.Write(record)
+		data.WriteByte('\n')
+	}
+	err := writeFileAtomic(s.path, data.Bytes(), 0644)
+	if err != nil {
+		return err
+	}
+	file, err := os.OpenFile(s.path, os.O_RDWR|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	logger.Noticef("compacted %s from %d to %d records", s.path, s.records,
+		len(s.sorted))
+	s.file.Close()
+	s.file = file
+	s.records = len(s.sorted)
+	return nil
+}
+
+// index adds or replaces sub in memory. s.mtx must be held (or s not yet
+// shared).
+func (s *FileSubmissionStore) index(sub *Submission) {
+	needs_sort := false
+	if old, ok := s.byId[sub.Id]; ok {
+		needs_sort = !old.Started.Equal(sub.Started)
+		*old = *sub
+	} else {
+		s.byId[sub.Id] = sub
+		s.sorted = append(s.sorted, sub)
+		n := len(s.sorted)
+		needs_sort = n > 1 && sub.Started.Before(s.sorted[n-2].Started)
+	}
+	if needs_sort {
+		sort.SliceStable(s.sorted, func(i, j int) bool {
+			return s.sorted[i].Started.Before(s.sorted[j].Started)
+		})
+	}
+}
+
+func (s *FileSubmissionStore) Put(ctx context.Context, sub *Submission) (
+	err error) {
+	defer mon.Task()(&ctx)(&err)
+	data, err := json.Marshal(sub)
+	if err != nil {
+		return err
+	}
+	data = append(data, '\n')
+
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	_, err = s.file.Write(data)
+	if err != nil {
+		// end whatever part of the record made it, so that it doesn't run
+		// into the next one
+		s.file.Write([]byte("\n"))
+		return err
+	}
+	err = s.file.Sync()
+	if err != nil {
+		return err
+	}
+	copied := *sub
+	s.records++
+	s.index(&copied)
+	if s.needsCompaction() {
+		// the record is safely written either way
+		logger.Errore(s.compact())
+	}
+	return nil
+}
+
+func (s *FileSubmissionStore) Get(ctx context.Context, id string) (
+	sub *Submission, err error) {
+	defer mon.Task()(&ctx)(&err)
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	found, ok := s.byId[id]
+	if !ok {
+		return nil, ErrSubmissionNotFound
+	}
+	copied := *found
+	return &copied, nil
+}
+
+func (s *FileSubmissionStore) Find(ctx context.Context, q SubmissionQuery) (
+	subs []*Submission, err error) {
+	defer mon.Task()(&ctx)(&err)
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	for _, sub := range s.sorted {
+		if q.matches(sub) {
+			copied := *sub
+			subs = append(subs, &copied)
+		}
+	}
+	if q.Limit > 0 && len(subs) > q.Limit {
+		subs = subs[len(subs)-q.Limit:]
+	}
+	return subs, nil
+}
+
+// Close closes the underlying file.
+func (s *FileSubmissionStore) Close() error {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	return s.file.Close()
+}
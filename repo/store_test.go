@@ -0,0 +1,147 @@
+// Copyright (C) 2014 JT Olds
+// See LICENSE for copying information
+
+package repo
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func record(t *testing.T, sub *Submission) string {
+	data, err := json.Marshal(sub)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(data)
+}
+
+func TestFileSubmissionStoreRepair(t *testing.T) {
+	ctx := context.Background()
+	started := time.Date(2014, 8, 16, 0, 0, 0, 0, time.UTC)
+	first := &Submission{Id: "1", UserId: "jt", Started: started}
+	second := &Submission{Id: "2", UserId: "jt", Started: started.Add(1)}
+	third := &Submission{Id: "3", UserId: "jt", Started: started.Add(2)}
+
+	for _, test := range []struct {
+		name string
+		data string
+		ids  []string
+	}{
+		{
+			name: "intact",
+			data: record(t, first) + "\n" + record(t, second) + "\n",
+			ids:  []string{"1", "2", "3"},
+		},
+		{
+			name: "torn",
+			data: record(t, first) + "\n" + record(t, second)[:10],
+			ids:  []string{"1", "3"},
+		},
+		{
+			name: "missing newline",
+			data: record(t, first) + "\n" + record(t, second),
+			ids:  []string{"1", "2", "3"},
+		},
+		{
+			name: "bad record in the middle",
+			data: record(t, first) + "\n{\n" + record(t, second) + "\n",
+			ids:  []string{"1", "2", "3"},
+		},
+		{
+			name: "empty",
+			ids:  []string{"3"},
+		},
+	} {
+		path := filepath.Join(t.TempDir(), "index")
+		err := ioutil.WriteFile(path, []byte(test.data), 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+		store, err := OpenFileSubmissionStore(path)
+		if err != nil {
+			t.Fatalf("%s: %v", test.name, err)
+		}
+		err = store.Put(ctx, third)
+		if err != nil {
+			t.Fatalf("%s: %v", test.name, err)
+		}
+		store.Close()
+
+		// the record put after the repair has to survive reopening
+		store, err = OpenFileSubmissionStore(path)
+		if err != nil {
+			t.Fatalf("%s: %v", test.name, err)
+		}
+		subs, err := store.Find(ctx, SubmissionQuery{})
+		store.Close()
+		if err != nil {
+			t.Fatalf("%s: %v", test.name, err)
+		}
+		var ids []string
+		for _, sub := range subs {
+			ids = append(ids, sub.Id)
+		}
+		if strings.Join(ids, ",") != strings.Join(test.ids, ",") {
+			t.Errorf("%s: got %v, expected %v", test.name, ids, test.ids)
+		}
+	}
+}
+
+func TestFileSubmissionStoreCompaction(t *testing.T) {
+	ctx := context.Background()
+	path := filepath.Join(t.TempDir(), "index")
+	store, err := OpenFileSubmissionStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+
+	sub := &Submission{Id: "1", Started: time.Now()}
+	for i := 0; i < 2*compactSlack; i++ {
+		sub.Status = SubmissionRunning
+		if i == 2*compactSlack-1 {
+			sub.Status = SubmissionDone
+		}
+		err = store.Put(ctx, sub)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	err = store.Put(ctx, &Submission{Id: "2", Started: time.Now()})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if lines := bytes.Count(data, []byte("\n")); lines > compactSlack {
+		t.Fatalf("file wasn't compacted: %d lines", lines)
+	}
+
+	// the compacted file is what's appended to, and it still has everything
+	store.Close()
+	store, err = OpenFileSubmissionStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := store.Get(ctx, "1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.Status != SubmissionDone {
+		t.Fatalf("got status %q, expected %q", got.Status, SubmissionDone)
+	}
+	_, err = store.Get(ctx, "2")
+	if err != nil {
+		t.Fatal(err)
+	}
+}
@@ -4,15 +4,19 @@
 package repo
 
 import (
+	"context"
 	"crypto/hmac"
 	"crypto/sha256"
 	"encoding/hex"
+	"encoding/json"
 	"fmt"
 	"io"
+	"net"
 	"os"
 	"os/exec"
 	"strings"
 	"sync"
+	"time"
 
 	gs_ssh "github.com/jtolds/gitserve/ssh"
 	"github.com/spacemonkeygo/monotime"
@@ -20,15 +24,18 @@ import (
 )
 
 type SubmissionHandler func(
+	ctx context.Context,
 	repo_path string,
 	output io.Writer,
 	meta ssh.ConnMetadata,
 	key ssh.PublicKey,
-	repo_name string, tags map[Ref][]Tag) (
+	repo_name string,
+	submission_id string, updates []RefUpdate) (
 	exit_status uint32,
 	err error)
 
 type PresubmissionHandler func(
+	ctx context.Context,
 	repo_path string,
 	output io.Writer,
 	meta ssh.ConnMetadata,
@@ -36,19 +43,63 @@ type PresubmissionHandler func(
 	repo_name string) (
 	err error)
 
-type AuthHandler func(meta ssh.ConnMetadata, key ssh.PublicKey) (
-	unique_user_id *string, err error)
+// AuthHandler decides whether a key may connect. If it returns a nil User or
+// a User with an empty Id, the user is identified by a hash of their key.
+// ctx expires after RepoSubmissions.AuthTimeout.
+type AuthHandler func(ctx context.Context, meta ssh.ConnMetadata,
+	key ssh.PublicKey) (user *User, err error)
 
 type NewRepoHandler func(
+	ctx context.Context,
 	repo_path string,
 	output io.Writer,
 	meta ssh.ConnMetadata,
 	key ssh.PublicKey,
 	repo_name string) error
 
+// User is an authenticated submitter, as identified by an AuthHandler.
+type User struct {
+	// Id uniquely identifies the user across keys.
+	Id          string
+	DisplayName string
+	Groups      []string
+}
+
+type userKey struct{}
+
+// UserFromContext returns the User the handler context belongs to, or nil.
+// It is set for the context given to PresubmissionHandler,
+// SubmissionHandler, and NewRepoHandler.
+func UserFromContext(ctx context.Context) *User {
+	user, _ := ctx.Value(userKey{}).(*User)
+	return user
+}
+
+// session is who a connection authenticated as.
 type session struct {
-	key            ssh.PublicKey
-	unique_user_id string
+	key  ssh.PublicKey
+	user User
+}
+
+// sessionExtension is the ssh.Permissions extension holding the
+// connection's User, as JSON. The key is in keyExtension.
+const sessionExtension = "gitserve-session@gitserve"
+
+// permissionsSession returns the session kept in perms, or nil.
+func permissionsSession(perms *ssh.Permissions) *session {
+	if perms == nil || perms.Extensions[sessionExtension] == "" {
+		return nil
+	}
+	key, err := ssh.ParsePublicKey([]byte(perms.Extensions[keyExtension]))
+	if err != nil {
+		return nil
+	}
+	rv := &session{key: key}
+	err = json.Unmarshal([]byte(perms.Extensions[sessionExtension]), &rv.user)
+	if err != nil {
+		return nil
+	}
+	return rv
 }
 
 type RepoSubmissions struct {
@@ -63,6 +114,56 @@ type RepoSubmissions struct {
 	NewRepoHandler       NewRepoHandler
 	MaxPushSize          int64
 
+	// If set, every submission is recorded here.
+	Store SubmissionStore
+	// The most SubmissionHandler output to keep in a stored Submission.
+	// Defaults to 64 KiB.
+	MaxStoredOutput int
+
+	// If positive, submissions are queued and processed by this many workers
+	// instead of running while the pusher waits. Requires Store, and can't be
+	// used with Clean. Pushers still see their submission's output unless
+	// they disconnect or push with -o nowait.
+	Workers int
+
+	// If true, pushes may delete refs in the submission repo. Deletions are
+	// passed to SubmissionHandler without a Tag. Otherwise they're rejected.
+	AllowDeletes bool
+
+	// If positive, how long each handler may run before its context is
+	// canceled. A SubmissionHandler or NewRepoHandler that times out fails
+	// the push. An AuthHandler that times out is abandoned, so that it can't
+	// stall the SSH handshake, and the key is rejected.
+	SubmissionTimeout    time.Duration
+	PresubmissionTimeout time.Duration
+	NewRepoTimeout       time.Duration
+	AuthTimeout          time.Duration
+
+	// If set, only these keys may connect, before AuthHandler gets a say.
+	// Key options like from= are enforced, and gitserve-repos and
+	// gitserve-read-only limit which repo names the key may use, and whether
+	// it may push to them.
+	KeySource KeySource
+	// If set, user certificates signed by its CAs are accepted too, before
+	// AuthHandler gets a say, and its revoked keys are refused. A
+	// certificate's first principal is the User Id, unless AuthHandler says
+	// otherwise. If there's no KeySource and no AuthHandler, only
+	// certificates are accepted.
+	CertAuthority *CertAuthority
+
+	// If set, limits connections and pushes. Unless Limits.User is set,
+	// users are told apart by User Id.
+	Limits *gs_ssh.Limits
+	// Timeouts for connections. See gs_ssh.Timeouts.
+	Timeouts gs_ssh.Timeouts
+	// If set, PROXY protocol headers are accepted from trusted proxies. The
+	// client's address is what hooks get as the remote address.
+	ProxyProtocol *gs_ssh.ProxyProtocol
+
+	// If set, gets an AuditEvent for every authentication attempt and
+	// command.
+	Audit AuditSink
+
 	// If set, these commands override the default git-receive-pack and
 	// git-upload-pack
 	GitReceivePack string
@@ -70,17 +171,26 @@ type RepoSubmissions struct {
 
 	mtx          sync.Mutex
 	repo_lock_cv *sync.Cond
-	sessions     map[string]*session
 	repo_locks   map[string]bool
+	server       *gs_ssh.RestrictedServer
+	queue        *submissionQueue
 }
 
-func (rs *RepoSubmissions) getSession(session_id []byte) *session {
-	rs.mtx.Lock()
-	defer rs.mtx.Unlock()
-	if rs.sessions == nil {
-		return nil
+// userId returns the User Id of the connection's user.
+func (rs *RepoSubmissions) userId(meta ssh.ConnMetadata) string {
+	if session := permissionsSession(gs_ssh.Permissions(meta)); session != nil {
+		return session.user.Id
+	}
+	return meta.User()
+}
+
+// identify returns who the connection belongs to, for auditing.
+func (rs *RepoSubmissions) identify(meta ssh.ConnMetadata) (user string,
+	key ssh.PublicKey) {
+	if session := permissionsSession(gs_ssh.Permissions(meta)); session != nil {
+		return session.user.Id, session.key
 	}
-	return rs.sessions[string(session_id)]
+	return "", nil
 }
 
 func (rs *RepoSubmissions) lockRepo(repo_id string) {
@@ -120,7 +230,8 @@ func (rs *RepoSubmissions) repoPath(unique_user_id, repo_name string) string {
 	return fmt.Sprintf("/tmp/submissions/%x", id)
 }
 
-func (rs *RepoSubmissions) getUserRepo(user_repo string, output io.Writer,
+func (rs *RepoSubmissions) getUserRepo(ctx context.Context,
+	user_repo string, output io.Writer,
 	meta ssh.ConnMetadata, key ssh.PublicKey, repo_name string) (
 	path string, err error) {
 	_, err = os.Stat(user_repo)
@@ -136,13 +247,17 @@ func (rs *RepoSubmissions) getUserRepo(user_repo string, output io.Writer,
 	}
 
 	if rs.NewRepoHandler != nil {
-		err = rs.NewRepoHandler(user_repo, output, meta, key, repo_name)
+		hook_ctx, cancel := withTimeout(ctx, rs.NewRepoTimeout)
+		err = rs.NewRepoHandler(hook_ctx, user_repo, output, meta, key,
+			repo_name)
+		reportTimeout(hook_ctx, output, "new repo handler", rs.NewRepoTimeout)
+		cancel()
 		if err != nil {
 			os.RemoveAll(user_repo)
 			return "", err
 		}
 	} else {
-		err = exec.Command(
+		err = exec.CommandContext(ctx,
 			"git", "--git-dir", user_repo, "init", "--bare").Run()
 		if err != nil {
 			os.RemoveAll(user_repo)
@@ -153,15 +268,20 @@ func (rs *RepoSubmissions) getUserRepo(user_repo string, output io.Writer,
 	return user_repo, nil
 }
 
-func (rs *RepoSubmissions) cmdHandler(command string,
-	stdin io.Reader, stdout, stderr io.Writer,
+func (rs *RepoSubmissions) cmdHandler(ctx context.Context, command string,
+	env []string, stdin io.Reader, stdout, stderr io.Writer,
 	meta ssh.ConnMetadata) (exit_status uint32, err error) {
-	defer mon.Task()(nil)(&err)
-	session := rs.getSession(meta.SessionID())
+	defer mon.Task()(&ctx)(&err)
+	session := permissionsSession(gs_ssh.Permissions(meta))
 	if session == nil {
 		panic("unauthorized?")
 	}
+	ctx = context.WithValue(ctx, userKey{}, &session.user)
 	parts := strings.Split(command, " ")
+	switch parts[0] {
+	case "submissions", "submission":
+		return rs.historyHandler(ctx, parts, stdout, stderr, session)
+	}
 	if len(parts) != 2 || (parts[0] != "git-receive-pack" &&
 		parts[0] != "git-upload-pack") {
 		_, err = fmt.Fprintf(stderr, "invalid command: %#v\r\n", command)
@@ -169,10 +289,21 @@ func (rs *RepoSubmissions) cmdHandler(command string,
 	}
 
 	repo_name := strings.Trim(parts[1], "'")
+	auditEvent(ctx).Repo = strings.Trim(repo_name, "/")
+	need := PermissionRead
+	if parts[0] == "git-receive-pack" {
+		need = PermissionWrite
+	}
+	limit := keyLimit(meta, strings.Trim(repo_name, "/"))
+	ok, err := checkedPermission(meta, strings.Trim(repo_name, "/"), limit,
+		need, stderr)
+	if !ok || err != nil {
+		return 1, err
+	}
 
-	repo_path := rs.repoPath(session.unique_user_id, repo_name)
+	repo_path := rs.repoPath(session.user.Id, repo_name)
 	rs.lockRepo(repo_path)
-	user_repo, err := rs.getUserRepo(repo_path, stderr, meta, session.key,
+	user_repo, err := rs.getUserRepo(ctx, repo_path, stderr, meta, session.key,
 		repo_name)
 	if err != nil {
 		rs.unlockRepo(repo_path)
@@ -194,7 +325,7 @@ func (rs *RepoSubmissions) cmdHandler(command string,
 			os_cmd = rs.GitUploadPack
 		}
 		start_time := monotime.Monotonic()
-		cmd := exec.Command(os_cmd, user_repo)
+		cmd := gitCommand(ctx, env, os_cmd, user_repo)
 		cmd.Stdin = stdin
 		cmd.Stdout = stdout
 		cmd.Stderr = stderr
@@ -205,8 +336,12 @@ func (rs *RepoSubmissions) cmdHandler(command string,
 	}
 
 	if rs.PresubmissionHandler != nil {
-		err := rs.PresubmissionHandler(user_repo, stderr, meta, session.key,
-			repo_name)
+		hook_ctx, cancel := withTimeout(ctx, rs.PresubmissionTimeout)
+		err := rs.PresubmissionHandler(hook_ctx, user_repo, stderr, meta,
+			session.key, repo_name)
+		reportTimeout(hook_ctx, stderr, "presubmission check",
+			rs.PresubmissionTimeout)
+		cancel()
 		if err != nil {
 			return 1, err
 		}
@@ -217,82 +352,292 @@ func (rs *RepoSubmissions) cmdHandler(command string,
 	if rs.GitReceivePack != "" {
 		os_cmd = rs.GitReceivePack
 	}
+	if rs.Workers > 0 {
+		// so pushers can use -o nowait
+		env = append(env, "GIT_CONFIG_COUNT=1",
+			"GIT_CONFIG_KEY_0=receive.advertisePushOptions",
+			"GIT_CONFIG_VALUE_0=true")
+	}
 	start_time := monotime.Monotonic()
-	cmd := exec.Command(os_cmd, user_repo)
-	tags := &tagger{Reader: &maxReader{Reader: stdin, Max: rs.MaxPushSize}}
+	started := time.Now()
+	cmd := gitCommand(ctx, env, os_cmd, user_repo)
+	tags := newTagger(&maxReader{Reader: stdin, Max: rs.MaxPushSize},
+		rs.AllowDeletes)
+	status := &statusRewriter{
+		Writer:   stdout,
+		Stderr:   stderr,
+		Commands: &tags.commandList,
+		Rewrite: func(lines []string) []string {
+			return rewriteReport(lines, tags.updates())
+		},
+		Message: tags.submittedMessage}
 	cmd.Stdin = tags
-	cmd.Stdout = stdout
+	cmd.Stdout = status
 	cmd.Stderr = stderr
 
 	exit_status, err = RunExec(cmd)
+	if flush_err := status.Flush(); err == nil {
+		err = flush_err
+	}
 	logger.Noticef("git push: %s %s %s [took %s]", meta.User(), repo_name,
 		user_repo, monotime.Monotonic()-start_time)
-	if err != nil {
+	if err != nil || exit_status != 0 {
 		if tags.Err != nil {
 			fmt.Fprintf(stderr, "error: %s\n", tags.Err)
 		}
 		return exit_status, err
 	}
 
+	if len(tags.PushOptions) > 0 {
+		logger.Infof("git push: %s %s push options: %#v", meta.User(), repo_name,
+			tags.PushOptions)
+	}
+
+	auditEvent(ctx).Refs = tags.updates()
+	auditEvent(ctx).Submission = tags.SubmissionId
+
+	sub := &Submission{
+		Id:       tags.SubmissionId,
+		UserId:   session.user.Id,
+		RepoName: repo_name,
+		Updates:  tags.Updates,
+		Started:  started,
+		RepoPath: user_repo}
+	if rs.Workers > 0 {
+		return rs.enqueue(ctx, sub, stderr, meta, session, tags.PushOptions)
+	}
+	sub.Status = SubmissionRunning
+	rs.recordSubmission(ctx, sub)
+	return rs.runSubmission(ctx, sub, user_repo, stderr, meta, session.key)
+}
+
+// runSubmission calls the SubmissionHandler and records its results.
+func (rs *RepoSubmissions) runSubmission(ctx context.Context, sub *Submission,
+	user_repo string, output io.Writer, meta ssh.ConnMetadata,
+	key ssh.PublicKey) (exit_status uint32, err error) {
+	defer mon.Task()(&ctx)(&err)
 	if rs.SubmissionHandler != nil {
+		captured := &limitedBuffer{Max: rs.maxStoredOutput()}
+		output = io.MultiWriter(captured, output)
+		hook_ctx, cancel := withTimeout(ctx, rs.SubmissionTimeout)
 		start_time := monotime.Monotonic()
-		exit_status, err = rs.SubmissionHandler(user_repo, stderr, meta,
-			session.key, repo_name, tags.NewTags)
+		exit_status, err = rs.SubmissionHandler(hook_ctx, user_repo, output,
+			meta, key, sub.RepoName, sub.Id, sub.Updates)
+		reportTimeout(hook_ctx, output, "submission", rs.SubmissionTimeout)
+		cancel()
 		logger.Infof("processed submission: %s %s %s [took %s]", meta.User(),
-			repo_name, user_repo, monotime.Monotonic()-start_time)
-		return exit_status, err
+			sub.RepoName, user_repo, monotime.Monotonic()-start_time)
+		sub.Output = captured.String()
+		if captured.Truncated {
+			sub.Output += "\n[output truncated]\n"
+		}
+	}
+	sub.Status = SubmissionDone
+	sub.Finished = time.Now()
+	sub.ExitStatus = exit_status
+	if err != nil {
+		sub.Error = err.Error()
+	}
+	rs.recordSubmission(ctx, sub)
+	return exit_status, err
+}
+
+// withTimeout is context.WithTimeout, except that nonpositive timeouts mean
+// no timeout.
+func withTimeout(ctx context.Context, timeout time.Duration) (
+	context.Context, func()) {
+	if timeout <= 0 {
+		return context.WithCancel(ctx)
+	}
+	return context.WithTimeout(ctx, timeout)
+}
+
+// reportTimeout tells the user if what ran with ctx ran out of time.
+func reportTimeout(ctx context.Context, output io.Writer, what string,
+	timeout time.Duration) {
+	if ctx.Err() == context.DeadlineExceeded {
+		fmt.Fprintf(output, "\nerror: %s timed out after %s\n", what, timeout)
+	}
+}
+
+func (rs *RepoSubmissions) maxStoredOutput() int {
+	if rs.MaxStoredOutput > 0 {
+		return rs.MaxStoredOutput
+	}
+	return 64 * 1024
+}
+
+// recordSubmission saves sub to the Store, if there is one. Failing to
+// record a submission doesn't fail the push, so errors are only logged.
+func (rs *RepoSubmissions) recordSubmission(ctx context.Context,
+	sub *Submission) {
+	if rs.Store == nil {
+		return
+	}
+	err := rs.Store.Put(ctx, sub)
+	if err != nil {
+		logger.Errorf("failed recording submission %s: %v", sub.Id, err)
 	}
-	return 0, nil
 }
 
 func (rs *RepoSubmissions) publicKeyCallback(
 	meta ssh.ConnMetadata, key ssh.PublicKey) (rv *ssh.Permissions, err error) {
 	defer mon.Task()(nil)(&err)
 
-	var unique_user_id *string
-	if rs.AuthHandler != nil {
-		unique_user_id, err = rs.AuthHandler(meta, key)
+	handled := false
+	if rs.CertAuthority != nil {
+		rv, handled, err = rs.CertAuthority.authenticateKey(meta, key,
+			rs.KeySource != nil || rs.AuthHandler != nil)
 		if err != nil {
 			return nil, err
 		}
 	}
-	if unique_user_id == nil {
-		id := userIdFromKey(key)
-		unique_user_id = &id
+	if rs.KeySource != nil && !handled {
+		rv, err = authorizeKey(rs.KeySource, meta, key)
+		if err != nil {
+			return nil, err
+		}
 	}
 
-	rs.mtx.Lock()
-	defer rs.mtx.Unlock()
-	if rs.sessions == nil {
-		rs.sessions = make(map[string]*session)
+	var user User
+	if rs.AuthHandler != nil {
+		auth_user, err := rs.authenticate(meta, key)
+		if err != nil {
+			return nil, err
+		}
+		if auth_user != nil {
+			user = *auth_user
+		}
+	}
+	if user.Id == "" && rv != nil {
+		// the certificate principal, if any
+		user.Id = rv.Extensions[userExtension]
+	}
+	if user.Id == "" {
+		user.Id = userIdFromKey(key)
 	}
 
-	session_id := string(meta.SessionID())
-	if _, exists := rs.sessions[session_id]; exists {
-		panic("session should be unique")
+	// the user goes along with the permissions, so that it's the one for the
+	// key the client actually authenticates with, even if it offers several.
+	if rv == nil {
+		rv = keyPermissions(key)
 	}
-	rs.sessions[session_id] = &session{key: key, unique_user_id: *unique_user_id}
-	return nil, nil
+	session, err := json.Marshal(&user)
+	if err != nil {
+		return nil, err
+	}
+	rv.Extensions[sessionExtension] = string(session)
+	return rv, nil
 }
 
-func (rs *RepoSubmissions) sessionEnd(meta ssh.ConnMetadata) {
-	defer mon.Task()(nil)(nil)
-	rs.mtx.Lock()
-	defer rs.mtx.Unlock()
-	if rs.sessions != nil {
-		delete(rs.sessions, string(meta.SessionID()))
+// authenticate runs the AuthHandler, giving up on it after AuthTimeout.
+func (rs *RepoSubmissions) authenticate(meta ssh.ConnMetadata,
+	key ssh.PublicKey) (user *User, err error) {
+	ctx, cancel := withTimeout(context.Background(), rs.AuthTimeout)
+	defer cancel()
+	type result struct {
+		user *User
+		err  error
+	}
+	done := make(chan result, 1)
+	go func() {
+		user, err := rs.AuthHandler(ctx, meta, key)
+		done <- result{user: user, err: err}
+	}()
+	select {
+	case res := <-done:
+		return res.user, res.err
+	case <-ctx.Done():
+		logger.Warnf("auth handler for %s from %s timed out after %s",
+			meta.User(), meta.RemoteAddr(), rs.AuthTimeout)
+		return nil, fmt.Errorf("auth handler timed out")
 	}
 }
 
 func (rs *RepoSubmissions) ListenAndServe(network, address string) (
 	err error) {
+	defer mon.Task()(nil)(&err)
+	listener, err := net.Listen(network, address)
+	if err != nil {
+		return err
+	}
+	return rs.Serve(listener)
+}
+
+// Serve serves connections from all of listeners until Shutdown or Close is
+// called. See gs_ssh.RestrictedServer.ServeListeners.
+func (rs *RepoSubmissions) Serve(listeners ...net.Listener) (err error) {
 	defer mon.Task()(nil)(&err)
 	config := &ssh.ServerConfig{PublicKeyCallback: rs.publicKeyCallback}
 	config.AddHostKey(rs.PrivateKey)
-	return (&gs_ssh.RestrictedServer{
-		SSHConfig:  config,
-		ShellError: rs.ShellError,
-		MOTD:       rs.MOTD,
-		Handler:    rs.cmdHandler,
-		SessionEnd: rs.sessionEnd}).ListenAndServe(network, address)
+
+	if rs.Workers > 0 {
+		err = rs.startQueue()
+		if err != nil {
+			return err
+		}
+	}
+
+	server := rs.getServer()
+	server.SSHConfig = config
+	auditAuth(rs.Audit, "submissions", config, server,
+		func(meta ssh.ConnMetadata, perms *ssh.Permissions) string {
+			if session := permissionsSession(perms); session != nil {
+				return session.user.Id
+			}
+			return ""
+		})
+	server.ShellError = rs.ShellError
+	server.MOTD = rs.MOTD
+	server.Handler = auditCommands(rs.Audit, "submissions", rs.cmdHandler,
+		rs.identify)
+	server.AllowedEnv = gitEnv
+	server.Timeouts = rs.Timeouts
+	server.ProxyProtocol = rs.ProxyProtocol
+	if rs.Limits != nil {
+		limits := *rs.Limits
+		if limits.User == nil {
+			limits.User = rs.userId
+		}
+		server.Limits = &limits
+	}
+	return server.ServeListeners(listeners)
+}
+
+func (rs *RepoSubmissions) getServer() *gs_ssh.RestrictedServer {
+	rs.mtx.Lock()
+	defer rs.mtx.Unlock()
+	if rs.server == nil {
+		rs.server = &gs_ssh.RestrictedServer{}
+	}
+	return rs.server
+}
+
+// Shutdown gracefully stops the server. See gs_ssh.RestrictedServer.Shutdown.
+// In queued mode, running submissions are also given until ctx expires to
+// finish. Submissions still waiting in the queue are picked back up on the
+// next start.
+func (rs *RepoSubmissions) Shutdown(ctx context.Context) error {
+	q := rs.getQueue()
+	if q != nil {
+		// release pushers waiting on submissions that won't start now
+		q.stop()
+	}
+	err := rs.getServer().Shutdown(ctx)
+	if q != nil {
+		if queue_err := q.shutdown(ctx); err == nil {
+			err = queue_err
+		}
+	}
+	return err
+}
+
+// Close forcibly stops the server, and in queued mode, any running
+// submissions.
+func (rs *RepoSubmissions) Close() error {
+	if q := rs.getQueue(); q != nil {
+		q.stop()
+		q.cancel()
+	}
+	return rs.getServer().Close()
 }
@@ -0,0 +1,106 @@
+// Copyright (C) 2014 JT Olds
+// See LICENSE for copying information
+
+package repo
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net"
+	"testing"
+
+	gs_ssh "github.com/jtolds/gitserve/ssh"
+	"golang.org/x/crypto/ssh"
+)
+
+// testKeys is a KeySource with the given entries.
+type testKeys []*AuthorizedKey
+
+func (keys testKeys) Lookup(key ssh.PublicKey) *AuthorizedKey {
+	for _, entry := range keys {
+		if bytes.Equal(entry.Key.Marshal(), key.Marshal()) {
+			return entry
+		}
+	}
+	return nil
+}
+
+// mismatchedSigner makes signatures claiming the wrong algorithm, which
+// servers refuse without hanging up, so clients go on to their next key.
+type mismatchedSigner struct{ ssh.Signer }
+
+func (s mismatchedSigner) Sign(rand io.Reader, data []byte) (
+	*ssh.Signature, error) {
+	sig, err := s.Signer.Sign(rand, data)
+	if err != nil {
+		return nil, err
+	}
+	sig.Format = ssh.KeyAlgoRSA
+	return sig, nil
+}
+
+func TestSubmissionSeveralKeys(t *testing.T) {
+	alice, bob, unknown := testSigner(t), testSigner(t), testSigner(t)
+	rs := &RepoSubmissions{
+		KeySource: testKeys{{Key: alice.PublicKey()}, {Key: bob.PublicKey()}}}
+	config := &ssh.ServerConfig{PublicKeyCallback: rs.publicKeyCallback}
+	config.AddHostKey(testSigner(t))
+	server := &gs_ssh.RestrictedServer{SSHConfig: config,
+		Handler: func(ctx context.Context, command string, env []string,
+			stdin io.Reader, stdout, stderr io.Writer, meta ssh.ConnMetadata) (
+			uint32, error) {
+			user, key := rs.identify(meta)
+			if key == nil {
+				return 1, nil
+			}
+			_, err := io.WriteString(stdout,
+				user+" "+ssh.FingerprintSHA256(key))
+			return 0, err
+		}}
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go server.ServeListeners([]net.Listener{listener})
+	defer server.Close()
+
+	for _, test := range []struct {
+		name    string
+		signers []ssh.Signer
+		user    ssh.PublicKey
+	}{
+		{"one key", []ssh.Signer{alice}, alice.PublicKey()},
+		{"rejected then accepted", []ssh.Signer{unknown, bob},
+			bob.PublicKey()},
+		// alice's key passes the callback but not the signature check, so
+		// the callback runs again for bob on the same connection.
+		{"accepted, rejected, accepted",
+			[]ssh.Signer{mismatchedSigner{alice}, unknown, bob},
+			bob.PublicKey()},
+	} {
+		conn, err := ssh.Dial("tcp", listener.Addr().String(),
+			&ssh.ClientConfig{
+				User:            "git",
+				Auth:            []ssh.AuthMethod{ssh.PublicKeys(test.signers...)},
+				HostKeyCallback: ssh.InsecureIgnoreHostKey()})
+		if err != nil {
+			t.Errorf("%s: %v", test.name, err)
+			continue
+		}
+		session, err := conn.NewSession()
+		if err != nil {
+			conn.Close()
+			t.Errorf("%s: %v", test.name, err)
+			continue
+		}
+		output, err := session.Output("whoami")
+		conn.Close()
+		expected := userIdFromKey(test.user) + " " +
+			ssh.FingerprintSHA256(test.user)
+		if err != nil || string(output) != expected {
+			t.Errorf("%s: got %#v, %v, expected %#v", test.name, string(output),
+				err, expected)
+		}
+	}
+}
@@ -9,110 +9,257 @@ import (
 	"io"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 )
 
 type Ref string
 type Tag string
 
-type tagger struct {
+// RefUpdate is a single ref update command from a push.
+type RefUpdate struct {
+	Old string `json:"old"`
+	New string `json:"new"`
+	Ref Ref    `json:"ref"`
+	// Tag is the submission tag created for this update. It is empty for
+	// deletions.
+	Tag Tag `json:"tag,omitempty"`
+}
+
+func isZeroId(id string) bool { return strings.Trim(id, "0") == "" }
+
+// IsCreate is true if the ref did not exist before the push.
+func (u RefUpdate) IsCreate() bool { return isZeroId(u.Old) }
+
+// IsDelete is true if the push deletes the ref.
+func (u RefUpdate) IsDelete() bool { return isZeroId(u.New) }
+
+// commandList reads the command list, and any push options, a client sends
+// git-receive-pack, and passes them and the rest of the push through.
+type commandList struct {
 	Reader       io.Reader
 	pass_through bool
-	SubmissionId string
-	NewTags      map[Ref][]Tag
 	Err          error
+
+	// Command, if set, is called with each command as it's read. It may
+	// write pkt-lines to extra to send receive-pack after the command, or
+	// return an error to fail the push.
+	Command func(update RefUpdate, extra io.Writer) error
+
+	// Capabilities are the capabilities the client requested, normally on
+	// its first command line.
+	Capabilities []string
+	// PushOptions are any push options (git push -o) the client sent, if the
+	// push-options capability was negotiated.
+	PushOptions []string
+
+	// mtx protects Capabilities (and tagger's Updates) while receive-pack is
+	// running, since they are read from the goroutine copying its stdout.
+	mtx sync.Mutex
 }
 
-func (t *tagger) Read(p []byte) (n int, err error) {
-	if t.Err != nil {
-		return 0, t.Err
+type tagger struct {
+	commandList
+	SubmissionId string
+	Updates      []RefUpdate
+
+	// if false, pushes that delete refs are rejected. otherwise, deletions are
+	// passed through and recorded in Updates without a Tag.
+	AllowDeletes bool
+}
+
+func newTagger(r io.Reader, allow_deletes bool) *tagger {
+	t := &tagger{
+		SubmissionId: fmt.Sprint(time.Now().UnixNano()),
+		AllowDeletes: allow_deletes}
+	t.Reader = r
+	t.Command = t.tagCommand
+	return t
+}
+
+// readPktLine reads a single pkt-line, returning its payload. A flush-pkt
+// returns a nil payload.
+func readPktLine(r io.Reader) (payload []byte, err error) {
+	var size_packed [4]byte
+	_, err = io.ReadFull(r, size_packed[:])
+	if err != nil {
+		return nil, err
 	}
-	if t.pass_through {
-		return t.Reader.Read(p)
+	size, err := strconv.ParseUint(string(size_packed[:]), 16, 16)
+	if err != nil {
+		return nil, err
 	}
-	if t.SubmissionId == "" {
-		t.SubmissionId = fmt.Sprint(time.Now().UnixNano())
+	if size == 0 {
+		return nil, nil
 	}
-	if t.NewTags == nil {
-		t.NewTags = make(map[Ref][]Tag)
+	if size < 4 {
+		return nil, fmt.Errorf("protocol error: bad pkt-line length %d", size)
+	}
+	payload = make([]byte, size-4)
+	_, err = io.ReadFull(r, payload)
+	if err != nil {
+		return nil, err
+	}
+	return payload, nil
+}
+
+// writePktLine writes payload as a single pkt-line. A nil payload writes a
+// flush-pkt.
+func writePktLine(w io.Writer, payload []byte) (err error) {
+	if payload == nil {
+		_, err = io.WriteString(w, "0000")
+		return err
+	}
+	size := fmt.Sprintf("%04x", len(payload)+4)
+	if len(size) != 4 {
+		return fmt.Errorf("pkt-line too long")
+	}
+	_, err = io.WriteString(w, size)
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(payload)
+	return err
+}
+
+func (c *commandList) hasCapability(name string) bool {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	for _, capability := range c.Capabilities {
+		if capability == name {
+			return true
+		}
+	}
+	return false
+}
+
+func (t *tagger) updates() []RefUpdate {
+	t.mtx.Lock()
+	defer t.mtx.Unlock()
+	return append([]RefUpdate(nil), t.Updates...)
+}
+
+func (t *tagger) addUpdate(update RefUpdate) {
+	t.mtx.Lock()
+	t.Updates = append(t.Updates, update)
+	t.mtx.Unlock()
+}
+
+// tagCommand adds a submission tag for each pushed ref.
+func (t *tagger) tagCommand(update RefUpdate, extra io.Writer) error {
+	if strings.HasPrefix(string(update.Ref), "refs/tags/submissions/") {
+		return fmt.Errorf("pushing submission tags disallowed")
+	}
+
+	if update.IsDelete() {
+		if !t.AllowDeletes {
+			return fmt.Errorf("deleting %s disallowed", update.Ref)
+		}
+		t.addUpdate(update)
+		return nil
+	}
+
+	update.Tag = Tag(fmt.Sprintf("submissions/%s/%s", t.SubmissionId,
+		update.Ref))
+	new_ref := fmt.Sprintf("%s %s refs/tags/%s\n",
+		strings.Repeat("0", len(update.New)), update.New, update.Tag)
+	err := writePktLine(extra, []byte(new_ref))
+	if err != nil {
+		return fmt.Errorf("tag name too long")
+	}
+	t.addUpdate(update)
+	return nil
+}
+
+func (c *commandList) Read(p []byte) (n int, err error) {
+	if c.Err != nil {
+		return 0, c.Err
+	}
+	if c.pass_through {
+		return c.Reader.Read(p)
 	}
 	var buf bytes.Buffer
 	for {
-		var size_packed [4]byte
-		_, err = io.ReadFull(t.Reader, size_packed[:])
-		if err != nil {
-			return 0, err
+		line, err := readPktLine(c.Reader)
+		if err == io.EOF && buf.Len() > 0 {
+			// the command list was cut off
+			err = io.ErrUnexpectedEOF
 		}
-		size, err := strconv.ParseUint(string(size_packed[:]), 16, 16)
 		if err != nil {
 			return 0, err
 		}
-		if size == 0 {
+		if line == nil {
 			break
 		}
-		_, err = buf.Write(size_packed[:])
+		err = writePktLine(&buf, line)
 		if err != nil {
 			return 0, err
 		}
-		line := make([]byte, size-4)
-		_, err = io.ReadFull(t.Reader, line)
-		if err != nil {
-			return 0, err
-		}
-		_, err = buf.Write(line)
-		if err != nil {
-			return 0, err
+
+		parseable_part := strings.TrimSuffix(string(line), "\n")
+		if strings.HasPrefix(parseable_part, "shallow ") {
+			// shallow clients announce their shallow commits before the commands
+			continue
 		}
 
-		var fields []string
-		parseable_part := string(line)
+		// the first command carries capabilities, after a NUL byte. git
+		// accepts them on any command, and ends every command at a NUL, so we
+		// do too.
 		null_index := strings.Index(parseable_part, "\x00")
 		if null_index >= 0 {
-			fields = strings.Fields(
-				parseable_part[:null_index])
+			c.mtx.Lock()
+			c.Capabilities = append(c.Capabilities,
+				strings.Fields(parseable_part[null_index+1:])...)
+			c.mtx.Unlock()
+			parseable_part = parseable_part[:null_index]
 		}
+
+		// commands are of the form <old-id> <new-id> <ref>
+		fields := strings.Fields(parseable_part)
 		if len(fields) != 3 {
-			t.Err = fmt.Errorf(
+			c.Err = fmt.Errorf(
 				"protocol error: unexpected amount of fields in pkt-line: %#v",
 				parseable_part)
-			return 0, t.Err
-		}
-
-		if strings.HasPrefix(fields[2], "refs/tags/submissions/") {
-			t.Err = fmt.Errorf("pushing submission tags disallowed")
-			return 0, t.Err
-		}
-
-		new_ref := fmt.Sprintf(
-			"0000000000000000000000000000000000000000 %s "+
-				"refs/tags/submissions/%s/%s\n", fields[1], t.SubmissionId, fields[2])
-
-		new_size := fmt.Sprintf("%04x", len(new_ref)+4)
-		if len(new_size) != 4 {
-			t.Err = fmt.Errorf("tag name too long")
-			return 0, t.Err
-		}
-
-		_, err = buf.Write([]byte(new_size))
-		if err != nil {
-			return 0, err
+			return 0, c.Err
 		}
-
-		_, err = buf.Write([]byte(new_ref))
-		if err != nil {
-			return 0, err
+		if c.Command != nil {
+			err = c.Command(
+				RefUpdate{Old: fields[0], New: fields[1], Ref: Ref(fields[2])},
+				&buf)
+			if err != nil {
+				c.Err = err
+				return 0, c.Err
+			}
 		}
-
-		t.NewTags[Ref(fields[1])] = append(t.NewTags[Ref(fields[1])],
-			Tag(fmt.Sprintf("submissions/%s/%s", t.SubmissionId, fields[2])))
 	}
 
-	_, err = buf.Write([]byte("0000"))
+	err = writePktLine(&buf, nil)
 	if err != nil {
 		return 0, err
 	}
 
-	t.Reader = io.MultiReader(&buf, t.Reader)
-	t.pass_through = true
-	return t.Reader.Read(p)
+	if c.hasCapability("push-options") {
+		for {
+			line, err := readPktLine(c.Reader)
+			if err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			if err != nil {
+				return 0, err
+			}
+			err = writePktLine(&buf, line)
+			if err != nil {
+				return 0, err
+			}
+			if line == nil {
+				break
+			}
+			c.PushOptions = append(c.PushOptions,
+				strings.TrimSuffix(string(line), "\n"))
+		}
+	}
+
+	c.Reader = io.MultiReader(&buf, c.Reader)
+	c.pass_through = true
+	return c.Reader.Read(p)
 }
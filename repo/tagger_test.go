@@ -0,0 +1,339 @@
+// Copyright (C) 2014 JT Olds
+// See LICENSE for copying information
+
+package repo
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestReadPktLine(t *testing.T) {
+	for _, test := range []struct {
+		in      string
+		payload []byte
+		rest    string
+		err     bool
+	}{
+		{in: "0000", payload: nil},
+		{in: "0004", payload: []byte{}},
+		{in: "0009hello", payload: []byte("hello")},
+		{in: "0009hellorest", payload: []byte("hello"), rest: "rest"},
+		{in: "000ahello\n", payload: []byte("hello\n")},
+		{in: "0001", err: true},
+		{in: "0003", err: true},
+		{in: "zzzz", err: true},
+		{in: "000", err: true},
+		{in: "", err: true},
+		{in: "0009hell", err: true},
+	} {
+		r := strings.NewReader(test.in)
+		payload, err := readPktLine(r)
+		if test.err {
+			if err == nil {
+				t.Errorf("%#v: expected error, got %#v", test.in, string(payload))
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%#v: unexpected error: %v", test.in, err)
+			continue
+		}
+		if (payload == nil) != (test.payload == nil) ||
+			!bytes.Equal(payload, test.payload) {
+			t.Errorf("%#v: got %#v, expected %#v", test.in, payload, test.payload)
+		}
+		rest, _ := ioutil.ReadAll(r)
+		if string(rest) != test.rest {
+			t.Errorf("%#v: left %#v, expected %#v", test.in, string(rest),
+				test.rest)
+		}
+	}
+}
+
+func TestWritePktLine(t *testing.T) {
+	for _, test := range []struct {
+		payload []byte
+		out     string
+		err     bool
+	}{
+		{payload: nil, out: "0000"},
+		{payload: []byte{}, out: "0004"},
+		{payload: []byte("hello\n"), out: "000ahello\n"},
+		{payload: make([]byte, 0xffff-4), out: "ffff" +
+			string(make([]byte, 0xffff-4))},
+		{payload: make([]byte, 0xffff-3), err: true},
+	} {
+		var out bytes.Buffer
+		err := writePktLine(&out, test.payload)
+		if test.err {
+			if err == nil {
+				t.Errorf("%d bytes: expected error", len(test.payload))
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%d bytes: unexpected error: %v", len(test.payload), err)
+			continue
+		}
+		if out.String() != test.out {
+			t.Errorf("%d bytes: got %#v", len(test.payload), out.String())
+		}
+		if test.payload == nil {
+			continue
+		}
+		payload, err := readPktLine(&out)
+		if err != nil || !bytes.Equal(payload, test.payload) {
+			t.Errorf("%d bytes: didn't round trip: %v", len(test.payload), err)
+		}
+	}
+}
+
+// pkt encodes lines as pkt-lines. An empty line is a flush-pkt.
+func pkt(lines ...string) string {
+	var buf bytes.Buffer
+	for _, line := range lines {
+		if line == "" {
+			writePktLine(&buf, nil)
+			continue
+		}
+		writePktLine(&buf, []byte(line))
+	}
+	return buf.String()
+}
+
+const (
+	zeroId = "0000000000000000000000000000000000000000"
+	oldId  = "1111111111111111111111111111111111111111"
+	newId  = "2222222222222222222222222222222222222222"
+)
+
+func TestCommandList(t *testing.T) {
+	for _, test := range []struct {
+		name         string
+		in           string
+		updates      []RefUpdate
+		capabilities []string
+		options      []string
+		err          bool
+	}{
+		{
+			name: "single command",
+			in: pkt(oldId+" "+newId+" refs/heads/master\x00report-status "+
+				"side-band-64k\n", "") + "PACK...",
+			updates: []RefUpdate{
+				{Old: oldId, New: newId, Ref: "refs/heads/master"}},
+			capabilities: []string{"report-status", "side-band-64k"},
+		},
+		{
+			name: "several commands",
+			in: pkt(zeroId+" "+newId+" refs/heads/a\x00report-status\n",
+				oldId+" "+zeroId+" refs/heads/b\n",
+				oldId+" "+newId+" refs/tags/c", ""),
+			updates: []RefUpdate{
+				{Old: zeroId, New: newId, Ref: "refs/heads/a"},
+				{Old: oldId, New: zeroId, Ref: "refs/heads/b"},
+				{Old: oldId, New: newId, Ref: "refs/tags/c"}},
+			capabilities: []string{"report-status"},
+		},
+		{
+			name: "no capabilities",
+			in:   pkt(oldId+" "+newId+" refs/heads/master\n", ""),
+			updates: []RefUpdate{
+				{Old: oldId, New: newId, Ref: "refs/heads/master"}},
+		},
+		{
+			name: "shallow",
+			in: pkt("shallow "+oldId+"\n", "shallow "+newId+"\n",
+				oldId+" "+newId+" refs/heads/master\x00report-status\n", ""),
+			updates: []RefUpdate{
+				{Old: oldId, New: newId, Ref: "refs/heads/master"}},
+			capabilities: []string{"report-status"},
+		},
+		{
+			name: "push options",
+			in: pkt(oldId+" "+newId+" refs/heads/master\x00push-options\n", "",
+				"ci.skip\n", "reviewer=jt\n", "") + "PACK...",
+			updates: []RefUpdate{
+				{Old: oldId, New: newId, Ref: "refs/heads/master"}},
+			capabilities: []string{"push-options"},
+			options:      []string{"ci.skip", "reviewer=jt"},
+		},
+		{
+			name: "push options missing flush",
+			in: pkt(oldId+" "+newId+" refs/heads/master\x00push-options\n", "",
+				"ci.skip\n"),
+			updates: []RefUpdate{
+				{Old: oldId, New: newId, Ref: "refs/heads/master"}},
+			err: true,
+		},
+		{
+			name: "push options not negotiated",
+			in: pkt(oldId+" "+newId+" refs/heads/master\n", "",
+				"ci.skip\n", ""),
+			updates: []RefUpdate{
+				{Old: oldId, New: newId, Ref: "refs/heads/master"}},
+		},
+		{
+			name: "capabilities on a later command",
+			in: pkt(oldId+" "+newId+" refs/heads/a\x00report-status\n",
+				oldId+" "+newId+" refs/heads/b\x00side-band-64k\n", ""),
+			updates: []RefUpdate{
+				{Old: oldId, New: newId, Ref: "refs/heads/a"},
+				{Old: oldId, New: newId, Ref: "refs/heads/b"}},
+			capabilities: []string{"report-status", "side-band-64k"},
+		},
+		{
+			name: "too few fields",
+			in:   pkt(oldId+" refs/heads/master\n", ""),
+			err:  true,
+		},
+		{
+			name: "too many fields",
+			in:   pkt(oldId+" "+newId+" refs/heads/master extra\n", ""),
+			err:  true,
+		},
+		{
+			name: "truncated",
+			in:   pkt(oldId + " " + newId + " refs/heads/master\n")[:20],
+			err:  true,
+		},
+		{
+			name: "missing flush",
+			in:   pkt(oldId + " " + newId + " refs/heads/master\n"),
+			updates: []RefUpdate{
+				{Old: oldId, New: newId, Ref: "refs/heads/master"}},
+			err: true,
+		},
+	} {
+		var updates []RefUpdate
+		commands := &commandList{
+			Reader: strings.NewReader(test.in),
+			Command: func(update RefUpdate, extra io.Writer) error {
+				updates = append(updates, update)
+				return nil
+			}}
+		out, err := ioutil.ReadAll(commands)
+		if !reflect.DeepEqual(updates, test.updates) {
+			t.Errorf("%s: got updates %#v, expected %#v", test.name, updates,
+				test.updates)
+		}
+		if test.err {
+			if err == nil {
+				t.Errorf("%s: expected error", test.name)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: unexpected error: %v", test.name, err)
+			continue
+		}
+		if string(out) != test.in {
+			t.Errorf("%s: passed through %#v, expected %#v", test.name,
+				string(out), test.in)
+		}
+		if !reflect.DeepEqual(commands.Capabilities, test.capabilities) {
+			t.Errorf("%s: got capabilities %#v, expected %#v", test.name,
+				commands.Capabilities, test.capabilities)
+		}
+		if !reflect.DeepEqual(commands.PushOptions, test.options) {
+			t.Errorf("%s: got push options %#v, expected %#v", test.name,
+				commands.PushOptions, test.options)
+		}
+	}
+}
+
+func TestCommandListError(t *testing.T) {
+	commands := &commandList{
+		Reader: strings.NewReader(pkt(oldId+" "+newId+" refs/heads/a\n",
+			oldId+" "+newId+" refs/heads/b\n", "")),
+		Command: func(update RefUpdate, extra io.Writer) error {
+			if update.Ref == "refs/heads/b" {
+				return fmt.Errorf("no")
+			}
+			return nil
+		}}
+	_, err := ioutil.ReadAll(commands)
+	if err == nil || err.Error() != "no" {
+		t.Fatalf("expected the Command's error, got %v", err)
+	}
+	// the error sticks
+	_, err = commands.Read(make([]byte, 10))
+	if err == nil || err.Error() != "no" {
+		t.Fatalf("expected the Command's error again, got %v", err)
+	}
+}
+
+func TestTagger(t *testing.T) {
+	for _, test := range []struct {
+		name          string
+		in            string
+		allow_deletes bool
+		out           string
+		updates       []RefUpdate
+		err           bool
+	}{
+		{
+			name: "tags each ref",
+			in: pkt(oldId+" "+newId+" refs/heads/master\x00report-status\n",
+				zeroId+" "+newId+" refs/heads/dev\n", "") + "PACK",
+			out: pkt(oldId+" "+newId+" refs/heads/master\x00report-status\n",
+				zeroId+" "+newId+" refs/tags/submissions/1/refs/heads/master\n",
+				zeroId+" "+newId+" refs/heads/dev\n",
+				zeroId+" "+newId+" refs/tags/submissions/1/refs/heads/dev\n",
+				"") + "PACK",
+			updates: []RefUpdate{
+				{Old: oldId, New: newId, Ref: "refs/heads/master",
+					Tag: "submissions/1/refs/heads/master"},
+				{Old: zeroId, New: newId, Ref: "refs/heads/dev",
+					Tag: "submissions/1/refs/heads/dev"}},
+		},
+		{
+			name: "deletes disallowed",
+			in:   pkt(oldId+" "+zeroId+" refs/heads/master\n", ""),
+			err:  true,
+		},
+		{
+			name:          "deletes allowed",
+			in:            pkt(oldId+" "+zeroId+" refs/heads/master\n", ""),
+			allow_deletes: true,
+			out:           pkt(oldId+" "+zeroId+" refs/heads/master\n", ""),
+			updates: []RefUpdate{
+				{Old: oldId, New: zeroId, Ref: "refs/heads/master"}},
+		},
+		{
+			name: "submission tags disallowed",
+			in: pkt(zeroId+" "+newId+
+				" refs/tags/submissions/1/refs/heads/master\n", ""),
+			allow_deletes: true,
+			err:           true,
+		},
+	} {
+		tagger := newTagger(strings.NewReader(test.in), test.allow_deletes)
+		tagger.SubmissionId = "1"
+		out, err := ioutil.ReadAll(tagger)
+		if test.err {
+			if err == nil {
+				t.Errorf("%s: expected error", test.name)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: unexpected error: %v", test.name, err)
+			continue
+		}
+		if string(out) != test.out {
+			t.Errorf("%s: got %#v, expected %#v", test.name, string(out),
+				test.out)
+		}
+		if !reflect.DeepEqual(tagger.updates(), test.updates) {
+			t.Errorf("%s: got updates %#v, expected %#v", test.name,
+				tagger.updates(), test.updates)
+		}
+	}
+}
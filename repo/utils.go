@@ -5,10 +5,14 @@ package repo
 
 import (
 	"bytes"
+	"context"
 	"fmt"
 	"io"
+	"os"
 	"os/exec"
+	"syscall"
 
+	gs_ssh "github.com/jtolds/gitserve/ssh"
 	"github.com/spacemonkeygo/spacelog"
 	"golang.org/x/crypto/ssh"
 	"gopkg.in/spacemonkeygo/monkit.v2"
@@ -19,6 +23,21 @@ var (
 	mon    = monkit.Package()
 )
 
+// gitEnv lists the environment variables clients may pass through to git.
+// GIT_PROTOCOL is how clients negotiate wire protocol v2.
+var gitEnv = []string{"GIT_PROTOCOL"}
+
+// gitCommand builds a git subprocess with the given client-requested
+// environment variables added to ours.
+func gitCommand(ctx context.Context, env []string, name string,
+	args ...string) *exec.Cmd {
+	cmd := exec.CommandContext(ctx, name, args...)
+	if len(env) > 0 {
+		cmd.Env = append(os.Environ(), env...)
+	}
+	return cmd
+}
+
 type maxReader struct {
 	Reader io.Reader
 	Pos    int64
@@ -34,6 +53,25 @@ func (m *maxReader) Read(p []byte) (n int, err error) {
 	return n, err
 }
 
+// limitedBuffer keeps the first Max bytes written to it and discards the
+// rest. Writes always succeed.
+type limitedBuffer struct {
+	bytes.Buffer
+	Max       int
+	Truncated bool
+}
+
+func (l *limitedBuffer) Write(p []byte) (n int, err error) {
+	if room := l.Max - l.Buffer.Len(); len(p) > room {
+		l.Truncated = true
+		if room > 0 {
+			l.Buffer.Write(p[:room])
+		}
+		return len(p), nil
+	}
+	return l.Buffer.Write(p)
+}
+
 func LoadAuthorizedKeys(data []byte) (rv []ssh.PublicKey, err error) {
 	data = bytes.TrimSpace(data)
 	for len(data) > 0 {
@@ -47,14 +85,58 @@ func LoadAuthorizedKeys(data []byte) (rv []ssh.PublicKey, err error) {
 	return rv, nil
 }
 
-// RunExec will return a 0 exit status if err is nil
+// signalNames maps signals to the names RFC 4254 uses for exit-signal.
+var signalNames = map[syscall.Signal]string{
+	syscall.SIGABRT: "ABRT",
+	syscall.SIGALRM: "ALRM",
+	syscall.SIGFPE:  "FPE",
+	syscall.SIGHUP:  "HUP",
+	syscall.SIGILL:  "ILL",
+	syscall.SIGINT:  "INT",
+	syscall.SIGKILL: "KILL",
+	syscall.SIGPIPE: "PIPE",
+	syscall.SIGQUIT: "QUIT",
+	syscall.SIGSEGV: "SEGV",
+	syscall.SIGTERM: "TERM",
+}
+
+func signalName(sig syscall.Signal) string {
+	if name, ok := signalNames[sig]; ok {
+		return name
+	}
+	// RFC 4254 allows nonstandard signal names in the form name@domain
+	return fmt.Sprintf("%d@gitserve", int(sig))
+}
+
+// RunExec runs cmd and returns its exit status. A command that ran and
+// exited on its own returns its exit status and a nil error, even if the
+// status is nonzero. If the command was killed by a signal, err will be a
+// *gs_ssh.ExitSignal, which RestrictedServer relays to the client. Any other
+// error means the command could not be run at all.
 func RunExec(cmd *exec.Cmd) (exit_status uint32, err error) {
-	err = cmd.Run()
-	if err != nil {
-		// TODO: huh, os/exec doesn't actually let me see the exit status?
-		//  exec.ExitError/os.ProcessState seems like they should, but
-		//  cross-platform compatibility i guess?
+	return execExitStatus(cmd.Run())
+}
+
+// execExitStatus interprets the error from exec.Cmd's Run or Wait the way
+// RunExec documents.
+func execExitStatus(err error) (exit_status uint32, e error) {
+	if err == nil {
+		return 0, nil
+	}
+	exit_err, ok := err.(*exec.ExitError)
+	if !ok {
+		return 1, err
+	}
+	status, ok := exit_err.Sys().(syscall.WaitStatus)
+	if ok && status.Signaled() {
+		return 1, &gs_ssh.ExitSignal{
+			Signal:     signalName(status.Signal()),
+			CoreDumped: status.CoreDump(),
+			Message:    status.Signal().String()}
+	}
+	code := exit_err.ExitCode()
+	if code < 0 {
 		return 1, err
 	}
-	return 0, nil
+	return uint32(code), nil
 }
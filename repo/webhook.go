@@ -0,0 +1,511 @@
+// Copyright (C) 2014 JT Olds
+// See LICENSE for copying information
+
+package repo
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Webhook is an HTTP endpoint that's told about pushes to the repos
+// matching Pattern.
+type Webhook struct {
+	// Pattern matches repo names, like an ACL's repo patterns.
+	Pattern string
+	URL     string
+	// If set, payloads are signed with it. See SignWebhook.
+	Secret string
+}
+
+// WebhookTargets decides which Webhooks a push to repo goes to. repo is as
+// for ACL.Permission.
+type WebhookTargets interface {
+	Webhooks(repo string) []Webhook
+}
+
+// WebhookPayload is what a Webhook gets POSTed, as JSON.
+type WebhookPayload struct {
+	// Id is the same for every attempt to deliver the same payload.
+	Id   string    `json:"id"`
+	Time time.Time `json:"time"`
+	Repo string    `json:"repo"`
+	// User is who pushed, as in AuditEvent.
+	User string `json:"user,omitempty"`
+	// Key is the SHA256 fingerprint of the pusher's key.
+	Key string `json:"key,omitempty"`
+	// Updates are the ref updates the push made.
+	Updates []RefUpdate `json:"updates"`
+}
+
+// WebhookDelivery records one attempt to deliver a WebhookPayload.
+type WebhookDelivery struct {
+	Time    time.Time `json:"time"`
+	Id      string    `json:"id"`
+	Repo    string    `json:"repo"`
+	URL     string    `json:"url"`
+	Attempt int       `json:"attempt"`
+	// Status is the HTTP status code the endpoint responded with, if any.
+	Status          int     `json:"status,omitempty"`
+	Error           string  `json:"error,omitempty"`
+	DurationSeconds float64 `json:"duration_seconds"`
+	// Delivered is true if the attempt succeeded.
+	Delivered bool `json:"delivered"`
+	// Retrying is true if the attempt failed and there'll be another.
+	Retrying bool `json:"retrying,omitempty"`
+}
+
+// Webhook requests have these headers, besides Content-Type.
+const (
+	WebhookEventHeader     = "X-Gitserve-Event"
+	WebhookDeliveryHeader  = "X-Gitserve-Delivery"
+	WebhookSignatureHeader = "X-Gitserve-Signature"
+)
+
+// SignWebhook returns the WebhookSignatureHeader value for body, which is
+// "sha256=" followed by the hex HMAC-SHA256 of body keyed with secret.
+func SignWebhook(secret string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// VerifyWebhook returns true if signature is body's WebhookSignatureHeader
+// value.
+func VerifyWebhook(secret string, body []byte, signature string) bool {
+	return hmac.Equal([]byte(SignWebhook(secret, body)), []byte(signature))
+}
+
+// WebhookSender delivers webhooks for pushes to RepoHosting repos.
+// Deliveries happen in the background, after the push is done. Failed
+// deliveries are retried with exponential backoff, if the endpoint can't be
+// reached or responds with a 5xx or 429 status. Other statuses outside of
+// 2xx fail the delivery for good.
+type WebhookSender struct {
+	Targets WebhookTargets
+	// If nil, a client with a 30 second timeout is used.
+	Client *http.Client
+	// How many times to try each delivery. Defaults to 5.
+	MaxAttempts int
+	// How long to wait before the first retry. Each retry after that waits
+	// twice as long as the last. Defaults to 5 seconds.
+	RetryDelay time.Duration
+	// If set, is called with every delivery attempt.
+	DeliveryLog func(delivery *WebhookDelivery)
+
+	pending sync.WaitGroup
+	mtx     sync.Mutex
+	ctx     context.Context
+	cancel  func()
+	closed  bool
+}
+
+const (
+	defaultWebhookAttempts   = 5
+	defaultWebhookRetryDelay = 5 * time.Second
+)
+
+var defaultWebhookClient = &http.Client{
+	Timeout: 30 * time.Second,
+	// redirects would turn the POST into a GET
+	CheckRedirect: func(*http.Request, []*http.Request) error {
+		return http.ErrUseLastResponse
+	}}
+
+// pushed sends webhooks about updates to repo, in the background.
+func (s *WebhookSender) pushed(repo, user, key string, updates []RefUpdate) {
+	for _, hook := range s.Targets.Webhooks(repo) {
+		id, err := webhookId()
+		if err != nil {
+			logger.Errorf("webhook for %#v: %v", repo, err)
+			continue
+		}
+		body, err := json.Marshal(&WebhookPayload{
+			Id:      id,
+			Time:    time.Now(),
+			Repo:    repo,
+			User:    user,
+			Key:     key,
+			Updates: updates})
+		if err != nil {
+			logger.Errorf("webhook for %#v: %v", repo, err)
+			continue
+		}
+		s.mtx.Lock()
+		if s.closed {
+			s.mtx.Unlock()
+			logger.Warnf("webhook %s for %#v to %s dropped: shutting down", id,
+				repo, redactURL(hook.URL))
+			continue
+		}
+		s.init()
+		ctx := s.ctx
+		s.pending.Add(1)
+		s.mtx.Unlock()
+		go func(hook Webhook) {
+			defer s.pending.Done()
+			s.deliver(ctx, hook, id, repo, body)
+		}(hook)
+	}
+}
+
+// init sets up the context for deliveries, which is canceled if Wait gives
+// up on them. s.mtx must be held.
+func (s *WebhookSender) init() {
+	if s.ctx == nil {
+		s.ctx, s.cancel = context.WithCancel(context.Background())
+	}
+}
+
+func webhookId() (string, error) {
+	var id [16]byte
+	_, err := rand.Read(id[:])
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(id[:]), nil
+}
+
+// deliver sends body to hook, retrying as needed, until ctx is canceled.
+func (s *WebhookSender) deliver(ctx context.Context, hook Webhook, id,
+	repo string, body []byte) {
+	attempts := s.MaxAttempts
+	if attempts <= 0 {
+		attempts = defaultWebhookAttempts
+	}
+	delay := s.RetryDelay
+	if delay <= 0 {
+		delay = defaultWebhookRetryDelay
+	}
+	for attempt := 1; ; attempt++ {
+		delivery := &WebhookDelivery{
+			Time:    time.Now(),
+			Id:      id,
+			Repo:    repo,
+			URL:     redactURL(hook.URL),
+			Attempt: attempt}
+		retry := s.attempt(ctx, hook, id, body, delivery)
+		delivery.DurationSeconds = time.Since(delivery.Time).Seconds()
+		delivery.Retrying = retry && attempt < attempts && ctx.Err() == nil
+		if delivery.Delivered {
+			mon.Meter("webhooks_delivered").Mark(1)
+		} else {
+			mon.Meter("webhook_failures").Mark(1)
+			logger.Warnf("webhook %s for %#v to %s failed (attempt %d): %s",
+				id, repo, delivery.URL, attempt, delivery.Error)
+		}
+		if s.DeliveryLog != nil {
+			s.DeliveryLog(delivery)
+		}
+		if !delivery.Retrying {
+			return
+		}
+		timer := time.NewTimer(delay)
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+			logger.Warnf("webhook %s for %#v to %s abandoned: %v", id, repo,
+				delivery.URL, ctx.Err())
+			return
+		}
+		delay *= 2
+	}
+}
+
+// attempt tries to deliver body to hook once, filling in delivery. It
+// returns true if a failed attempt should be retried.
+func (s *WebhookSender) attempt(ctx context.Context, hook Webhook,
+	id string, body []byte, delivery *WebhookDelivery) (retry bool) {
+	req, err := http.NewRequestWithContext(ctx, "POST", hook.URL,
+		bytes.NewReader(body))
+	if err != nil {
+		delivery.Error = err.Error()
+		return false
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "gitserve-webhook")
+	req.Header.Set(WebhookEventHeader, "push")
+	req.Header.Set(WebhookDeliveryHeader, id)
+	if hook.Secret != "" {
+		req.Header.Set(WebhookSignatureHeader, SignWebhook(hook.Secret, body))
+	}
+	client := s.Client
+	if client == nil {
+		client = defaultWebhookClient
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		// the client leaves passwords out of its errors
+		delivery.Error = err.Error()
+		return true
+	}
+	defer resp.Body.Close()
+	ioutil.ReadAll(resp.Body)
+	delivery.Status = resp.StatusCode
+	if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+		delivery.Delivered = true
+		return false
+	}
+	delivery.Error = resp.Status
+	return resp.StatusCode >= 500 ||
+		resp.StatusCode == http.StatusTooManyRequests
+}
+
+// redactURL hides any password in raw_url, so that it can be logged.
+func redactURL(raw_url string) string {
+	u, err := url.Parse(raw_url)
+	if err != nil {
+		return raw_url
+	}
+	return u.Redacted()
+}
+
+// Wait waits for deliveries in progress, including their retries, to
+// finish, or for ctx to be canceled. In that case, the deliveries are given
+// up on. Pushes after Wait is called don't get webhooks.
+func (s *WebhookSender) Wait(ctx context.Context) error {
+	s.mtx.Lock()
+	s.closed = true
+	s.mtx.Unlock()
+	done := make(chan struct{})
+	go func() {
+		s.pending.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		s.mtx.Lock()
+		s.init()
+		s.cancel()
+		s.mtx.Unlock()
+		return ctx.Err()
+	}
+}
+
+// StaticWebhooks are WebhookTargets read from a config file by
+// ParseWebhooks.
+type StaticWebhooks []Webhook
+
+var _ WebhookTargets = StaticWebhooks(nil)
+
+// Webhooks returns the hooks whose Pattern matches repo.
+func (hooks StaticWebhooks) Webhooks(repo string) (matched []Webhook) {
+	for _, hook := range hooks {
+		if ok, _ := path.Match(hook.Pattern, repo); ok {
+			matched = append(matched, hook)
+		}
+	}
+	return matched
+}
+
+// ParseWebhooks parses a webhook config file. Blank lines and lines
+// starting with # are ignored. Other lines are
+//
+//	<repo pattern> <url> [<secret>]
+//
+// Every matching line gets a webhook for a push.
+func ParseWebhooks(data []byte) (StaticWebhooks, error) {
+	var hooks StaticWebhooks
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for lineno := 1; scanner.Scan(); lineno++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Fields(line)
+		if len(fields) < 2 || len(fields) > 3 {
+			return nil, fmt.Errorf("line %d: expected <repo pattern> <url> "+
+				"[<secret>]", lineno)
+		}
+		if _, err := path.Match(fields[0], ""); err != nil {
+			return nil, fmt.Errorf("line %d: bad pattern %#v", lineno, fields[0])
+		}
+		u, err := url.Parse(fields[1])
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") ||
+			u.Host == "" {
+			return nil, fmt.Errorf("line %d: bad url", lineno)
+		}
+		hook := Webhook{Pattern: fields[0], URL: fields[1]}
+		if len(fields) == 3 {
+			hook.Secret = fields[2]
+		}
+		hooks = append(hooks, hook)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return hooks, nil
+}
+
+// WebhooksFile is WebhookTargets backed by a webhook config file, which can
+// be reloaded while it's in use. If reloading fails, the last successfully
+// loaded version stays in effect.
+type WebhooksFile struct {
+	Path string
+
+	mtx   sync.Mutex
+	hooks StaticWebhooks
+	stat  fileStat
+}
+
+var _ WebhookTargets = (*WebhooksFile)(nil)
+
+// LoadWebhooksFile loads the webhook config file at path.
+func LoadWebhooksFile(path string) (*WebhooksFile, error) {
+	f := &WebhooksFile{Path: path}
+	return f, f.Reload()
+}
+
+// Reload rereads the file, replacing the current webhooks if it parses.
+func (f *WebhooksFile) Reload() error {
+	stat, err := statFile(f.Path)
+	if err != nil {
+		return err
+	}
+	data, err := ioutil.ReadFile(f.Path)
+	if err != nil {
+		return err
+	}
+	hooks, err := ParseWebhooks(data)
+	if err != nil {
+		return fmt.Errorf("%s: %v", f.Path, err)
+	}
+	f.mtx.Lock()
+	f.hooks = hooks
+	f.stat = stat
+	f.mtx.Unlock()
+	logger.Noticef("loaded %d webhooks from %s", len(hooks), f.Path)
+	return nil
+}
+
+func (f *WebhooksFile) loaded() fileStat {
+	f.mtx.Lock()
+	defer f.mtx.Unlock()
+	return f.stat
+}
+
+// Watch reloads the file whenever it changes, checking every interval,
+// until ctx is canceled. Reload errors are logged.
+func (f *WebhooksFile) Watch(ctx context.Context, interval time.Duration) {
+	watchFile(ctx, f.Path, interval, f.loaded, f.Reload)
+}
+
+func (f *WebhooksFile) Webhooks(repo string) []Webhook {
+	f.mtx.Lock()
+	hooks := f.hooks
+	f.mtx.Unlock()
+	return hooks.Webhooks(repo)
+}
+
+// WebhookReceiver is an http.Handler that accepts webhooks, for testing
+// them. It checks signatures if Secret is set, and keeps the payloads it
+// gets.
+type WebhookReceiver struct {
+	Secret string
+	// If positive, this many requests are answered with a 500 before any
+	// succeed, to exercise retries.
+	Fail int
+	// If set, is called with each payload accepted.
+	Received func(payload *WebhookPayload)
+
+	mtx      sync.Mutex
+	cond     *sync.Cond
+	failed   int
+	payloads []WebhookPayload
+}
+
+func (rcv *WebhookReceiver) ServeHTTP(w http.ResponseWriter,
+	req *http.Request) {
+	if req.Method != "POST" {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	body, err := ioutil.ReadAll(req.Body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if rcv.Secret != "" && !VerifyWebhook(rcv.Secret, body,
+		req.Header.Get(WebhookSignatureHeader)) {
+		http.Error(w, "bad signature", http.StatusUnauthorized)
+		return
+	}
+	var payload WebhookPayload
+	err = json.Unmarshal(body, &payload)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	rcv.mtx.Lock()
+	if rcv.failed < rcv.Fail {
+		rcv.failed++
+		rcv.mtx.Unlock()
+		http.Error(w, "failing on purpose", http.StatusInternalServerError)
+		return
+	}
+	rcv.payloads = append(rcv.payloads, payload)
+	rcv.getCond().Broadcast()
+	rcv.mtx.Unlock()
+
+	if rcv.Received != nil {
+		rcv.Received(&payload)
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// getCond returns the receiver's sync.Cond. rcv.mtx must be held.
+func (rcv *WebhookReceiver) getCond() *sync.Cond {
+	if rcv.cond == nil {
+		rcv.cond = sync.NewCond(&rcv.mtx)
+	}
+	return rcv.cond
+}
+
+// Payloads returns the payloads accepted so far.
+func (rcv *WebhookReceiver) Payloads() []WebhookPayload {
+	rcv.mtx.Lock()
+	defer rcv.mtx.Unlock()
+	return append([]WebhookPayload(nil), rcv.payloads...)
+}
+
+// Wait waits until at least n payloads have been accepted, or until timeout
+// passes, and returns the payloads accepted so far.
+func (rcv *WebhookReceiver) Wait(n int, timeout time.Duration) (
+	[]WebhookPayload, error) {
+	timer := time.AfterFunc(timeout, func() {
+		rcv.mtx.Lock()
+		rcv.getCond().Broadcast()
+		rcv.mtx.Unlock()
+	})
+	defer timer.Stop()
+	deadline := time.Now().Add(timeout)
+	rcv.mtx.Lock()
+	defer rcv.mtx.Unlock()
+	for len(rcv.payloads) < n && time.Now().Before(deadline) {
+		rcv.getCond().Wait()
+	}
+	payloads := append([]WebhookPayload(nil), rcv.payloads...)
+	if len(payloads) < n {
+		return payloads, fmt.Errorf("got %d webhooks, wanted %d",
+			len(payloads), n)
+	}
+	return payloads, nil
+}
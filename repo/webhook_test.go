@@ -0,0 +1,152 @@
+// Copyright (C) 2014 JT Olds
+// See LICENSE for copying information
+
+package repo
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestWebhookReceiver(t *testing.T) {
+	rcv := &WebhookReceiver{Secret: "s3cret", Fail: 1}
+	server := httptest.NewServer(rcv)
+	defer server.Close()
+
+	var mtx sync.Mutex
+	var deliveries []*WebhookDelivery
+	sender := func(secret string) *WebhookSender {
+		return &WebhookSender{
+			Targets: StaticWebhooks{
+				{Pattern: "proj", URL: server.URL, Secret: secret}},
+			RetryDelay: time.Millisecond,
+			DeliveryLog: func(delivery *WebhookDelivery) {
+				mtx.Lock()
+				deliveries = append(deliveries, delivery)
+				mtx.Unlock()
+			}}
+	}
+	updates := []RefUpdate{{Ref: "refs/heads/master", Old: oldId, New: newId}}
+
+	// the first attempt fails on purpose and is retried
+	good := sender("s3cret")
+	good.pushed("proj", "alice", "SHA256:key", updates)
+	good.pushed("other", "alice", "SHA256:key", updates)
+	payloads, err := rcv.Wait(1, 5*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := good.Wait(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if len(payloads) != 1 || payloads[0].Repo != "proj" ||
+		payloads[0].User != "alice" || payloads[0].Key != "SHA256:key" ||
+		len(payloads[0].Updates) != 1 || payloads[0].Updates[0] != updates[0] {
+		t.Fatalf("got payloads %+v", payloads)
+	}
+	mtx.Lock()
+	if len(deliveries) != 2 || deliveries[0].Status != 500 ||
+		!deliveries[0].Retrying || !deliveries[1].Delivered ||
+		deliveries[1].Attempt != 2 || deliveries[1].Id != payloads[0].Id {
+		t.Errorf("got deliveries %+v", deliveries)
+	}
+	deliveries = nil
+	mtx.Unlock()
+
+	// no more webhooks once Wait is called
+	good.pushed("proj", "alice", "SHA256:key", updates)
+
+	// a bad signature isn't retried
+	bad := sender("wrong")
+	bad.pushed("proj", "alice", "SHA256:key", updates)
+	if err := bad.Wait(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	mtx.Lock()
+	if len(deliveries) != 1 || deliveries[0].Status != 401 ||
+		deliveries[0].Retrying || deliveries[0].Delivered {
+		t.Errorf("got deliveries %+v", deliveries)
+	}
+	mtx.Unlock()
+
+	body := []byte(`{"id":"x","repo":"proj","updates":[]}`)
+	for _, test := range []struct {
+		name      string
+		body      []byte
+		signature string
+		status    int
+	}{
+		{"signed", body, SignWebhook("s3cret", body), 204},
+		{"unsigned", body, "", 401},
+		{"tampered", append([]byte(" "), body...), SignWebhook("s3cret", body),
+			401},
+		{"wrong secret", body, SignWebhook("wrong", body), 401},
+		{"not json", []byte("x"), SignWebhook("s3cret", []byte("x")), 400},
+	} {
+		req, err := http.NewRequest("POST", server.URL, bytes.NewReader(test.body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set(WebhookSignatureHeader, test.signature)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != test.status {
+			t.Errorf("%s: got %d, expected %d", test.name, resp.StatusCode,
+				test.status)
+		}
+	}
+
+	payloads, err = rcv.Wait(3, 10*time.Millisecond)
+	if err == nil || len(payloads) != 2 || payloads[1].Id != "x" {
+		t.Errorf("got payloads %+v, %v", payloads, err)
+	}
+	if len(rcv.Payloads()) != 2 {
+		t.Errorf("got payloads %+v", rcv.Payloads())
+	}
+}
+
+func TestWebhookSenderWait(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}))
+	defer server.Close()
+
+	var mtx sync.Mutex
+	var deliveries []*WebhookDelivery
+	sender := &WebhookSender{
+		Targets:    StaticWebhooks{{Pattern: "*", URL: server.URL}},
+		RetryDelay: time.Hour,
+		DeliveryLog: func(delivery *WebhookDelivery) {
+			mtx.Lock()
+			deliveries = append(deliveries, delivery)
+			mtx.Unlock()
+		}}
+	sender.pushed("proj", "alice", "", []RefUpdate{
+		{Ref: "refs/heads/master", Old: oldId, New: newId}})
+
+	ctx, cancel := context.WithTimeout(context.Background(),
+		100*time.Millisecond)
+	defer cancel()
+	if err := sender.Wait(ctx); err != context.DeadlineExceeded {
+		t.Fatalf("got %v, expected the deadline to pass", err)
+	}
+	// the retry is abandoned instead of sleeping for an hour
+	if err := sender.Wait(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	mtx.Lock()
+	defer mtx.Unlock()
+	if len(deliveries) != 1 || deliveries[0].Status != 503 ||
+		!deliveries[0].Retrying {
+		t.Fatalf("got deliveries %+v", deliveries)
+	}
+}
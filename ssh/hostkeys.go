@@ -0,0 +1,189 @@
+// Copyright (C) 2014 JT Olds
+// See LICENSE for copying information
+
+package ssh
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+const (
+	hostKeysRequest      = "hostkeys-00@openssh.com"
+	hostKeysProveRequest = "hostkeys-prove-00@openssh.com"
+
+	// kexAlgorithmTTL is how long the algorithm of a key exchange that
+	// nobody asked about is kept, e.g. after a rekey.
+	kexAlgorithmTTL = time.Minute
+)
+
+// AddHostKey adds key to SSHConfig, like SSHConfig.AddHostKey. RSA keys
+// added this way remember the signature algorithm each connection's key
+// exchange negotiated, since OpenSSH clients check that RSA host key proofs
+// use the same one. Without it, proofs are signed with rsa-sha2-512.
+func (r *RestrictedServer) AddHostKey(key ssh.Signer) {
+	algorithm_signer, ok := key.(ssh.AlgorithmSigner)
+	if ok && key.PublicKey().Type() == ssh.KeyAlgoRSA {
+		key = kexSigner{AlgorithmSigner: algorithm_signer, server: r}
+	}
+	r.SSHConfig.AddHostKey(key)
+}
+
+// kexSigner is an RSA host key that tells its server which algorithm it
+// signed each key exchange with. A connection's first exchange hash is its
+// session id.
+type kexSigner struct {
+	ssh.AlgorithmSigner
+	server *RestrictedServer
+}
+
+func (s kexSigner) Sign(rand io.Reader, data []byte) (*ssh.Signature,
+	error) {
+	return s.SignWithAlgorithm(rand, data, "")
+}
+
+func (s kexSigner) SignWithAlgorithm(rand io.Reader, data []byte,
+	algorithm string) (*ssh.Signature, error) {
+	sig, err := s.AlgorithmSigner.SignWithAlgorithm(rand, data, algorithm)
+	if err == nil {
+		s.server.kexSigned(data, sig.Format)
+	}
+	return sig, err
+}
+
+type kexAlgorithm struct {
+	algorithm string
+	signed    time.Time
+}
+
+// kexSigned records that the key exchange with hash exchange_hash was
+// signed with an RSA key using algorithm.
+func (r *RestrictedServer) kexSigned(exchange_hash []byte, algorithm string) {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+	now := time.Now()
+	if r.kex_algos == nil {
+		r.kex_algos = make(map[string]kexAlgorithm)
+	}
+	for hash, kex := range r.kex_algos {
+		if now.Sub(kex.signed) > kexAlgorithmTTL {
+			delete(r.kex_algos, hash)
+		}
+	}
+	r.kex_algos[string(exchange_hash)] = kexAlgorithm{
+		algorithm: algorithm, signed: now}
+}
+
+// takeKexAlgorithm returns the RSA signature algorithm the connection with
+// session_id negotiated in its first key exchange, if it used an RSA key
+// added with AddHostKey.
+func (r *RestrictedServer) takeKexAlgorithm(session_id []byte) string {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+	kex := r.kex_algos[string(session_id)]
+	delete(r.kex_algos, string(session_id))
+	return kex.algorithm
+}
+
+// announceHostKeys tells the client about all of HostKeys.
+func (r *RestrictedServer) announceHostKeys(sc *ssh.ServerConn) (err error) {
+	defer mon.Task()(nil)(&err)
+	var payload []byte
+	for _, key := range r.HostKeys {
+		payload = appendString(payload, key.PublicKey().Marshal())
+	}
+	_, _, err = sc.SendRequest(hostKeysRequest, false, payload)
+	return err
+}
+
+// handleGlobalRequests answers hostkeys-prove-00@openssh.com requests, and
+// refuses all other global requests. rsa_algorithm is as for proveHostKeys.
+func (r *RestrictedServer) handleGlobalRequests(sc *ssh.ServerConn,
+	reqs <-chan *ssh.Request, rsa_algorithm string) {
+	for req := range reqs {
+		if req.Type != hostKeysProveRequest || len(r.HostKeys) == 0 {
+			if req.WantReply {
+				req.Reply(false, nil)
+			}
+			continue
+		}
+		proof, err := r.proveHostKeys(sc.SessionID(), req.Payload,
+			rsa_algorithm)
+		if err != nil {
+			logger.Warnf("host key proof for %s failed: %v", sc.RemoteAddr(),
+				err)
+			req.Reply(false, nil)
+			continue
+		}
+		req.Reply(true, proof)
+	}
+}
+
+// proveHostKeys signs a proof of possession for each host key the client
+// asked about, as OpenSSH's PROTOCOL file describes. RSA keys sign with
+// rsa_algorithm, the one the connection's key exchange used if it used an
+// RSA key, or rsa-sha2-512 if it's empty.
+func (r *RestrictedServer) proveHostKeys(session_id, payload []byte,
+	rsa_algorithm string) (proof []byte, err error) {
+	if rsa_algorithm == "" {
+		// clients won't accept SHA-1 signatures unless they negotiated them
+		rsa_algorithm = ssh.KeyAlgoRSASHA512
+	}
+	for len(payload) > 0 {
+		var blob []byte
+		blob, payload, err = parseString(payload)
+		if err != nil {
+			return nil, err
+		}
+		var signer ssh.Signer
+		for _, key := range r.HostKeys {
+			if bytes.Equal(key.PublicKey().Marshal(), blob) {
+				signer = key
+				break
+			}
+		}
+		if signer == nil {
+			return nil, fmt.Errorf("asked to prove unknown host key")
+		}
+		var data []byte
+		data = appendString(data, []byte(hostKeysProveRequest))
+		data = appendString(data, session_id)
+		data = appendString(data, blob)
+		var sig *ssh.Signature
+		algorithm_signer, ok := signer.(ssh.AlgorithmSigner)
+		if ok && signer.PublicKey().Type() == ssh.KeyAlgoRSA {
+			sig, err = algorithm_signer.SignWithAlgorithm(rand.Reader, data,
+				rsa_algorithm)
+		} else {
+			sig, err = signer.Sign(rand.Reader, data)
+		}
+		if err != nil {
+			return nil, err
+		}
+		proof = appendString(proof, ssh.Marshal(sig))
+	}
+	return proof, nil
+}
+
+func appendString(buf, s []byte) []byte {
+	var length [4]byte
+	binary.BigEndian.PutUint32(length[:], uint32(len(s)))
+	return append(append(buf, length[:]...), s...)
+}
+
+func parseString(buf []byte) (s, rest []byte, err error) {
+	if len(buf) < 4 {
+		return nil, nil, fmt.Errorf("short string")
+	}
+	length := binary.BigEndian.Uint32(buf)
+	if uint32(len(buf)-4) < length {
+		return nil, nil, fmt.Errorf("short string")
+	}
+	return buf[4 : 4+length], buf[4+length:], nil
+}
@@ -0,0 +1,98 @@
+// Copyright (C) 2014 JT Olds
+// See LICENSE for copying information
+
+package ssh
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"testing"
+
+	"golang.org/x/crypto/ssh"
+)
+
+func TestProveHostKeys(t *testing.T) {
+	rsa_key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rsa_signer, err := ssh.NewSignerFromKey(rsa_key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ed25519_signer := testSigner(t)
+
+	server := &RestrictedServer{
+		SSHConfig: &ssh.ServerConfig{PublicKeyCallback: acceptAnyKey},
+		HostKeys:  []ssh.Signer{rsa_signer, ed25519_signer}}
+	server.SSHConfig.AddHostKey(ed25519_signer)
+	server.AddHostKey(rsa_signer)
+	addr := testServer(t, server)
+
+	for _, test := range []struct {
+		kex_algorithm string
+		rsa_algorithm string
+	}{
+		{ssh.KeyAlgoRSASHA256, ssh.KeyAlgoRSASHA256},
+		{ssh.KeyAlgoRSASHA512, ssh.KeyAlgoRSASHA512},
+		{ssh.KeyAlgoED25519, ssh.KeyAlgoRSASHA512},
+	} {
+		config := testClientConfig(t)
+		config.HostKeyAlgorithms = []string{test.kex_algorithm}
+		client, err := ssh.Dial("tcp", addr, config)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer client.Close()
+
+		var payload []byte
+		for _, key := range server.HostKeys {
+			payload = appendString(payload, key.PublicKey().Marshal())
+		}
+		ok, proof, err := client.SendRequest(hostKeysProveRequest, true,
+			payload)
+		if err != nil || !ok {
+			t.Fatalf("%s: proof refused: %v", test.kex_algorithm, err)
+		}
+		for _, key := range server.HostKeys {
+			var sig_blob []byte
+			sig_blob, proof, err = parseString(proof)
+			if err != nil {
+				t.Fatalf("%s: %v", test.kex_algorithm, err)
+			}
+			var sig ssh.Signature
+			err = ssh.Unmarshal(sig_blob, &sig)
+			if err != nil {
+				t.Fatalf("%s: %v", test.kex_algorithm, err)
+			}
+			blob := key.PublicKey().Marshal()
+			var data []byte
+			data = appendString(data, []byte(hostKeysProveRequest))
+			data = appendString(data, client.SessionID())
+			data = appendString(data, blob)
+			err = key.PublicKey().Verify(data, &sig)
+			if err != nil {
+				t.Errorf("%s: %s proof: %v", test.kex_algorithm,
+					key.PublicKey().Type(), err)
+			}
+			expected := key.PublicKey().Type()
+			if expected == ssh.KeyAlgoRSA {
+				expected = test.rsa_algorithm
+			}
+			if sig.Format != expected {
+				t.Errorf("%s: got %s proof, expected %s", test.kex_algorithm,
+					sig.Format, expected)
+			}
+		}
+		if len(proof) != 0 {
+			t.Errorf("%s: extra proof data", test.kex_algorithm)
+		}
+
+		// keys we don't have can't be proven
+		payload = appendString(nil, testSigner(t).PublicKey().Marshal())
+		ok, _, err = client.SendRequest(hostKeysProveRequest, true, payload)
+		if err != nil || ok {
+			t.Errorf("%s: proved an unknown key: %v", test.kex_algorithm, err)
+		}
+	}
+}
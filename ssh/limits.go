@@ -0,0 +1,323 @@
+// Copyright (C) 2014 JT Olds
+// See LICENSE for copying information
+
+package ssh
+
+import (
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// Limits bounds how much of a RestrictedServer clients may use. Zero fields
+// mean no limit.
+type Limits struct {
+	// MaxConns limits concurrent connections overall, and MaxConnsPerIP
+	// limits them per source IP. MaxConnsPerUser limits concurrent
+	// authenticated connections per user; connections over it are refused
+	// any sessions.
+	MaxConns        int
+	MaxConnsPerIP   int
+	MaxConnsPerUser int
+
+	// User identifies the user of an authenticated connection, for
+	// MaxConnsPerUser and PushRate. If nil, the SSH user name is used.
+	User func(meta ssh.ConnMetadata) string
+
+	// ConnRate limits new connections from each source IP to ConnRate per
+	// second, in bursts of up to ConnBurst.
+	ConnRate  float64
+	ConnBurst int
+	// PushRate limits each user to PushRate git-receive-pack commands per
+	// second, in bursts of up to PushBurst.
+	PushRate  float64
+	PushBurst int
+
+	// A source IP with MaxAuthFailures connections that failed to
+	// authenticate within AuthFailureWindow is refused for BanDuration. Both
+	// durations default to 10 minutes.
+	MaxAuthFailures   int
+	AuthFailureWindow time.Duration
+	BanDuration       time.Duration
+}
+
+const (
+	// limitsSweepInterval is how often idle limiter state is thrown away.
+	limitsSweepInterval = time.Minute
+
+	defaultBanDuration = 10 * time.Minute
+)
+
+func (limits *Limits) authFailureWindow() time.Duration {
+	if limits.AuthFailureWindow <= 0 {
+		return defaultBanDuration
+	}
+	return limits.AuthFailureWindow
+}
+
+func (limits *Limits) banDuration() time.Duration {
+	if limits.BanDuration <= 0 {
+		return defaultBanDuration
+	}
+	return limits.BanDuration
+}
+
+// tokenBucket is a token bucket rate limiter. The zero value is full.
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+func burst(n int) float64 {
+	if n < 1 {
+		return 1
+	}
+	return float64(n)
+}
+
+// refill adds the tokens earned since the last call, returning whether the
+// bucket is full.
+func (b *tokenBucket) refill(rate float64, size int, now time.Time) bool {
+	if b.last.IsZero() {
+		b.tokens = burst(size)
+	} else {
+		b.tokens += now.Sub(b.last).Seconds() * rate
+		if b.tokens > burst(size) {
+			b.tokens = burst(size)
+		}
+	}
+	b.last = now
+	return b.tokens >= burst(size)
+}
+
+// take returns true and uses up a token if one is available.
+func (b *tokenBucket) take(rate float64, size int, now time.Time) bool {
+	b.refill(rate, size, now)
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+// limiter keeps the state for enforcing Limits.
+type limiter struct {
+	mtx          sync.Mutex
+	conns        int
+	ip_conns     map[string]int
+	user_conns   map[string]int
+	conn_buckets map[string]*tokenBucket
+	push_buckets map[string]*tokenBucket
+	failures     map[string][]time.Time
+	bans         map[string]time.Time
+	last_sweep   time.Time
+}
+
+// init sets up the limiter's maps. l.mtx must be held.
+func (l *limiter) init() {
+	if l.ip_conns == nil {
+		l.ip_conns = map[string]int{}
+		l.user_conns = map[string]int{}
+		l.conn_buckets = map[string]*tokenBucket{}
+		l.push_buckets = map[string]*tokenBucket{}
+		l.failures = map[string][]time.Time{}
+		l.bans = map[string]time.Time{}
+	}
+}
+
+// sweep throws away state that no longer matters. l.mtx must be held.
+func (l *limiter) sweep(limits *Limits, now time.Time) {
+	if now.Sub(l.last_sweep) < limitsSweepInterval {
+		return
+	}
+	l.last_sweep = now
+	for ip, bucket := range l.conn_buckets {
+		if bucket.refill(limits.ConnRate, limits.ConnBurst, now) {
+			delete(l.conn_buckets, ip)
+		}
+	}
+	for user, bucket := range l.push_buckets {
+		if bucket.refill(limits.PushRate, limits.PushBurst, now) {
+			delete(l.push_buckets, user)
+		}
+	}
+	for ip := range l.failures {
+		l.failures[ip] = recentFailures(l.failures[ip], limits, now)
+		if len(l.failures[ip]) == 0 {
+			delete(l.failures, ip)
+		}
+	}
+	for ip, until := range l.bans {
+		if !now.Before(until) {
+			delete(l.bans, ip)
+		}
+	}
+}
+
+func recentFailures(failures []time.Time, limits *Limits,
+	now time.Time) []time.Time {
+	window := limits.authFailureWindow()
+	for len(failures) > 0 && now.Sub(failures[0]) > window {
+		failures = failures[1:]
+	}
+	return failures
+}
+
+// addrIP returns the IP of addr, or all of addr if it has none, e.g. for
+// Unix sockets.
+func addrIP(addr net.Addr) string {
+	if tcp_addr, ok := addr.(*net.TCPAddr); ok {
+		return tcp_addr.IP.String()
+	}
+	host, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return addr.String()
+	}
+	return host
+}
+
+// admitConn decides whether to let a new connection from ip in. If so, the
+// connection must be released when it's done.
+func (l *limiter) admitConn(limits *Limits, ip string) (reason string) {
+	now := time.Now()
+	l.mtx.Lock()
+	defer l.mtx.Unlock()
+	l.init()
+	l.sweep(limits, now)
+	if until, banned := l.bans[ip]; banned {
+		if now.Before(until) {
+			mon.Meter("conns_banned").Mark(1)
+			return "banned"
+		}
+		delete(l.bans, ip)
+	}
+	if limits.MaxConns > 0 && l.conns >= limits.MaxConns {
+		mon.Meter("conns_over_limit").Mark(1)
+		return "too many connections"
+	}
+	if limits.MaxConnsPerIP > 0 && l.ip_conns[ip] >= limits.MaxConnsPerIP {
+		mon.Meter("conns_over_ip_limit").Mark(1)
+		return "too many connections from ip"
+	}
+	if limits.ConnRate > 0 {
+		bucket := l.conn_buckets[ip]
+		if bucket == nil {
+			bucket = &tokenBucket{}
+			l.conn_buckets[ip] = bucket
+		}
+		if !bucket.take(limits.ConnRate, limits.ConnBurst, now) {
+			mon.Meter("conns_rate_limited").Mark(1)
+			return "connection rate exceeded"
+		}
+	}
+	l.conns++
+	l.ip_conns[ip]++
+	mon.IntVal("conns").Observe(int64(l.conns))
+	return ""
+}
+
+func (l *limiter) releaseConn(ip string) {
+	l.mtx.Lock()
+	defer l.mtx.Unlock()
+	l.conns--
+	l.ip_conns[ip]--
+	if l.ip_conns[ip] <= 0 {
+		delete(l.ip_conns, ip)
+	}
+}
+
+// admitUser decides whether user may have another connection. If so, the
+// connection must be released when it's done.
+func (l *limiter) admitUser(limits *Limits, user string) bool {
+	l.mtx.Lock()
+	defer l.mtx.Unlock()
+	l.init()
+	if limits.MaxConnsPerUser > 0 &&
+		l.user_conns[user] >= limits.MaxConnsPerUser {
+		mon.Meter("conns_over_user_limit").Mark(1)
+		return false
+	}
+	l.user_conns[user]++
+	return true
+}
+
+func (l *limiter) releaseUser(user string) {
+	l.mtx.Lock()
+	defer l.mtx.Unlock()
+	l.user_conns[user]--
+	if l.user_conns[user] <= 0 {
+		delete(l.user_conns, user)
+	}
+}
+
+// allowPush returns true if user may push now.
+func (l *limiter) allowPush(limits *Limits, user string) bool {
+	if limits.PushRate <= 0 {
+		return true
+	}
+	l.mtx.Lock()
+	defer l.mtx.Unlock()
+	l.init()
+	bucket := l.push_buckets[user]
+	if bucket == nil {
+		bucket = &tokenBucket{}
+		l.push_buckets[user] = bucket
+	}
+	if !bucket.take(limits.PushRate, limits.PushBurst, time.Now()) {
+		mon.Meter("pushes_rate_limited").Mark(1)
+		return false
+	}
+	return true
+}
+
+// authFailed records a connection from ip that failed to authenticate,
+// returning true if ip is now banned.
+func (l *limiter) authFailed(limits *Limits, ip string) (banned bool) {
+	mon.Meter("auth_failures").Mark(1)
+	if limits.MaxAuthFailures <= 0 {
+		return false
+	}
+	now := time.Now()
+	l.mtx.Lock()
+	defer l.mtx.Unlock()
+	l.init()
+	failures := append(recentFailures(l.failures[ip], limits, now), now)
+	if len(failures) < limits.MaxAuthFailures {
+		l.failures[ip] = failures
+		return false
+	}
+	delete(l.failures, ip)
+	l.bans[ip] = now.Add(limits.banDuration())
+	mon.Meter("bans").Mark(1)
+	return true
+}
+
+// isAuthFailure returns true if err from ssh.NewServerConn means the client
+// tried to authenticate and failed, as opposed to e.g. not trying at all.
+func isAuthFailure(err error) bool {
+	auth_err, ok := err.(*ssh.ServerAuthError)
+	if !ok {
+		return false
+	}
+	for _, err := range auth_err.Errors {
+		if err != ssh.ErrNoAuth {
+			return true
+		}
+	}
+	return false
+}
+
+func (r *RestrictedServer) limitsUser(meta ssh.ConnMetadata) string {
+	if r.Limits.User != nil {
+		return r.Limits.User(meta)
+	}
+	return meta.User()
+}
+
+// isPush returns true if command is a push.
+func isPush(command string) bool {
+	return strings.HasPrefix(command, "git-receive-pack ")
+}
@@ -0,0 +1,231 @@
+// Copyright (C) 2014 JT Olds
+// See LICENSE for copying information
+
+package ssh
+
+import (
+	"errors"
+	"net"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+func TestTokenBucket(t *testing.T) {
+	start := time.Date(2030, 1, 2, 0, 0, 0, 0, time.UTC)
+	at := func(seconds float64) time.Time {
+		return start.Add(time.Duration(seconds * float64(time.Second)))
+	}
+	for _, test := range []struct {
+		name  string
+		rate  float64
+		size  int
+		times []float64
+		taken []bool
+	}{
+		{"burst", 1, 3, []float64{0, 0, 0, 0},
+			[]bool{true, true, true, false}},
+		{"no burst means 1", 1, 0, []float64{0, 0, 1, 1},
+			[]bool{true, false, true, false}},
+		{"refill", 2, 2, []float64{0, 0, 0, 0.4, 0.5, 0.5, 0.9},
+			[]bool{true, true, false, false, true, false, false}},
+		{"refill caps at size", 10, 2, []float64{0, 0, 100, 100, 100},
+			[]bool{true, true, true, true, false}},
+		{"failed takes are free", 1, 1, []float64{0, 0.5, 0.9, 1},
+			[]bool{true, false, false, true}},
+	} {
+		var bucket tokenBucket
+		for i, seconds := range test.times {
+			taken := bucket.take(test.rate, test.size, at(seconds))
+			if taken != test.taken[i] {
+				t.Errorf("%s: take %d at %vs: got %v", test.name, i, seconds,
+					taken)
+			}
+		}
+	}
+
+	var bucket tokenBucket
+	if !bucket.refill(1, 2, start) {
+		t.Errorf("a new bucket isn't full")
+	}
+	bucket.take(1, 2, start)
+	if bucket.refill(1, 2, at(0.5)) || !bucket.refill(1, 2, at(1)) {
+		t.Errorf("bucket didn't fill back up after a second")
+	}
+}
+
+func TestLimiterConns(t *testing.T) {
+	limits := &Limits{MaxConns: 3, MaxConnsPerIP: 2}
+	var l limiter
+	for i, test := range []struct {
+		ip     string
+		reason string
+	}{
+		{"10.0.0.1", ""},
+		{"10.0.0.1", ""},
+		{"10.0.0.1", "too many connections from ip"},
+		{"10.0.0.2", ""},
+		{"10.0.0.3", "too many connections"},
+	} {
+		reason := l.admitConn(limits, test.ip)
+		if reason != test.reason {
+			t.Errorf("conn %d from %s: got %#v, expected %#v", i, test.ip, reason,
+				test.reason)
+		}
+	}
+	l.releaseConn("10.0.0.1")
+	if reason := l.admitConn(limits, "10.0.0.3"); reason != "" {
+		t.Errorf("released conn not reusable: %#v", reason)
+	}
+	l.releaseConn("10.0.0.3")
+	l.releaseConn("10.0.0.2")
+	l.releaseConn("10.0.0.1")
+	if l.conns != 0 || len(l.ip_conns) != 0 {
+		t.Errorf("conns left over: %d, %v", l.conns, l.ip_conns)
+	}
+
+	limits = &Limits{ConnRate: 0.001, ConnBurst: 2}
+	for i, expected := range []string{"", "", "connection rate exceeded"} {
+		reason := l.admitConn(limits, "10.0.0.1")
+		if reason != expected {
+			t.Errorf("rate limited conn %d: got %#v, expected %#v", i, reason,
+				expected)
+		}
+	}
+	if reason := l.admitConn(limits, "10.0.0.2"); reason != "" {
+		t.Errorf("rate limit isn't per ip: %#v", reason)
+	}
+}
+
+func TestLimiterUsers(t *testing.T) {
+	limits := &Limits{MaxConnsPerUser: 1, PushRate: 0.001, PushBurst: 1}
+	var l limiter
+	if !l.admitUser(limits, "alice") || l.admitUser(limits, "alice") {
+		t.Errorf("user connection limit not enforced")
+	}
+	if !l.admitUser(limits, "bob") {
+		t.Errorf("user connection limit isn't per user")
+	}
+	l.releaseUser("alice")
+	if !l.admitUser(limits, "alice") {
+		t.Errorf("released user connection not reusable")
+	}
+
+	if !l.allowPush(limits, "alice") || l.allowPush(limits, "alice") {
+		t.Errorf("push rate not enforced")
+	}
+	if !l.allowPush(limits, "bob") {
+		t.Errorf("push rate isn't per user")
+	}
+	if !l.allowPush(&Limits{}, "alice") {
+		t.Errorf("push rate enforced without a limit")
+	}
+}
+
+func TestLimiterBans(t *testing.T) {
+	limits := &Limits{MaxAuthFailures: 3, BanDuration: time.Hour}
+	var l limiter
+	for i, expected := range []bool{false, false, true} {
+		if banned := l.authFailed(limits, "10.0.0.1"); banned != expected {
+			t.Errorf("failure %d: got banned %v", i, banned)
+		}
+	}
+	if reason := l.admitConn(limits, "10.0.0.1"); reason != "banned" {
+		t.Errorf("banned ip admitted: %#v", reason)
+	}
+	if reason := l.admitConn(limits, "10.0.0.2"); reason != "" {
+		t.Errorf("other ip not admitted: %#v", reason)
+	}
+	if _, left := l.failures["10.0.0.1"]; left {
+		t.Errorf("failures kept after the ban")
+	}
+
+	// bans expire
+	l.bans["10.0.0.1"] = time.Now().Add(-time.Second)
+	if reason := l.admitConn(limits, "10.0.0.1"); reason != "" {
+		t.Errorf("expired ban still enforced: %#v", reason)
+	}
+
+	// failures outside the window don't count
+	l.failures["10.0.0.3"] = []time.Time{
+		time.Now().Add(-2 * defaultBanDuration),
+		time.Now().Add(-2 * defaultBanDuration)}
+	if l.authFailed(limits, "10.0.0.3") {
+		t.Errorf("banned for old failures")
+	}
+	if len(l.failures["10.0.0.3"]) != 1 {
+		t.Errorf("old failures kept: %v", l.failures["10.0.0.3"])
+	}
+
+	if l.authFailed(&Limits{}, "10.0.0.4") {
+		t.Errorf("banned without a limit")
+	}
+}
+
+func TestLimiterSweep(t *testing.T) {
+	limits := &Limits{ConnRate: 1, ConnBurst: 1}
+	var l limiter
+	l.admitConn(limits, "10.0.0.1")
+	l.releaseConn("10.0.0.1")
+	l.failures["10.0.0.2"] = []time.Time{
+		time.Now().Add(-2 * defaultBanDuration)}
+	l.bans["10.0.0.3"] = time.Now().Add(-time.Second)
+	l.bans["10.0.0.4"] = time.Now().Add(time.Hour)
+
+	l.mtx.Lock()
+	l.sweep(limits, time.Now().Add(limitsSweepInterval))
+	l.mtx.Unlock()
+	if len(l.conn_buckets) != 0 || len(l.failures) != 0 || len(l.bans) != 1 {
+		t.Errorf("sweep left %v, %v, %v", l.conn_buckets, l.failures, l.bans)
+	}
+}
+
+func TestAddrIP(t *testing.T) {
+	for _, test := range []struct {
+		addr net.Addr
+		ip   string
+	}{
+		{&net.TCPAddr{IP: net.ParseIP("10.0.0.1"), Port: 22}, "10.0.0.1"},
+		{&net.TCPAddr{IP: net.ParseIP("2001:db8::1"), Port: 22},
+			"2001:db8::1"},
+		{&net.UDPAddr{IP: net.ParseIP("2001:db8::1"), Port: 22},
+			"2001:db8::1"},
+		{&net.UnixAddr{Name: "/run/gitserve.sock", Net: "unix"},
+			"/run/gitserve.sock"},
+	} {
+		if ip := addrIP(test.addr); ip != test.ip {
+			t.Errorf("%v: got %#v, expected %#v", test.addr, ip, test.ip)
+		}
+	}
+}
+
+func TestIsAuthFailure(t *testing.T) {
+	for _, test := range []struct {
+		err     error
+		failure bool
+	}{
+		{errors.New("EOF"), false},
+		{&ssh.ServerAuthError{}, false},
+		{&ssh.ServerAuthError{Errors: []error{ssh.ErrNoAuth}}, false},
+		{&ssh.ServerAuthError{Errors: []error{ssh.ErrNoAuth,
+			errors.New("unknown key")}}, true},
+	} {
+		if failure := isAuthFailure(test.err); failure != test.failure {
+			t.Errorf("%v: got %v", test.err, failure)
+		}
+	}
+}
+
+func TestIsPush(t *testing.T) {
+	for command, push := range map[string]bool{
+		"git-receive-pack 'proj'": true,
+		"git-upload-pack 'proj'":  false,
+		"git-receive-pack":        false,
+		"git-receive-packs 'x'":   false,
+	} {
+		if isPush(command) != push {
+			t.Errorf("%#v: got %v", command, !push)
+		}
+	}
+}
@@ -0,0 +1,133 @@
+// Copyright (C) 2014 JT Olds
+// See LICENSE for copying information
+
+package ssh
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// unixPrefix marks an address for Listen as a Unix socket path.
+const unixPrefix = "unix:"
+
+// systemdFirstFD is the first file descriptor systemd passes listeners on.
+const systemdFirstFD = 3
+
+// Listen listens on addr, which is either a TCP address like ":7022", or a
+// Unix socket path prefixed with "unix:". A Unix socket left behind at the
+// path by a previous run is replaced.
+func Listen(addr string) (net.Listener, error) {
+	if !strings.HasPrefix(addr, unixPrefix) {
+		return net.Listen("tcp", addr)
+	}
+	path := strings.TrimPrefix(addr, unixPrefix)
+	if info, err := os.Lstat(path); err == nil &&
+		info.Mode()&os.ModeSocket != 0 {
+		err = os.Remove(path)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return net.Listen("unix", path)
+}
+
+// ListenAll listens on every comma-separated address in addrs, as with
+// Listen.
+func ListenAll(addrs string) (listeners []net.Listener, err error) {
+	for _, addr := range strings.Split(addrs, ",") {
+		addr = strings.TrimSpace(addr)
+		if addr == "" {
+			continue
+		}
+		listener, err := Listen(addr)
+		if err != nil {
+			for _, l := range listeners {
+				l.Close()
+			}
+			return nil, err
+		}
+		listeners = append(listeners, listener)
+	}
+	return listeners, nil
+}
+
+// listenFDNames parses systemd's socket activation environment variables
+// for process pid, returning a name for each descriptor passed to it. There
+// are none if the variables are missing, malformed, or meant for some other
+// process.
+func listenFDNames(listen_pid, listen_fds, fd_names string,
+	pid int) []string {
+	parsed_pid, err := strconv.Atoi(listen_pid)
+	if err != nil || parsed_pid != pid {
+		return nil
+	}
+	count, err := strconv.Atoi(listen_fds)
+	if err != nil || count <= 0 {
+		return nil
+	}
+	given := strings.Split(fd_names, ":")
+	names := make([]string, count)
+	for i := range names {
+		names[i] = fmt.Sprintf("LISTEN_FD_%d", systemdFirstFD+i)
+		if i < len(given) && given[i] != "" {
+			names[i] = given[i]
+		}
+	}
+	return names
+}
+
+// InheritedListeners returns the listeners passed to the process with
+// systemd's socket activation protocol, if any. The protocol's environment
+// variables are cleared, so that child processes don't see them.
+func InheritedListeners() (listeners []net.Listener, err error) {
+	defer os.Unsetenv("LISTEN_PID")
+	defer os.Unsetenv("LISTEN_FDS")
+	defer os.Unsetenv("LISTEN_FDNAMES")
+	names := listenFDNames(os.Getenv("LISTEN_PID"), os.Getenv("LISTEN_FDS"),
+		os.Getenv("LISTEN_FDNAMES"), os.Getpid())
+	for i, name := range names {
+		fh := os.NewFile(uintptr(systemdFirstFD+i), name)
+		// FileListener makes its own close-on-exec copy of the descriptor
+		listener, err := net.FileListener(fh)
+		fh.Close()
+		if err != nil {
+			for _, l := range listeners {
+				l.Close()
+			}
+			return nil, fmt.Errorf("inherited socket %s: %v", name, err)
+		}
+		listeners = append(listeners, listener)
+	}
+	return listeners, nil
+}
+
+// ServeListeners serves all of listeners at once, as with Serve. If one of
+// them fails, the rest stop accepting connections too. It returns once all
+// of them are done, with the first error.
+func (r *RestrictedServer) ServeListeners(listeners []net.Listener) (
+	err error) {
+	defer mon.Task()(nil)(&err)
+	if len(listeners) == 0 {
+		return fmt.Errorf("no listeners")
+	}
+	errs := make(chan error, len(listeners))
+	var wg sync.WaitGroup
+	for _, listener := range listeners {
+		wg.Add(1)
+		go func(listener net.Listener) {
+			defer wg.Done()
+			errs <- r.Serve(listener)
+		}(listener)
+	}
+	err = <-errs
+	if err != ErrServerClosed {
+		logger.Errore(r.stopAccepting())
+	}
+	wg.Wait()
+	return err
+}
@@ -0,0 +1,62 @@
+// Copyright (C) 2014 JT Olds
+// See LICENSE for copying information
+
+package ssh
+
+import (
+	"os"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestListenFDNames(t *testing.T) {
+	for _, test := range []struct {
+		name     string
+		pid, fds string
+		fd_names string
+		expected string
+	}{
+		{name: "unset"},
+		{name: "one", pid: "100", fds: "1", expected: "LISTEN_FD_3"},
+		{name: "named", pid: "100", fds: "2", fd_names: "ssh:admin",
+			expected: "ssh,admin"},
+		{name: "some named", pid: "100", fds: "3", fd_names: "ssh::admin",
+			expected: "ssh,LISTEN_FD_4,admin"},
+		{name: "fewer names", pid: "100", fds: "2", fd_names: "ssh",
+			expected: "ssh,LISTEN_FD_4"},
+		{name: "extra names", pid: "100", fds: "1", fd_names: "ssh:admin",
+			expected: "ssh"},
+		{name: "other process", pid: "101", fds: "1"},
+		{name: "bad pid", pid: "pid", fds: "1"},
+		{name: "no pid", fds: "1"},
+		{name: "no count", pid: "100"},
+		{name: "zero count", pid: "100", fds: "0"},
+		{name: "negative count", pid: "100", fds: "-1"},
+		{name: "bad count", pid: "100", fds: "1x"},
+	} {
+		names := listenFDNames(test.pid, test.fds, test.fd_names, 100)
+		if strings.Join(names, ",") != test.expected {
+			t.Errorf("%s: got %#v, expected %#v", test.name, names,
+				test.expected)
+		}
+	}
+}
+
+func TestInheritedListenersEnv(t *testing.T) {
+	// meant for our parent, say, so nothing is inherited, but the variables
+	// are cleared all the same
+	t.Setenv("LISTEN_PID", strconv.Itoa(os.Getppid()))
+	t.Setenv("LISTEN_FDS", "1")
+	t.Setenv("LISTEN_FDNAMES", "ssh")
+	listeners, err := InheritedListeners()
+	if err != nil || len(listeners) != 0 {
+		t.Fatalf("got %v, %v", listeners, err)
+	}
+	for _, name := range []string{"LISTEN_PID", "LISTEN_FDS",
+		"LISTEN_FDNAMES"} {
+		if value, set := os.LookupEnv(name); set {
+			t.Errorf("%s left set to %#v", name, value)
+		}
+	}
+}
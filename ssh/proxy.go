@@ -0,0 +1,220 @@
+// Copyright (C) 2014 JT Olds
+// See LICENSE for copying information
+
+package ssh
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ProxyProtocol accepts PROXY protocol headers, as sent by e.g. HAProxy's
+// send-proxy and send-proxy-v2 options, from trusted proxies. The client
+// address in the header replaces the proxy's as the connection's
+// RemoteAddr, everywhere from key options to handlers' ConnMetadata.
+type ProxyProtocol struct {
+	// Connections from TrustedProxies must start with a version 1 or 2
+	// PROXY protocol header. Connections from anywhere else are taken as
+	// they are.
+	TrustedProxies []*net.IPNet
+	// How long trusted proxies have to send the header. Defaults to 10
+	// seconds.
+	HeaderTimeout time.Duration
+}
+
+const (
+	defaultProxyHeaderTimeout = 10 * time.Second
+	// the longest possible version 1 header
+	maxProxyV1Header = 107
+)
+
+var proxyV2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+// ParseTrustedProxies parses a comma-separated list of CIDR ranges and IPs,
+// for ProxyProtocol.TrustedProxies.
+func ParseTrustedProxies(list string) (nets []*net.IPNet, err error) {
+	for _, entry := range strings.Split(list, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		if !strings.Contains(entry, "/") {
+			ip := net.ParseIP(entry)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid IP %#v", entry)
+			}
+			bits := 8 * net.IPv6len
+			if ip.To4() != nil {
+				ip, bits = ip.To4(), 8*net.IPv4len
+			}
+			nets = append(nets, &net.IPNet{
+				IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, ip_net, err := net.ParseCIDR(entry)
+		if err != nil {
+			return nil, err
+		}
+		nets = append(nets, ip_net)
+	}
+	return nets, nil
+}
+
+func (p *ProxyProtocol) trusted(addr net.Addr) bool {
+	tcp_addr, ok := addr.(*net.TCPAddr)
+	if !ok {
+		return false
+	}
+	for _, ip_net := range p.TrustedProxies {
+		if ip_net.Contains(tcp_addr.IP) {
+			return true
+		}
+	}
+	return false
+}
+
+// proxyConn is a connection from a proxy, with the client's address.
+type proxyConn struct {
+	net.Conn
+	reader *bufio.Reader
+	remote net.Addr
+}
+
+func (c *proxyConn) Read(p []byte) (int, error) { return c.reader.Read(p) }
+
+func (c *proxyConn) RemoteAddr() net.Addr { return c.remote }
+
+// accept reads the PROXY protocol header from conn if it's from a trusted
+// proxy, returning a connection with the client's address.
+func (p *ProxyProtocol) accept(conn net.Conn) (rv net.Conn, err error) {
+	defer mon.Task()(nil)(&err)
+	if !p.trusted(conn.RemoteAddr()) {
+		return conn, nil
+	}
+	timeout := p.HeaderTimeout
+	if timeout <= 0 {
+		timeout = defaultProxyHeaderTimeout
+	}
+	err = conn.SetReadDeadline(time.Now().Add(timeout))
+	if err != nil {
+		return nil, err
+	}
+	reader := bufio.NewReader(conn)
+	remote, err := readProxyHeader(reader)
+	if err != nil {
+		mon.Meter("proxy_header_errors").Mark(1)
+		return nil, fmt.Errorf("PROXY protocol header from %s: %v",
+			conn.RemoteAddr(), err)
+	}
+	err = conn.SetReadDeadline(time.Time{})
+	if err != nil {
+		return nil, err
+	}
+	if remote == nil {
+		// e.g. the proxy's own health checks
+		remote = conn.RemoteAddr()
+	} else {
+		logger.Debugf("connection from %s via proxy %s", remote,
+			conn.RemoteAddr())
+	}
+	return &proxyConn{Conn: conn, reader: reader, remote: remote}, nil
+}
+
+// readProxyHeader reads a version 1 or 2 header, returning the client's
+// address, or nil if the header doesn't have one.
+func readProxyHeader(reader *bufio.Reader) (net.Addr, error) {
+	signature, err := reader.Peek(len(proxyV2Signature))
+	if err != nil {
+		return nil, err
+	}
+	if bytes.Equal(signature, proxyV2Signature) {
+		return readProxyV2Header(reader)
+	}
+	if !bytes.HasPrefix(signature, []byte("PROXY ")) {
+		return nil, fmt.Errorf("missing header")
+	}
+	return readProxyV1Header(reader)
+}
+
+func readProxyV1Header(reader *bufio.Reader) (net.Addr, error) {
+	var line []byte
+	for !bytes.HasSuffix(line, []byte("\r\n")) {
+		if len(line) >= maxProxyV1Header {
+			return nil, fmt.Errorf("header too long")
+		}
+		b, err := reader.ReadByte()
+		if err != nil {
+			return nil, err
+		}
+		line = append(line, b)
+	}
+	fields := strings.Split(strings.TrimSuffix(string(line), "\r\n"), " ")
+	if len(fields) >= 2 && fields[1] == "UNKNOWN" {
+		return nil, nil
+	}
+	if len(fields) != 6 || (fields[1] != "TCP4" && fields[1] != "TCP6") {
+		return nil, fmt.Errorf("malformed header %#v", string(line))
+	}
+	// fields 2 and 3 are the source and destination addresses, and 4 and 5
+	// the ports
+	var ips [2]net.IP
+	var ports [2]uint64
+	for i := range ips {
+		port, err := strconv.ParseUint(fields[4+i], 10, 16)
+		ips[i], ports[i] = net.ParseIP(fields[2+i]), port
+		if ips[i] == nil || err != nil ||
+			strings.Contains(fields[2+i], ":") != (fields[1] == "TCP6") {
+			return nil, fmt.Errorf("malformed header %#v", string(line))
+		}
+	}
+	return &net.TCPAddr{IP: ips[0], Port: int(ports[0])}, nil
+}
+
+func readProxyV2Header(reader *bufio.Reader) (net.Addr, error) {
+	var header [16]byte
+	_, err := io.ReadFull(reader, header[:])
+	if err != nil {
+		return nil, err
+	}
+	version, command := header[12]>>4, header[12]&0xf
+	if version != 2 {
+		return nil, fmt.Errorf("unsupported version %d", version)
+	}
+	payload := make([]byte, binary.BigEndian.Uint16(header[14:16]))
+	_, err = io.ReadFull(reader, payload)
+	if err != nil {
+		return nil, err
+	}
+	switch command {
+	case 0: // LOCAL
+		return nil, nil
+	case 1: // PROXY
+	default:
+		return nil, fmt.Errorf("unsupported command %d", command)
+	}
+	// only the high nibble, the address family, matters. the transport is
+	// whatever it is.
+	var ip_len int
+	switch header[13] >> 4 {
+	case 1: // AF_INET
+		ip_len = net.IPv4len
+	case 2: // AF_INET6
+		ip_len = net.IPv6len
+	default:
+		return nil, nil
+	}
+	if len(payload) < 2*ip_len+4 {
+		return nil, fmt.Errorf("short address block")
+	}
+	ip := make(net.IP, ip_len)
+	copy(ip, payload[:ip_len])
+	port := binary.BigEndian.Uint16(payload[2*ip_len:])
+	return &net.TCPAddr{IP: ip, Port: int(port)}, nil
+}
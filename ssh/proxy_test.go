@@ -0,0 +1,259 @@
+// Copyright (C) 2014 JT Olds
+// See LICENSE for copying information
+
+package ssh
+
+import (
+	"bufio"
+	"encoding/binary"
+	"io/ioutil"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+// proxyV2Header builds a version 2 header with the given version and
+// command byte, family byte and address block.
+func proxyV2Header(version_command, family byte, block []byte) string {
+	header := append([]byte(nil), proxyV2Signature...)
+	header = append(header, version_command, family, 0, 0)
+	binary.BigEndian.PutUint16(header[14:], uint16(len(block)))
+	return string(append(header, block...))
+}
+
+// inetBlock is a version 2 address block for src and dst, which must be the
+// same length.
+func inetBlock(src, dst net.IP, src_port, dst_port uint16) []byte {
+	block := append(append([]byte(nil), src...), dst...)
+	var ports [4]byte
+	binary.BigEndian.PutUint16(ports[:2], src_port)
+	binary.BigEndian.PutUint16(ports[2:], dst_port)
+	return append(block, ports[:]...)
+}
+
+func TestReadProxyHeader(t *testing.T) {
+	v4 := inetBlock(net.ParseIP("192.0.2.1").To4(),
+		net.ParseIP("192.0.2.2").To4(), 1234, 22)
+	v6 := inetBlock(net.ParseIP("2001:db8::1"), net.ParseIP("2001:db8::2"),
+		1234, 22)
+	unix_block := make([]byte, 216)
+	copy(unix_block, "/tmp/client.sock")
+
+	for _, test := range []struct {
+		name   string
+		in     string
+		remote string
+		err    bool
+	}{
+		{name: "v1 tcp4",
+			in:     "PROXY TCP4 192.0.2.1 192.0.2.2 1234 22\r\nSSH-2.0-x\r\n",
+			remote: "192.0.2.1:1234"},
+		{name: "v1 tcp6",
+			in:     "PROXY TCP6 2001:db8::1 2001:db8::2 1234 22\r\nSSH-2.0-x\r\n",
+			remote: "[2001:db8::1]:1234"},
+		{name: "v1 unknown", in: "PROXY UNKNOWN\r\nSSH-2.0-x\r\n"},
+		{name: "v1 unknown with addresses",
+			in: "PROXY UNKNOWN 192.0.2.1 192.0.2.2 1234 22\r\nSSH-2.0-x\r\n"},
+		{name: "v1 longest",
+			remote: "[ffff:ffff:ffff:ffff:ffff:ffff:ffff:ffff]:65535",
+			in: "PROXY TCP6 ffff:ffff:ffff:ffff:ffff:ffff:ffff:ffff " +
+				"ffff:ffff:ffff:ffff:ffff:ffff:ffff:ffff 65535 65535\r\n" +
+				"SSH-2.0-x\r\n"},
+		{name: "v1 too long", err: true,
+			in: "PROXY TCP4 " + strings.Repeat("1", 200) + "\r\n"},
+		{name: "v1 no crlf", err: true,
+			in: "PROXY TCP4 192.0.2.1 192.0.2.2 1234 22\nSSH-2.0-x\r\n"},
+		{name: "v1 truncated", err: true,
+			in: "PROXY TCP4 192.0.2.1 192.0.2.2 1234"},
+		{name: "v1 missing fields", err: true,
+			in: "PROXY TCP4 192.0.2.1 192.0.2.2 1234\r\n"},
+		{name: "v1 bad protocol", err: true,
+			in: "PROXY UDP4 192.0.2.1 192.0.2.2 1234 22\r\n"},
+		{name: "v1 bad ip", err: true,
+			in: "PROXY TCP4 192.0.2.300 192.0.2.2 1234 22\r\n"},
+		{name: "v1 family mismatch", err: true,
+			in: "PROXY TCP4 2001:db8::1 2001:db8::2 1234 22\r\n"},
+		{name: "v1 bad port", err: true,
+			in: "PROXY TCP4 192.0.2.1 192.0.2.2 65536 22\r\n"},
+		{name: "no header", in: "SSH-2.0-OpenSSH_9.0\r\n", err: true},
+		{name: "short", in: "PROXY", err: true},
+		{name: "empty", in: "", err: true},
+
+		{name: "v2 tcp4", in: proxyV2Header(0x21, 0x11, v4) + "SSH-2.0-x",
+			remote: "192.0.2.1:1234"},
+		{name: "v2 udp6", in: proxyV2Header(0x21, 0x22, v6) + "SSH-2.0-x",
+			remote: "[2001:db8::1]:1234"},
+		{name: "v2 with tlvs",
+			in: proxyV2Header(0x21, 0x11,
+				append(append([]byte(nil), v4...), 0x04, 0, 1, 0)) + "SSH-2.0-x",
+			remote: "192.0.2.1:1234"},
+		{name: "v2 local", in: proxyV2Header(0x20, 0x00, nil) + "SSH-2.0-x"},
+		{name: "v2 local with addresses",
+			in: proxyV2Header(0x20, 0x11, v4) + "SSH-2.0-x"},
+		{name: "v2 unix", in: proxyV2Header(0x21, 0x31, unix_block) +
+			"SSH-2.0-x"},
+		{name: "v2 unspec", in: proxyV2Header(0x21, 0x00, nil) + "SSH-2.0-x"},
+		{name: "v2 short address block", err: true,
+			in: proxyV2Header(0x21, 0x21, v4) + "SSH-2.0-x"},
+		{name: "v2 bad version", err: true,
+			in: proxyV2Header(0x11, 0x11, v4) + "SSH-2.0-x"},
+		{name: "v2 bad command", err: true,
+			in: proxyV2Header(0x22, 0x11, v4) + "SSH-2.0-x"},
+		{name: "v2 truncated header", err: true,
+			in: proxyV2Header(0x21, 0x11, v4)[:14]},
+		{name: "v2 truncated addresses", err: true,
+			in: proxyV2Header(0x21, 0x11, v4)[:20]},
+	} {
+		reader := bufio.NewReader(strings.NewReader(test.in))
+		remote, err := readProxyHeader(reader)
+		if test.err {
+			if err == nil {
+				t.Errorf("%s: expected error, got %v", test.name, remote)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: unexpected error: %v", test.name, err)
+			continue
+		}
+		if test.remote == "" {
+			if remote != nil {
+				t.Errorf("%s: got %v, expected no address", test.name, remote)
+			}
+		} else if remote == nil {
+			t.Errorf("%s: got no address, expected %s", test.name, test.remote)
+		} else if remote.String() != test.remote {
+			t.Errorf("%s: got %v, expected %s", test.name, remote, test.remote)
+		}
+		rest, _ := ioutil.ReadAll(reader)
+		if !strings.HasPrefix(string(rest), "SSH-2.0-x") {
+			t.Errorf("%s: header not consumed, %#v left", test.name,
+				string(rest))
+		}
+	}
+}
+
+func TestParseTrustedProxies(t *testing.T) {
+	for _, test := range []struct {
+		in   string
+		nets []string
+		err  bool
+	}{
+		{in: "", nets: nil},
+		{in: "10.0.0.0/8", nets: []string{"10.0.0.0/8"}},
+		{in: " 10.1.2.3/8 , 192.0.2.1,2001:db8::1,2001:db8::/32,",
+			nets: []string{"10.0.0.0/8", "192.0.2.1/32", "2001:db8::1/128",
+				"2001:db8::/32"}},
+		{in: "::ffff:192.0.2.1", nets: []string{"192.0.2.1/32"}},
+		{in: "proxy.example.com", err: true},
+		{in: "10.0.0.0/33", err: true},
+	} {
+		nets, err := ParseTrustedProxies(test.in)
+		if test.err {
+			if err == nil {
+				t.Errorf("%#v: expected error, got %v", test.in, nets)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%#v: unexpected error: %v", test.in, err)
+			continue
+		}
+		var got []string
+		for _, ip_net := range nets {
+			got = append(got, ip_net.String())
+		}
+		if strings.Join(got, ",") != strings.Join(test.nets, ",") {
+			t.Errorf("%#v: got %v, expected %v", test.in, got, test.nets)
+		}
+	}
+}
+
+// proxyConnPair returns both ends of a loopback TCP connection, after
+// sending header from the client end.
+func proxyConnPair(t *testing.T, header string) (client, server net.Conn) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	client, err = net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { client.Close() })
+	server, err = listener.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { server.Close() })
+	_, err = client.Write([]byte(header))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return client, server
+}
+
+func TestProxyProtocolAccept(t *testing.T) {
+	loopback, _ := ParseTrustedProxies("127.0.0.1")
+	elsewhere, _ := ParseTrustedProxies("192.0.2.0/24")
+	header := "PROXY TCP4 192.0.2.1 192.0.2.2 1234 22\r\n"
+
+	for _, test := range []struct {
+		name    string
+		trusted []*net.IPNet
+		sent    string
+		remote  string
+		data    string
+		err     bool
+	}{
+		{name: "trusted", trusted: loopback, sent: header + "SSH-2.0-x\r\n",
+			remote: "192.0.2.1:1234", data: "SSH-2.0-x\r\n"},
+		{name: "trusted local", trusted: loopback,
+			sent: proxyV2Header(0x20, 0, nil) + "SSH-2.0-x\r\n",
+			data: "SSH-2.0-x\r\n"},
+		{name: "trusted without header", trusted: loopback,
+			sent: "SSH-2.0-OpenSSH_9.0\r\n", err: true},
+		{name: "untrusted keeps its address", trusted: elsewhere,
+			sent: header + "SSH-2.0-x\r\n", data: header + "SSH-2.0-x\r\n"},
+		{name: "nothing trusted", sent: header, data: header},
+	} {
+		p := &ProxyProtocol{TrustedProxies: test.trusted}
+		_, server := proxyConnPair(t, test.sent)
+		conn, err := p.accept(server)
+		if test.err {
+			if err == nil {
+				t.Errorf("%s: expected error", test.name)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: unexpected error: %v", test.name, err)
+			continue
+		}
+		remote := test.remote
+		if remote == "" {
+			remote = server.RemoteAddr().String()
+		}
+		if conn.RemoteAddr().String() != remote {
+			t.Errorf("%s: got remote %v, expected %s", test.name,
+				conn.RemoteAddr(), remote)
+		}
+		data := make([]byte, len(test.data))
+		_, err = conn.Read(data)
+		if err != nil || string(data) != test.data {
+			t.Errorf("%s: read %#v, %v, expected %#v", test.name, string(data),
+				err, test.data)
+		}
+	}
+
+	// trusted proxies that don't send a header in time are dropped
+	p := &ProxyProtocol{TrustedProxies: loopback,
+		HeaderTimeout: 10 * time.Millisecond}
+	_, server := proxyConnPair(t, "PROXY TCP4")
+	_, err := p.accept(server)
+	if err == nil {
+		t.Errorf("accepted a connection without a whole header")
+	}
+}
@@ -4,10 +4,13 @@
 package ssh
 
 import (
+	"context"
 	"encoding/binary"
+	"errors"
 	"fmt"
 	"io"
 	"net"
+	"sync"
 	"time"
 
 	"github.com/spacemonkeygo/spacelog"
@@ -18,21 +21,108 @@ import (
 var (
 	logger = spacelog.GetLogger()
 	mon    = monkit.Package()
+
+	// ErrServerClosed is returned by Serve and ListenAndServe after a call to
+	// Shutdown or Close.
+	ErrServerClosed = errors.New("ssh: server closed")
 )
 
+// CommandHandler handles a single exec request. ctx is canceled when the
+// connection goes away or when the server is forcibly closed. env contains
+// "NAME=value" entries for any allowed environment variables the client
+// requested. Permissions(meta) returns the connection's ssh.Permissions.
 type CommandHandler func(
+	ctx context.Context,
 	command string,
+	env []string,
 	stdin io.Reader,
 	stdout, stderr io.Writer,
 	meta ssh.ConnMetadata) (
 	exit_status uint32, err error)
 
+// Permissions returns what the SSHConfig's authentication callback returned
+// for the key the client actually authenticated with, given the meta a
+// CommandHandler or SessionEnd was called with. Unlike anything recorded
+// from inside the callback, this can't be confused by clients offering
+// several keys.
+func Permissions(meta ssh.ConnMetadata) *ssh.Permissions {
+	if sc, ok := meta.(*ssh.ServerConn); ok {
+		return sc.Permissions
+	}
+	return nil
+}
+
 type RestrictedServer struct {
 	SSHConfig  *ssh.ServerConfig
 	ShellError string
 	MOTD       string
 	Handler    CommandHandler
 	SessionEnd func(meta ssh.ConnMetadata)
+
+	// HandshakeError, if set, is called when a connection fails the
+	// handshake after its client started authenticating, e.g. because of a
+	// bad signature, which never reaches SSHConfig.AuthLogCallback. meta is
+	// what SSHConfig's callbacks were given.
+	HandshakeError func(meta ssh.ConnMetadata, err error)
+
+	// AllowedEnv lists the environment variable names clients may set with
+	// "env" requests. All other env requests are rejected.
+	AllowedEnv []string
+
+	// HostKeys, if set, are announced to clients after the handshake with
+	// OpenSSH's hostkeys-00@openssh.com extension, so that clients with
+	// UpdateHostKeys enabled learn about new keys before they're needed,
+	// e.g. ahead of a host key rotation. It should include the host keys in
+	// SSHConfig. Add RSA host keys to SSHConfig with AddHostKey, so that
+	// their proofs use the signature algorithm clients expect.
+	HostKeys []ssh.Signer
+
+	// If set, limits how much of the server clients may use.
+	Limits *Limits
+
+	// Timeouts bounds how long connections may take.
+	Timeouts Timeouts
+
+	// If set, PROXY protocol headers are accepted from trusted proxies.
+	ProxyProtocol *ProxyProtocol
+
+	limiter   limiter
+	mtx       sync.Mutex
+	ctx       context.Context
+	cancel    func()
+	closed    bool
+	listeners map[net.Listener]bool
+	conns     map[net.Conn]bool
+	execs     sync.WaitGroup
+	kex_algos map[string]kexAlgorithm
+}
+
+// ExitSignal may be returned as the error from a CommandHandler to report
+// that the command was terminated by a signal. It is relayed to the client
+// as an "exit-signal" request instead of an "exit-status".
+type ExitSignal struct {
+	// Signal is the signal name without the "SIG" prefix, e.g. "KILL".
+	Signal     string
+	CoreDumped bool
+	Message    string
+}
+
+func (e *ExitSignal) Error() string {
+	if e.Message != "" {
+		return fmt.Sprintf("killed by signal %s: %s", e.Signal, e.Message)
+	}
+	return fmt.Sprintf("killed by signal %s", e.Signal)
+}
+
+func writeExitSignal(ch ssh.Channel, sig *ExitSignal) (err error) {
+	defer mon.Task()(nil)(&err)
+	_, err = ch.SendRequest("exit-signal", false, ssh.Marshal(struct {
+		Signal     string
+		CoreDumped bool
+		Message    string
+		Lang       string
+	}{Signal: sig.Signal, CoreDumped: sig.CoreDumped, Message: sig.Message}))
+	return err
 }
 
 func writeExitStatus(ch ssh.Channel, status uint32) (err error) {
@@ -43,23 +133,168 @@ func writeExitStatus(ch ssh.Channel, status uint32) (err error) {
 	return err
 }
 
-func (r *RestrictedServer) handleExec(ch ssh.Channel, command string,
-	meta ssh.ConnMetadata) (exit_status uint32, err error) {
+// init sets up the server's lifecycle state. r.mtx must be held.
+func (r *RestrictedServer) init() {
+	if r.ctx == nil {
+		r.ctx, r.cancel = context.WithCancel(context.Background())
+	}
+	if r.listeners == nil {
+		r.listeners = make(map[net.Listener]bool)
+	}
+	if r.conns == nil {
+		r.conns = make(map[net.Conn]bool)
+	}
+}
+
+func (r *RestrictedServer) context() context.Context {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+	r.init()
+	return r.ctx
+}
+
+func (r *RestrictedServer) shuttingDown() bool {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+	return r.closed
+}
+
+func (r *RestrictedServer) trackListener(l net.Listener, add bool) bool {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+	r.init()
+	if !add {
+		delete(r.listeners, l)
+		return true
+	}
+	if r.closed {
+		return false
+	}
+	r.listeners[l] = true
+	return true
+}
+
+func (r *RestrictedServer) trackConn(c net.Conn, add bool) bool {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+	r.init()
+	if !add {
+		delete(r.conns, c)
+		return true
+	}
+	if r.closed {
+		return false
+	}
+	r.conns[c] = true
+	return true
+}
+
+// startExec registers a new running exec session, unless the server is
+// shutting down.
+func (r *RestrictedServer) startExec() bool {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+	if r.closed {
+		return false
+	}
+	r.execs.Add(1)
+	return true
+}
+
+// stopAccepting marks the server as closed and closes all listeners.
+func (r *RestrictedServer) stopAccepting() (err error) {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+	r.init()
+	r.closed = true
+	for l := range r.listeners {
+		if close_err := l.Close(); close_err != nil && err == nil {
+			err = close_err
+		}
+		delete(r.listeners, l)
+	}
+	return err
+}
+
+// closeConns cancels all handler contexts and closes every open connection.
+func (r *RestrictedServer) closeConns() {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+	r.init()
+	r.cancel()
+	for c := range r.conns {
+		c.Close()
+		delete(r.conns, c)
+	}
+}
+
+// Shutdown stops accepting new connections and exec requests, then waits for
+// running exec sessions to finish. If ctx expires first, handler contexts
+// are canceled and all connections are forcibly closed, and ctx's error is
+// returned.
+func (r *RestrictedServer) Shutdown(ctx context.Context) (err error) {
+	defer mon.Task()(&ctx)(&err)
+	err = r.stopAccepting()
+	done := make(chan struct{})
+	go func() {
+		r.execs.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-ctx.Done():
+		r.closeConns()
+		return ctx.Err()
+	}
+	r.closeConns()
+	return err
+}
+
+// Close immediately closes all listeners and connections, canceling any
+// running handlers.
+func (r *RestrictedServer) Close() (err error) {
 	defer mon.Task()(nil)(&err)
+	err = r.stopAccepting()
+	r.closeConns()
+	return err
+}
+
+func (r *RestrictedServer) envAllowed(name string) bool {
+	for _, allowed := range r.AllowedEnv {
+		if name == allowed {
+			return true
+		}
+	}
+	return false
+}
+
+func (r *RestrictedServer) handleExec(ctx context.Context, ch ssh.Channel,
+	command string, env []string, meta ssh.ConnMetadata) (
+	exit_status uint32, err error) {
+	defer mon.Task()(&ctx)(&err)
+	if r.Limits != nil && isPush(command) &&
+		!r.limiter.allowPush(r.Limits, r.limitsUser(meta)) {
+		logger.Noticef("push rate exceeded for %#v from %s",
+			r.limitsUser(meta), meta.RemoteAddr())
+		_, err = ch.Stderr().Write([]byte(
+			"push rate exceeded, try again later\r\n"))
+		return 1, err
+	}
 	if r.Handler != nil {
-		return r.Handler(command, ch, ch, ch.Stderr(), meta)
+		return r.Handler(ctx, command, env, ch, ch, ch.Stderr(), meta)
 	}
 	_, err = ch.Stderr().Write([]byte(
 		fmt.Sprintf("command rejected: %#v\r\n", command)))
 	return 1, err
 }
 
-func (r *RestrictedServer) handleChan(ch ssh.Channel,
+func (r *RestrictedServer) handleChan(ctx context.Context, ch ssh.Channel,
 	reqs <-chan *ssh.Request, meta ssh.ConnMetadata) (err error) {
-	defer mon.Task()(nil)(&err)
+	defer mon.Task()(&ctx)(&err)
 	defer ch.Close()
 	exec_happened := false
 	pty_requested := false
+	var env []string
 	for req := range reqs {
 		switch req.Type {
 		case "pty-req":
@@ -88,7 +323,17 @@ func (r *RestrictedServer) handleChan(ch ssh.Channel,
 			}
 			return writeExitStatus(ch, 1)
 		case "env":
-			err := req.Reply(false, nil)
+			var payload struct {
+				Name  string
+				Value string
+			}
+			ok := !exec_happened &&
+				ssh.Unmarshal(req.Payload, &payload) == nil &&
+				r.envAllowed(payload.Name)
+			if ok {
+				env = append(env, payload.Name+"="+payload.Value)
+			}
+			err := req.Reply(ok, nil)
 			if err != nil {
 				return err
 			}
@@ -102,6 +347,15 @@ func (r *RestrictedServer) handleChan(ch ssh.Channel,
 			}
 			continue
 		}
+
+		if !r.startExec() {
+			// we're shutting down
+			err := req.Reply(false, nil)
+			if err != nil {
+				return err
+			}
+			continue
+		}
 		exec_happened = true
 
 		payload_len := binary.BigEndian.Uint32(req.Payload[:4])
@@ -119,13 +373,16 @@ func (r *RestrictedServer) handleChan(ch ssh.Channel,
 
 		err := req.Reply(true, nil)
 		if err != nil {
+			r.execs.Done()
 			return err
 		}
 
+		command := string(req.Payload[4:])
 		go func() {
+			defer r.execs.Done()
 			defer ch.Close()
 			if r.MOTD != "" {
-				_, err = ch.Stderr().Write([]byte(r.MOTD))
+				_, err := ch.Stderr().Write([]byte(r.MOTD))
 				if err != nil {
 					logger.Errore(err)
 					logger.Errore(writeExitStatus(ch, 1))
@@ -133,8 +390,11 @@ func (r *RestrictedServer) handleChan(ch ssh.Channel,
 				}
 			}
 
-			exit_status, err := r.handleExec(ch, string(req.Payload[4:]), meta)
-			if err != nil {
+			exit_status, err := r.handleExec(ctx, ch, command, env, meta)
+			if sig, ok := err.(*ExitSignal); ok {
+				logger.Noticef("command %#v: %v", command, sig)
+				logger.Errore(writeExitSignal(ch, sig))
+			} else if err != nil {
 				logger.Errore(err)
 				logger.Errore(writeExitStatus(ch, 1))
 			} else {
@@ -145,43 +405,154 @@ func (r *RestrictedServer) handleChan(ch ssh.Channel,
 	return nil
 }
 
-func (r *RestrictedServer) handleConn(conn net.Conn) (err error) {
-	defer mon.Task()(nil)(&err)
+// handshakeConfig returns the SSHConfig for a connection's handshake. If
+// HandshakeError is set, its callbacks store the ConnMetadata they're given
+// in meta.
+func (r *RestrictedServer) handshakeConfig(
+	meta *ssh.ConnMetadata) *ssh.ServerConfig {
+	if r.HandshakeError == nil {
+		return r.SSHConfig
+	}
+	config := *r.SSHConfig
+	if callback := config.PublicKeyCallback; callback != nil {
+		config.PublicKeyCallback = func(conn ssh.ConnMetadata,
+			key ssh.PublicKey) (*ssh.Permissions, error) {
+			*meta = conn
+			return callback(conn, key)
+		}
+	}
+	if callback := config.AuthLogCallback; callback != nil {
+		config.AuthLogCallback = func(conn ssh.ConnMetadata, method string,
+			err error) {
+			*meta = conn
+			callback(conn, method, err)
+		}
+	}
+	return &config
+}
+
+func (r *RestrictedServer) handleConn(ctx context.Context, conn net.Conn) (
+	err error) {
+	defer mon.Task()(&ctx)(&err)
 	defer conn.Close()
-	sc, new_chans, reqs, err := ssh.NewServerConn(conn, r.SSHConfig)
+	if !r.trackConn(conn, true) {
+		return nil
+	}
+	defer r.trackConn(conn, false)
+
+	if r.ProxyProtocol != nil {
+		// from here on, conn.RemoteAddr() is the client's, not the proxy's
+		conn, err = r.ProxyProtocol.accept(conn)
+		if err != nil {
+			return err
+		}
+	}
+
+	var ip string
+	if r.Limits != nil {
+		ip = addrIP(conn.RemoteAddr())
+		if reason := r.limiter.admitConn(r.Limits, ip); reason != "" {
+			logger.Noticef("refusing connection from %s: %s", conn.RemoteAddr(),
+				reason)
+			return nil
+		}
+		defer r.limiter.releaseConn(ip)
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	defer closeAfter(conn, r.Timeouts.MaxSessionDuration,
+		"maximum session duration")()
+	ssh_conn := conn
+	if r.Timeouts.IdleTimeout > 0 {
+		ssh_conn = &idleConn{Conn: conn, timeout: r.Timeouts.IdleTimeout}
+	}
+	stop_handshake_timer := closeAfter(conn, r.Timeouts.HandshakeTimeout,
+		"handshake timeout")
+	var auth_meta ssh.ConnMetadata
+	sc, new_chans, reqs, err := ssh.NewServerConn(ssh_conn,
+		r.handshakeConfig(&auth_meta))
+	if !stop_handshake_timer() && err == nil {
+		// the timer went off just as the handshake finished
+		err = fmt.Errorf("handshake timed out")
+	}
 	if err != nil {
+		if r.HandshakeError != nil && auth_meta != nil {
+			r.HandshakeError(auth_meta, err)
+		}
+		if r.Limits != nil && isAuthFailure(err) &&
+			r.limiter.authFailed(r.Limits, ip) {
+			logger.Warnf("banning %s for %s after repeated authentication "+
+				"failures", ip, r.Limits.banDuration())
+		}
 		return err
 	}
 	defer sc.Close()
 	if r.SessionEnd != nil {
-		defer r.SessionEnd(sc.Conn)
+		defer r.SessionEnd(sc)
+	}
+	over_limit := false
+	if r.Limits != nil {
+		user := r.limitsUser(sc)
+		if r.limiter.admitUser(r.Limits, user) {
+			defer r.limiter.releaseUser(user)
+		} else {
+			logger.Noticef("refusing sessions for %#v from %s: too many "+
+				"connections", user, sc.RemoteAddr())
+			over_limit = true
+		}
+	}
+	go r.handleGlobalRequests(sc, reqs, r.takeKexAlgorithm(sc.SessionID()))
+	if r.Timeouts.KeepaliveInterval > 0 {
+		go r.keepalive(ctx, sc)
+	}
+	if len(r.HostKeys) > 0 {
+		err = r.announceHostKeys(sc)
+		if err != nil {
+			return err
+		}
 	}
-	go ssh.DiscardRequests(reqs)
 
 	for new_chan := range new_chans {
 		if new_chan.ChannelType() != "session" {
 			new_chan.Reject(ssh.UnknownChannelType, "unknown channel type")
 			continue
 		}
+		if over_limit {
+			new_chan.Reject(ssh.ResourceShortage, "too many connections")
+			continue
+		}
 		ch, reqs, err := new_chan.Accept()
 		if err != nil {
 			return fmt.Errorf("could not accept channel")
 		}
 		go func() {
-			logger.Errore(r.handleChan(ch, reqs, sc.Conn))
+			logger.Errore(r.handleChan(ctx, ch, reqs, sc))
 		}()
 	}
 	return nil
 }
 
+// Serve accepts connections on listener until Shutdown or Close is called,
+// after which it returns ErrServerClosed.
 func (r *RestrictedServer) Serve(listener net.Listener) (err error) {
 	defer mon.Task()(nil)(&err)
 	defer listener.Close()
+	if !r.trackListener(listener, true) {
+		return ErrServerClosed
+	}
+	defer r.trackListener(listener, false)
+	ctx := r.context()
+
 	logger.Noticef("listening on %s", listener.Addr())
 	var delay time.Duration
 	for {
 		conn, err := listener.Accept()
 		if err != nil {
+			if r.shuttingDown() {
+				return ErrServerClosed
+			}
 			if net_err, ok := err.(net.Error); ok && net_err.Temporary() {
 				if delay == 0 {
 					delay = 5 * time.Millisecond
@@ -199,7 +570,7 @@ func (r *RestrictedServer) Serve(listener net.Listener) (err error) {
 		}
 		delay = 0
 		go func() {
-			err := r.handleConn(conn)
+			err := r.handleConn(ctx, conn)
 			if err != nil && err != io.EOF {
 				logger.Errore(err)
 			}
@@ -0,0 +1,237 @@
+// Copyright (C) 2014 JT Olds
+// See LICENSE for copying information
+
+package ssh
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+func testSigner(t *testing.T) ssh.Signer {
+	_, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signer, err := ssh.NewSignerFromKey(priv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return signer
+}
+
+func acceptAnyKey(meta ssh.ConnMetadata, key ssh.PublicKey) (
+	*ssh.Permissions, error) {
+	return &ssh.Permissions{}, nil
+}
+
+// testServer serves r on loopback and returns its address. Unless r has an
+// SSHConfig already, it gets one that lets any key in. r is closed when the
+// test is done.
+func testServer(t *testing.T, r *RestrictedServer) string {
+	if r.SSHConfig == nil {
+		r.SSHConfig = &ssh.ServerConfig{PublicKeyCallback: acceptAnyKey}
+		r.SSHConfig.AddHostKey(testSigner(t))
+	}
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go r.Serve(listener)
+	t.Cleanup(func() { r.Close() })
+	return listener.Addr().String()
+}
+
+func testClientConfig(t *testing.T) *ssh.ClientConfig {
+	return &ssh.ClientConfig{
+		User:            "git",
+		Auth:            []ssh.AuthMethod{ssh.PublicKeys(testSigner(t))},
+		HostKeyCallback: ssh.InsecureIgnoreHostKey()}
+}
+
+func testClient(t *testing.T, addr string) *ssh.Client {
+	client, err := ssh.Dial("tcp", addr, testClientConfig(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { client.Close() })
+	return client
+}
+
+// blockingHandler is a CommandHandler that tells started when it's called,
+// and then waits for release or, if it's set, for its context to end. In
+// the latter case, it tells canceled.
+type blockingHandler struct {
+	started  chan struct{}
+	release  chan struct{}
+	canceled chan struct{}
+	use_ctx  bool
+}
+
+func newBlockingHandler(use_ctx bool) *blockingHandler {
+	return &blockingHandler{
+		started:  make(chan struct{}, 1),
+		release:  make(chan struct{}),
+		canceled: make(chan struct{}),
+		use_ctx:  use_ctx}
+}
+
+func (h *blockingHandler) handle(ctx context.Context, command string,
+	env []string, stdin io.Reader, stdout, stderr io.Writer,
+	meta ssh.ConnMetadata) (uint32, error) {
+	h.started <- struct{}{}
+	if !h.use_ctx {
+		<-h.release
+		return 0, nil
+	}
+	select {
+	case <-h.release:
+		return 0, nil
+	case <-ctx.Done():
+		close(h.canceled)
+		return 1, ctx.Err()
+	}
+}
+
+// runCommand runs command on a new session over client in the background,
+// sending its error to the returned channel.
+func runCommand(t *testing.T, client *ssh.Client,
+	command string) <-chan error {
+	session, err := client.NewSession()
+	if err != nil {
+		t.Fatal(err)
+	}
+	done := make(chan error, 1)
+	go func() {
+		done <- session.Run(command)
+	}()
+	return done
+}
+
+func waitFor(t *testing.T, ch <-chan struct{}, what string) {
+	select {
+	case <-ch:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("timed out waiting for %s", what)
+	}
+}
+
+func TestShutdownWaits(t *testing.T) {
+	handler := newBlockingHandler(false)
+	server := &RestrictedServer{Handler: handler.handle}
+	addr := testServer(t, server)
+	client := testClient(t, addr)
+	ran := runCommand(t, client, "true")
+	waitFor(t, handler.started, "the handler")
+
+	shutdown := make(chan error, 1)
+	go func() {
+		shutdown <- server.Shutdown(context.Background())
+	}()
+	select {
+	case err := <-shutdown:
+		t.Fatalf("shutdown returned %v with an exec running", err)
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	// no new connections or commands in the meantime
+	if conn, err := ssh.Dial("tcp", addr, testClientConfig(t)); err == nil {
+		conn.Close()
+		t.Errorf("connected while shutting down")
+	}
+	session, err := client.NewSession()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := session.Run("true"); err == nil {
+		t.Errorf("ran a command while shutting down")
+	}
+
+	close(handler.release)
+	select {
+	case err := <-shutdown:
+		if err != nil {
+			t.Errorf("shutdown: %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("shutdown didn't finish")
+	}
+	if err := <-ran; err != nil {
+		t.Errorf("command failed: %v", err)
+	}
+}
+
+func TestShutdownTimeout(t *testing.T) {
+	handler := newBlockingHandler(true)
+	defer close(handler.release)
+	server := &RestrictedServer{Handler: handler.handle}
+	client := testClient(t, testServer(t, server))
+	ran := runCommand(t, client, "true")
+	waitFor(t, handler.started, "the handler")
+
+	ctx, cancel := context.WithTimeout(context.Background(),
+		100*time.Millisecond)
+	defer cancel()
+	if err := server.Shutdown(ctx); err != context.DeadlineExceeded {
+		t.Errorf("got %v, expected the deadline to pass", err)
+	}
+	waitFor(t, handler.canceled, "the handler's context to be canceled")
+	select {
+	case err := <-ran:
+		if err == nil {
+			t.Errorf("command succeeded")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("connection left open")
+	}
+}
+
+func TestClose(t *testing.T) {
+	// the handler ignores its context, and close doesn't wait for it
+	handler := newBlockingHandler(false)
+	defer close(handler.release)
+	server := &RestrictedServer{Handler: handler.handle}
+	addr := testServer(t, server)
+	client := testClient(t, addr)
+	ran := runCommand(t, client, "true")
+	waitFor(t, handler.started, "the handler")
+
+	closed := make(chan error, 1)
+	go func() {
+		closed <- server.Close()
+	}()
+	select {
+	case err := <-closed:
+		if err != nil {
+			t.Errorf("close: %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("close waited for the handler")
+	}
+	select {
+	case err := <-ran:
+		if err == nil {
+			t.Errorf("command succeeded")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("connection left open")
+	}
+	if conn, err := ssh.Dial("tcp", addr, testClientConfig(t)); err == nil {
+		conn.Close()
+		t.Errorf("connected after close")
+	}
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := server.Serve(listener); err != ErrServerClosed {
+		t.Errorf("serve after close: %v", err)
+	}
+}
@@ -0,0 +1,116 @@
+// Copyright (C) 2014 JT Olds
+// See LICENSE for copying information
+
+package ssh
+
+import (
+	"context"
+	"net"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// Timeouts bounds how long connections may take. Zero fields mean no limit.
+type Timeouts struct {
+	// Connections are closed if they haven't authenticated within
+	// HandshakeTimeout, if nothing arrives from the client for IdleTimeout,
+	// or once they've been open for MaxSessionDuration. Closing a connection
+	// cancels its handlers' contexts.
+	HandshakeTimeout   time.Duration
+	IdleTimeout        time.Duration
+	MaxSessionDuration time.Duration
+
+	// If set, a keepalive request is sent to clients every
+	// KeepaliveInterval, and connections with KeepaliveCountMax (default 3)
+	// unanswered keepalives in a row are closed. Replies count as activity
+	// for IdleTimeout, so clients waiting quietly on a long command aren't
+	// idle.
+	KeepaliveInterval time.Duration
+	KeepaliveCountMax int
+}
+
+// defaultKeepaliveCountMax is how many keepalives may go unanswered if
+// KeepaliveCountMax isn't set, as with OpenSSH's ServerAliveCountMax.
+const defaultKeepaliveCountMax = 3
+
+// idleConn is a net.Conn whose reads time out if nothing arrives for
+// timeout.
+type idleConn struct {
+	net.Conn
+	timeout time.Duration
+}
+
+func (c *idleConn) Read(p []byte) (n int, err error) {
+	err = c.Conn.SetReadDeadline(time.Now().Add(c.timeout))
+	if err != nil {
+		return 0, err
+	}
+	n, err = c.Conn.Read(p)
+	if net_err, ok := err.(net.Error); ok && net_err.Timeout() {
+		mon.Meter("conns_timed_out").Mark(1)
+		logger.Noticef("closing connection from %s: idle for %s",
+			c.RemoteAddr(), c.timeout)
+	}
+	return n, err
+}
+
+// closeAfter closes conn after timeout, unless the returned stop function is
+// called first.
+func closeAfter(conn net.Conn, timeout time.Duration, what string) (
+	stop func() bool) {
+	if timeout <= 0 {
+		return func() bool { return true }
+	}
+	return time.AfterFunc(timeout, func() {
+		mon.Meter("conns_timed_out").Mark(1)
+		logger.Noticef("closing connection from %s: %s of %s exceeded",
+			conn.RemoteAddr(), what, timeout)
+		conn.Close()
+	}).Stop
+}
+
+// keepalive sends keepalive requests every KeepaliveInterval, and closes sc
+// if KeepaliveCountMax of them in a row go unanswered.
+func (r *RestrictedServer) keepalive(ctx context.Context, sc *ssh.ServerConn) {
+	count_max := r.Timeouts.KeepaliveCountMax
+	if count_max <= 0 {
+		count_max = defaultKeepaliveCountMax
+	}
+	ticker := time.NewTicker(r.Timeouts.KeepaliveInterval)
+	defer ticker.Stop()
+	replies := make(chan error, 1)
+	pending := false
+	missed := 0
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case err := <-replies:
+			if err != nil {
+				return
+			}
+			pending = false
+			missed = 0
+		case <-ticker.C:
+			if !pending {
+				pending = true
+				go func() {
+					// clients answer requests they don't know with a failure,
+					// which is all we need
+					_, _, err := sc.SendRequest("keepalive@openssh.com", true, nil)
+					replies <- err
+				}()
+				continue
+			}
+			missed++
+			if missed >= count_max {
+				mon.Meter("conns_timed_out").Mark(1)
+				logger.Noticef("closing connection from %s: %d keepalives "+
+					"unanswered", sc.RemoteAddr(), missed)
+				sc.Close()
+				return
+			}
+		}
+	}
+}
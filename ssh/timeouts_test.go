@@ -0,0 +1,172 @@
+// Copyright (C) 2014 JT Olds
+// See LICENSE for copying information
+
+package ssh
+
+import (
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// stallConn is a client connection that stops reading when stall is
+// called, like a client that's hung.
+type stallConn struct {
+	net.Conn
+	once    sync.Once
+	stalled chan struct{}
+	closed  chan struct{}
+}
+
+func newStallConn(conn net.Conn) *stallConn {
+	return &stallConn{Conn: conn, stalled: make(chan struct{}),
+		closed: make(chan struct{})}
+}
+
+func (c *stallConn) stall() { close(c.stalled) }
+
+func (c *stallConn) Read(p []byte) (int, error) {
+	select {
+	case <-c.stalled:
+		<-c.closed
+		return 0, net.ErrClosed
+	default:
+	}
+	return c.Conn.Read(p)
+}
+
+func (c *stallConn) Close() error {
+	c.once.Do(func() { close(c.closed) })
+	return c.Conn.Close()
+}
+
+// timeoutServer starts a server with timeouts, returning its address and a
+// channel that's told whenever the server is done with a connection.
+func timeoutServer(t *testing.T, timeouts Timeouts) (string,
+	<-chan time.Time) {
+	ended := make(chan time.Time, 10)
+	server := &RestrictedServer{Timeouts: timeouts,
+		SessionEnd: func(meta ssh.ConnMetadata) { ended <- time.Now() }}
+	return testServer(t, server), ended
+}
+
+// connectedFor returns how long the server kept a connection that started
+// at start, or 0 if it still has it after wait.
+func connectedFor(ended <-chan time.Time, start time.Time,
+	wait time.Duration) time.Duration {
+	select {
+	case end := <-ended:
+		return end.Sub(start)
+	case <-time.After(wait):
+		return 0
+	}
+}
+
+func TestHandshakeTimeout(t *testing.T) {
+	addr, _ := timeoutServer(t, Timeouts{
+		HandshakeTimeout: 100 * time.Millisecond})
+	// a client that never starts the handshake
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	start := time.Now()
+	conn.SetReadDeadline(start.Add(5 * time.Second))
+	buf := make([]byte, 1024)
+	for {
+		_, err = conn.Read(buf)
+		if err != nil {
+			break
+		}
+	}
+	if net_err, ok := err.(net.Error); ok && net_err.Timeout() {
+		t.Fatalf("connection still open after %s", time.Since(start))
+	}
+
+	// clients that finish in time keep their connections
+	testClient(t, addr)
+}
+
+func TestIdleTimeout(t *testing.T) {
+	addr, ended := timeoutServer(t, Timeouts{
+		IdleTimeout: 200 * time.Millisecond})
+	start := time.Now()
+	testClient(t, addr)
+	// the client sends nothing after the handshake
+	if held := connectedFor(ended, start, 5*time.Second); held == 0 {
+		t.Fatalf("idle connection kept")
+	} else if held < 200*time.Millisecond {
+		t.Errorf("idle connection closed after %s", held)
+	}
+
+	// a client that's busy isn't idle
+	client := testClient(t, addr)
+	start = time.Now()
+	for time.Since(start) < 500*time.Millisecond {
+		_, _, err := client.SendRequest("ping@gitserve", true, nil)
+		if err != nil {
+			t.Fatalf("busy connection closed after %s", time.Since(start))
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+}
+
+func TestMaxSessionDuration(t *testing.T) {
+	addr, ended := timeoutServer(t, Timeouts{
+		MaxSessionDuration: 200 * time.Millisecond})
+	start := time.Now()
+	client := testClient(t, addr)
+	go func() {
+		for {
+			_, _, err := client.SendRequest("ping@gitserve", true, nil)
+			if err != nil {
+				return
+			}
+			time.Sleep(20 * time.Millisecond)
+		}
+	}()
+	if held := connectedFor(ended, start, 5*time.Second); held == 0 {
+		t.Fatalf("busy connection kept past its maximum duration")
+	} else if held < 200*time.Millisecond {
+		t.Errorf("connection closed after %s", held)
+	}
+}
+
+func TestKeepalive(t *testing.T) {
+	addr, ended := timeoutServer(t, Timeouts{
+		IdleTimeout:       300 * time.Millisecond,
+		KeepaliveInterval: 50 * time.Millisecond,
+		KeepaliveCountMax: 2})
+
+	// answering keepalives is enough to not be idle
+	start := time.Now()
+	testClient(t, addr)
+	if held := connectedFor(ended, start, time.Second); held != 0 {
+		t.Fatalf("connection answering keepalives closed after %s", held)
+	}
+
+	// a client that stops answering is dropped before it'd be idle
+	raw, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn := newStallConn(raw)
+	defer conn.Close()
+	sc, chans, reqs, err := ssh.NewClientConn(conn, addr, testClientConfig(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	client := ssh.NewClient(sc, chans, reqs)
+	defer client.Close()
+	start = time.Now()
+	conn.stall()
+	if held := connectedFor(ended, start, 5*time.Second); held == 0 {
+		t.Fatalf("unresponsive connection kept")
+	} else if held >= 300*time.Millisecond {
+		t.Errorf("unresponsive connection closed after %s, when idle", held)
+	}
+}